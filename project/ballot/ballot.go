@@ -0,0 +1,229 @@
+package ballot
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"strconv"
+	"strings"
+)
+
+// Layout of the ballots of a poll. A ballot is a vector of 0/1 entries, every entry is encrypted
+// separately so the entries of all ballots can be added homomorphically. In polls with weights, the
+// encrypted entries are the weight of the voter times the entry, so the sums are weighted:
+//   - yes/no: a single entry, 1 for yes
+//   - single choice: an entry per option, exactly one of them is 1
+//   - approval: an entry per option, 1 for every approved option
+//   - ranked choice: an entry per rank and option, exactly one option per rank and one rank per option.
+//     The sums tell how often every option got every rank, which is all the Borda count needs.
+//     Instant-runoff would need the full ranking of every ballot, which sums of entries can only tell
+//     with an entry per ranking: ballots that grow with the factorial of the number of options
+
+const (
+	YesNo    = "yesno"
+	Single   = "single"
+	Approval = "approval"
+	Ranked   = "ranked"
+)
+
+// Weights are limited to keep the weighted counts far from overflowing
+const MaxWeight = 1000000
+
+// Type of the ballots of poll, polls without a type are yes/no polls
+func Type(poll *Poll) string {
+	if poll.BallotType == "" {
+		return YesNo
+	}
+	return poll.BallotType
+}
+
+// Check that the options of poll fit its ballot type
+func CheckPoll(poll *Poll) error {
+	switch Type(poll) {
+	case YesNo:
+		if len(poll.Options) != 0 {
+			return errors.New("yes/no polls have no options")
+		}
+	case Single, Approval:
+		if len(poll.Options) < 2 {
+			return errors.New("at least 2 options needed")
+		}
+	case Ranked:
+		if len(poll.Options) < 2 {
+			return errors.New("at least 2 options needed")
+		}
+	default:
+		return fmt.Errorf("unknown ballot type %v", poll.BallotType)
+	}
+
+	if len(poll.Weights) != 0 && len(poll.Weights) != len(poll.Voters) {
+		return fmt.Errorf("%v weights for %v voters", len(poll.Weights), len(poll.Voters))
+	}
+	for _, weight := range poll.Weights {
+		if weight < 1 || weight > MaxWeight {
+			return fmt.Errorf("weights have to be between 1 and %v", MaxWeight)
+		}
+	}
+	return nil
+}
+
+// Weight of the ballot of voter, 0 if voter can't vote on poll
+func Weight(poll *Poll, voter string) int64 {
+	for i, v := range poll.Voters {
+		if v == voter {
+			if len(poll.Weights) == 0 {
+				return 1
+			}
+			return int64(poll.Weights[i])
+		}
+	}
+	return 0
+}
+
+// Sum of the weights of the voters of poll, the largest count any entry can have
+func TotalWeight(poll *Poll) int64 {
+	total := int64(0)
+	seen := make(map[string]bool)
+	for _, voter := range poll.Voters {
+		if !seen[voter] {
+			seen[voter] = true
+			total += Weight(poll, voter)
+		}
+	}
+	return total
+}
+
+// Parse voters written as name or name:weight. The weights are nil if no voter has a weight, voters
+// without weight have weight 1 otherwise
+func ParseVoters(voters []string) ([]string, []uint32, error) {
+	names := make([]string, 0, len(voters))
+	weights := make([]uint32, 0, len(voters))
+	weighted := false
+	for _, voter := range voters {
+		name, weight := voter, uint64(1)
+		if i := strings.LastIndex(voter, ":"); i >= 0 {
+			var err error
+			name = voter[:i]
+			if weight, err = strconv.ParseUint(voter[i+1:], 10, 32); err != nil || weight < 1 || weight > MaxWeight {
+				return nil, nil, fmt.Errorf("invalid weight of %v", name)
+			}
+			weighted = true
+		}
+		names = append(names, name)
+		weights = append(weights, uint32(weight))
+	}
+	if !weighted {
+		return names, nil, nil
+	}
+	return names, weights, nil
+}
+
+// Number of entries of a ballot of poll
+func Size(poll *Poll) int {
+	switch Type(poll) {
+	case Single, Approval:
+		return len(poll.Options)
+	case Ranked:
+		return len(poll.Options) * len(poll.Options)
+	default:
+		return 1
+	}
+}
+
+// Groups of entries of a ballot of poll of which exactly one is 1: all entries of a single choice ballot,
+// every rank and every option of a ranked ballot
+func OneHotGroups(poll *Poll) [][]int {
+	n := len(poll.Options)
+	switch Type(poll) {
+	case Single:
+		group := make([]int, n)
+		for i := range group {
+			group[i] = i
+		}
+		return [][]int{group}
+	case Ranked:
+		groups := make([][]int, 2*n)
+		for k := 0; k < n; k++ {
+			groups[k] = make([]int, n)
+			groups[n+k] = make([]int, n)
+			for i := 0; i < n; i++ {
+				groups[k][i] = rankedEntry(n, k, i)
+				groups[n+k][i] = rankedEntry(n, i, k)
+			}
+		}
+		return groups
+	default:
+		return nil
+	}
+}
+
+// Entry of a ranked ballot of numOptions options that is 1 if option has rank (from 0, the most preferred)
+func rankedEntry(numOptions int, rank int, option int) int {
+	return rank*numOptions + option
+}
+
+// The entries of the ballot for vote: vote.Vote for yes/no polls, vote.Choices (indices of options) otherwise.
+// For ranked polls, the choices are all options from most to least preferred
+func Entries(poll *Poll, vote *NewVote) ([]int64, error) {
+	entries := make([]int64, Size(poll))
+	switch Type(poll) {
+	case YesNo:
+		if vote.Vote {
+			entries[0] = 1
+		}
+	case Single:
+		if len(vote.Choices) != 1 || int(vote.Choices[0]) >= len(poll.Options) {
+			return nil, errors.New("choose exactly one option")
+		}
+		entries[vote.Choices[0]] = 1
+	case Approval:
+		for _, choice := range vote.Choices {
+			if int(choice) >= len(poll.Options) {
+				return nil, fmt.Errorf("unknown option %v", choice)
+			}
+			entries[choice] = 1
+		}
+	case Ranked:
+		n := len(poll.Options)
+		if len(vote.Choices) != n {
+			return nil, errors.New("rank all options")
+		}
+		ranked := make([]bool, n)
+		for rank, choice := range vote.Choices {
+			if int(choice) >= n {
+				return nil, fmt.Errorf("unknown option %v", choice)
+			}
+			if ranked[choice] {
+				return nil, fmt.Errorf("option %v ranked twice", choice)
+			}
+			ranked[choice] = true
+			entries[rankedEntry(n, rank, int(choice))] = 1
+		}
+	}
+	return entries, nil
+}
+
+// Borda count on the counts of a ranked poll of numOptions options: an option gets numOptions-1 points for
+// every ballot that ranks it first, numOptions-2 for every second rank and so on. Returns the winner (-1
+// without votes) and the points of every option. Ties are won by the first of the options
+func Borda(numOptions int, counts []int64) (int, []int64) {
+	points := make([]int64, numOptions)
+	total := int64(0)
+	for rank := 0; rank < numOptions; rank++ {
+		for option := 0; option < numOptions; option++ {
+			count := counts[rankedEntry(numOptions, rank, option)]
+			points[option] += int64(numOptions-1-rank) * count
+			total += count
+		}
+	}
+	if total == 0 {
+		return -1, points
+	}
+	winner := 0
+	for option := range points {
+		if points[option] > points[winner] {
+			winner = option
+		}
+	}
+	return winner, points
+}
@@ -0,0 +1,96 @@
+package ballot
+
+import (
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"reflect"
+	"testing"
+)
+
+func TestEntries(t *testing.T) {
+	yesNo := &Poll{}
+	single := &Poll{BallotType: Single, Options: []string{"a", "b", "c"}}
+	approval := &Poll{BallotType: Approval, Options: []string{"a", "b", "c"}}
+	ranked := &Poll{BallotType: Ranked, Options: []string{"a", "b", "c"}}
+
+	tests := []struct {
+		name     string
+		poll     *Poll
+		vote     *NewVote
+		expected []int64 // nil if the vote is invalid
+	}{
+		{"yes", yesNo, &NewVote{Vote: true}, []int64{1}},
+		{"no", yesNo, &NewVote{}, []int64{0}},
+		{"single choice", single, &NewVote{Choices: []uint32{1}}, []int64{0, 1, 0}},
+		{"two single choices", single, &NewVote{Choices: []uint32{0, 1}}, nil},
+		{"unknown single choice", single, &NewVote{Choices: []uint32{3}}, nil},
+		{"approval", approval, &NewVote{Choices: []uint32{0, 2}}, []int64{1, 0, 1}},
+		{"no approval", approval, &NewVote{}, []int64{0, 0, 0}},
+		{"ranking", ranked, &NewVote{Choices: []uint32{2, 0, 1}}, []int64{0, 0, 1, 1, 0, 0, 0, 1, 0}},
+		{"incomplete ranking", ranked, &NewVote{Choices: []uint32{2, 0}}, nil},
+		{"option ranked twice", ranked, &NewVote{Choices: []uint32{2, 0, 2}}, nil},
+		{"unknown option ranked", ranked, &NewVote{Choices: []uint32{2, 0, 3}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := Entries(test.poll, test.vote)
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("invalid vote accepted as %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("entries %v, expected %v", entries, test.expected)
+			}
+		})
+	}
+}
+
+// Every valid ranking has exactly one entry in every one-hot group
+func TestOneHotGroups(t *testing.T) {
+	poll := &Poll{BallotType: Ranked, Options: []string{"a", "b", "c", "d"}}
+	groups := OneHotGroups(poll)
+	if len(groups) != 8 {
+		t.Fatalf("%v one-hot groups for 4 options", len(groups))
+	}
+	entries, err := Entries(poll, &NewVote{Choices: []uint32{3, 1, 0, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range groups {
+		sum := int64(0)
+		for _, i := range group {
+			sum += entries[i]
+		}
+		if sum != 1 {
+			t.Errorf("%v entries of group %v chosen", sum, group)
+		}
+	}
+}
+
+func TestBorda(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int64 // By rank, then option
+		winner int
+		points []int64
+	}{
+		{"no votes", []int64{0, 0, 0, 0, 0, 0, 0, 0, 0}, -1, []int64{0, 0, 0}},
+		{"one ballot", []int64{0, 0, 1, 1, 0, 0, 0, 1, 0}, 2, []int64{1, 0, 2}},
+		// 2 ballots a > b > c, 2 ballots c > b > a and 1 ballot b > c > a: b is nobody's favourite but
+		// everyone's second choice at worst
+		{"compromise wins", []int64{2, 1, 2, 0, 4, 1, 3, 0, 2}, 1, []int64{4, 6, 5}},
+		{"tie won by the first option", []int64{1, 1, 0, 1, 1, 0, 0, 0, 2}, 0, []int64{3, 3, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			winner, points := Borda(3, test.counts)
+			if winner != test.winner || !reflect.DeepEqual(points, test.points) {
+				t.Errorf("winner %v with %v, expected %v with %v", winner, points, test.winner, test.points)
+			}
+		})
+	}
+}
@@ -1,63 +1,166 @@
 package blockchain
 
 import (
-	"bitbucket.org/ustraca/crypto/paillier"
+	"bytes"
+	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
+	"github.com/lukasdeloose/decentralized-voting-system/project/threshold"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
-	"strings"
+	"github.com/lukasdeloose/decentralized-voting-system/project/zkp"
+	"math/big"
 	"sync"
 	"time"
 )
 
 // Blockchain implementation
 
+// Blocks can't be timestamped further in the future than this
+const maxClockDrift = 2 * time.Minute
+
 type Blockchain struct {
-	Transactions            chan *Transaction
-	unconfirmedTransactions Transactions
-	TransactionsLock        sync.RWMutex
+	Transactions chan *Transaction
+	mempool      *Mempool // Transactions that are not on the main chain yet
 
-	Blocks         []*Block
+	Blocks         []*Block              // Main chain, from genesis to the tip
+	tree           map[string]*blockNode // All valid blocks we know of, by hash
+	orphans        map[string][]*Block   // Blocks of which the parent is unknown, by hash of the parent
+	missingParents chan string           // Hashes of unknown parents of orphans, to be requested from peers
+	chainMutex     *sync.Mutex           // Serializes changes to the tree and the main chain
+	finalized      *Block                // Last block finalized by the validators, it is never rolled back
+	finality       []*FinalityVote       // Precommits of the validators that finalized it
+	pruned         uint32                // Side branches forking off the main chain below this block are dropped
 	nextRegisterId uint32
 	nextVoteId     uint32
 	nextPollId     uint32
 	nextResultId   uint32
 
-	difficulty int
+	config    ChainConfig    // From the genesis block, never changes
+	consensus Consensus      // Engine of the consensus in config
+	group     *elgamal.Group // Group of the keys of all polls, from config
+
+	Registry    []*RegisterTx
+	PublicKeys  map[string]*rsa.PublicKey
+	Votes       map[uint32][]*VoteTx   // Votes by pollID
+	Revotes     map[uint32][]*RevoteTx // Revotes by pollID, in the order of the chain
+	Polls       []*PollTx
+	Results     map[uint32]*ResultTx // Results by pollID
+	txBlocks    map[string]uint32    // ID of the block of the main chain of every transaction, by hash
+	delegations []*chainDelegation   // In the order of the chain
+	mutex       *sync.RWMutex
 
-	Registry   []*RegisterTx
-	PublicKeys map[string]*rsa.PublicKey
-	Votes      map[uint32][]*VoteTx // Votes by pollID
-	Polls      []*PollTx
-	Results    map[uint32]*ResultTx // Results by pollID
-	mutex      *sync.RWMutex
+	storage *Storage // nil if the chain is only kept in memory
+}
+
+// Create a blockchain for the network of the genesis file
+func NewBlockChain(genesis *Genesis) (*Blockchain, error) {
+	block, err := genesis.Block()
+	if err != nil {
+		return nil, err
+	}
+	return newBlockChain(block)
 }
 
-func NewBlockChain() *Blockchain {
+func newBlockChain(genesis *Block) (*Blockchain, error) {
+	consensus, err := NewConsensus(*genesis.Config)
+	if err != nil {
+		return nil, err
+	}
+	group, err := elgamal.StandardGroup(int(genesis.Config.ElGamalKeyBits))
+	if err != nil {
+		return nil, err
+	}
 	Blocks := make([]*Block, 1)
-	Blocks[0] = &Block{
-		ID:           0,
-		Timestamp:    time.Now(),
-		Transactions: Transactions{},
-		Difficulty:   1,
-		Nonce:        "",
-		PrevHash:     "0",
-	} // Genesis block
-	Blocks[0].Hash = calculateHash(Blocks[0])
-	return &Blockchain{
-		Transactions:            make(chan *Transaction),
-		Registry:                make([]*RegisterTx, 0),
-		Votes:                   make(map[uint32][]*VoteTx),
-		Polls:                   make([]*PollTx, 0),
-		Results:                 make(map[uint32]*ResultTx),
-		PublicKeys:              make(map[string]*rsa.PublicKey),
-		unconfirmedTransactions: Transactions{},
-		Blocks:                  Blocks,
-		difficulty:              1,
-		mutex:                   &sync.RWMutex{},
+	Blocks[0] = genesis
+	b := &Blockchain{
+		Transactions:   make(chan *Transaction),
+		Registry:       make([]*RegisterTx, 0),
+		Votes:          make(map[uint32][]*VoteTx),
+		Revotes:        make(map[uint32][]*RevoteTx),
+		delegations:    make([]*chainDelegation, 0),
+		Polls:          make([]*PollTx, 0),
+		Results:        make(map[uint32]*ResultTx),
+		txBlocks:       make(map[string]uint32),
+		PublicKeys:     make(map[string]*rsa.PublicKey),
+		Blocks:         Blocks,
+		tree:           map[string]*blockNode{genesis.Hash: {block: genesis, work: consensus.Weight(genesis)}},
+		orphans:        make(map[string][]*Block),
+		missingParents: make(chan string, 16),
+		chainMutex:     &sync.Mutex{},
+		finalized:      genesis,
+		config:         *genesis.Config,
+		consensus:      consensus,
+		group:          group,
+		mutex:          &sync.RWMutex{},
 	}
+	b.mempool = NewMempool(b.pendingValid, b.validAtTip)
+	// The users in the genesis block are registered from the start
+	b.addTransactions(genesis.Transactions, genesis.Timestamp)
+	b.indexTransactions(genesis, true)
+	return b, nil
+}
+
+// Create a blockchain backed by storage: the stored blocks are re-validated and replayed on top
+// of the stored genesis block. Replaying stops at the first invalid block, which is removed from
+// the storage together with all blocks following it.
+// The stored genesis block has to be the genesis block of genesis: the storage can't be reused for another network
+func LoadBlockChain(storage *Storage, genesis *Genesis) (*Blockchain, error) {
+	expected, err := genesis.Block()
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blocks) == 0 {
+		// Fresh storage: persist our genesis block
+		b, err := newBlockChain(expected)
+		if err != nil {
+			return nil, err
+		}
+		b.storage = storage
+		return b, storage.Append(b.Blocks[0])
+	}
+
+	if blocks[0].Hash != expected.Hash || calculateHash(blocks[0]) != expected.Hash {
+		return nil, fmt.Errorf("stored blocks are of another network: genesis block %v, expected %v",
+			blocks[0].Hash, expected.Hash)
+	}
+	b, err := newBlockChain(expected)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range blocks[1:] {
+		if err := b.blockValid(block); err != nil {
+			fmt.Printf("STORAGE block %v is invalid, dropping it and all later blocks: %v\n", block.ID, err)
+			if err := storage.Truncate(block.ID); err != nil {
+				return nil, err
+			}
+			break
+		}
+		b.appendBlock(block)
+	}
+	fmt.Printf("STORAGE loaded %v blocks\n", len(b.Blocks))
+	if err := b.restoreFinality(storage); err != nil {
+		fmt.Printf("STORAGE could not restore the finalized block: %v\n", err)
+	}
+
+	b.pruneBranches()
+	// Only attach the storage now, the loaded blocks are already stored
+	b.storage = storage
+	return b, nil
+}
+
+// Configuration of the network, as recorded in the genesis block
+func (b *Blockchain) Config() ChainConfig {
+	return b.config
 }
 
 func (b *Blockchain) GetPoll(pollId uint32) *PollTx {
@@ -92,6 +195,55 @@ func (b *Blockchain) GetVotes(pollId uint32) []*VoteTx {
 
 }
 
+// Whether the chain has a vote of origin on the poll
+func (b *Blockchain) HasVoted(pollId uint32, origin string) bool {
+	return b.LatestBallot(pollId, origin) != nil
+}
+
+// Hash of the last ballot of origin on the poll on the chain: of its last revote, or of its vote if it
+// didn't revote. nil if origin didn't vote
+func (b *Blockchain) LatestBallot(pollId uint32, origin string) []byte {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	revotes := b.Revotes[pollId]
+	for i := len(revotes) - 1; i >= 0; i-- {
+		if revotes[i].Revote.Vote.Origin == origin {
+			return revotes[i].Hash()
+		}
+	}
+	for _, vote := range b.Votes[pollId] {
+		if vote.Vote.Origin == origin {
+			return vote.Hash()
+		}
+	}
+	return nil
+}
+
+// Hash of the last ballot of origin on the poll, counting the pending transactions: a pending vote if origin
+// didn't vote on the chain, and the pending revotes that supersede the last ballot in turn. nil if origin
+// didn't vote
+func (b *Blockchain) LatestPendingBallot(pollId uint32, origin string) []byte {
+	latest := b.LatestBallot(pollId, origin)
+	pending := b.mempool.Transactions()
+	if latest == nil {
+		for _, tx := range pending.Votes {
+			if tx.Vote.PollID == pollId && tx.Vote.Origin == origin {
+				latest = tx.Hash()
+				break
+			}
+		}
+	}
+	// Revotes come after the revote or vote they supersede
+	for _, tx := range pending.Revotes {
+		vote := tx.Revote.Vote
+		if vote.PollID == pollId && vote.Origin == origin && latest != nil && bytes.Equal(tx.Revote.Supersedes, latest) {
+			latest = tx.Hash()
+		}
+	}
+	return latest
+}
+
 func (b *Blockchain) GetResult(pollId uint32) *ResultTx {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
@@ -99,6 +251,14 @@ func (b *Blockchain) GetResult(pollId uint32) *ResultTx {
 	return b.Results[pollId]
 }
 
+// Last block of the main chain
+func (b *Blockchain) Tip() *Block {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.lastBlock()
+}
+
 func (b *Blockchain) lastBlock() *Block {
 	return b.Blocks[len(b.Blocks)-1]
 }
@@ -107,95 +267,52 @@ func (b *Blockchain) length() int {
 	return len(b.Blocks)
 }
 
-func (b *Blockchain) addUnconfirmedTransactions(tx Transactions) {
-	b.TransactionsLock.Lock()
-	defer b.TransactionsLock.Unlock()
-
-	if tx.Polls != nil {
-		b.unconfirmedTransactions.Polls = append(b.unconfirmedTransactions.Polls, tx.Polls...)
+// Check if block can be appended to the chain
+func (b *Blockchain) blockValid(block *Block) error {
+	if block.ID != uint32(b.length()) {
+		return fmt.Errorf("expected block %v, got %v", b.length(), block.ID)
 	}
-	if tx.Votes != nil {
-		b.unconfirmedTransactions.Votes = append(b.unconfirmedTransactions.Votes, tx.Votes...)
+	if block.PrevHash != b.lastBlock().Hash {
+		return fmt.Errorf("previous hash does not match")
 	}
-	if tx.Registers != nil {
-		b.unconfirmedTransactions.Registers = append(b.unconfirmedTransactions.Registers, tx.Registers...)
+	if !hashesValid(block) {
+		return fmt.Errorf("invalid hashes")
 	}
-	if tx.Results != nil {
-		b.unconfirmedTransactions.Results = append(b.unconfirmedTransactions.Results, tx.Results...)
+	if err := b.consensus.VerifyHeader(block); err != nil {
+		return err
 	}
-}
-
-func (b *Blockchain) addUnconfirmedTransaction(tx Transaction) {
-	b.TransactionsLock.Lock()
-	defer b.TransactionsLock.Unlock()
-
-	if tx.PollTx != nil {
-		b.unconfirmedTransactions.Polls = append(b.unconfirmedTransactions.Polls, tx.PollTx)
+	if err := b.consensus.VerifySeal(b, block, b.tipNode()); err != nil {
+		return err
 	}
-	if tx.VoteTx != nil {
-		b.unconfirmedTransactions.Votes = append(b.unconfirmedTransactions.Votes, tx.VoteTx)
-		fmt.Println("Adding vote")
+	if block.Timestamp.Before(b.lastBlock().Timestamp) {
+		return fmt.Errorf("timestamp before the previous block")
 	}
-	if tx.RegisterTx != nil {
-		b.unconfirmedTransactions.Registers = append(b.unconfirmedTransactions.Registers, tx.RegisterTx)
+	if block.Timestamp.After(time.Now().Add(maxClockDrift)) {
+		return fmt.Errorf("timestamp too far in the future")
 	}
-	if tx.ResultTx != nil {
-		b.unconfirmedTransactions.Results = append(b.unconfirmedTransactions.Results, tx.ResultTx)
+	if _, ok := b.checkTransactions(block.Transactions, block.Timestamp, false); !ok {
+		return fmt.Errorf("invalid transactions")
 	}
+	return nil
 }
 
-func (b *Blockchain) removeConfirmedTx(tx Transactions) {
-	b.TransactionsLock.Lock()
-	defer b.TransactionsLock.Unlock()
+// Append a block to the chain, apply its transactions and persist it if the chain has a storage
+func (b *Blockchain) appendBlock(block *Block) {
+	b.insertNode(block)
 
-	// Keep only votes that are not confirmed
-	newVotes := b.unconfirmedTransactions.Votes[:0]
-	for _, unconfirmedVote := range b.unconfirmedTransactions.Votes {
-		found := false
-		for _, confirmedVote := range tx.Votes {
-			if confirmedVote.Vote == unconfirmedVote.Vote {
-				found = true
-			}
-		}
-		if !found {
-			newVotes = append(newVotes, unconfirmedVote)
-		}
-	}
-	b.unconfirmedTransactions.Votes = newVotes
+	b.mutex.Lock()
+	b.Blocks = append(b.Blocks, block)
+	b.indexTransactions(block, true)
+	b.mutex.Unlock()
 
-	// Polls
-	newPolls := b.unconfirmedTransactions.Polls[:0]
-	for _, unconfirmedPoll := range b.unconfirmedTransactions.Polls {
-		found := false
-		for _, confirmedPoll := range tx.Polls {
-			if confirmedPoll.Poll.IsEqual(unconfirmedPoll.Poll) {
-				fmt.Println("transaction was confirmed", unconfirmedPoll.Poll.Origin, unconfirmedPoll.Poll.Id)
-				found = true
-			}
-		}
-		if !found {
-			newPolls = append(newPolls, unconfirmedPoll)
-		}
-	}
-	b.unconfirmedTransactions.Polls = newPolls
+	b.addTransactions(block.Transactions, block.Timestamp)
+	b.mempool.Remove(block.Transactions)
 
-	// Polls
-	newRegisters := b.unconfirmedTransactions.Registers[:0]
-	for _, unconfirmedRegister := range b.unconfirmedTransactions.Registers {
-		found := false
-		for _, confirmedRegister := range tx.Registers {
-			if confirmedRegister.Registry.Origin == unconfirmedRegister.Registry.Origin {
-				fmt.Println("register was confirmed", confirmedRegister.Registry.Origin)
-				found = true
-			}
-		}
-		if !found {
-			newRegisters = append(newRegisters, unconfirmedRegister)
+	if b.storage != nil {
+		if err := b.storage.Append(block); err != nil {
+			fmt.Printf("ERROR: could not store block %v: %v\n", block.ID, err)
 		}
 	}
-	b.unconfirmedTransactions.Registers = newRegisters
-
-	// TODO:  results
 }
 
 func (b *Blockchain) GetPolls() []*PollTx {
@@ -221,6 +338,10 @@ func (b *Blockchain) AddTransaction(t *Transaction) {
 	} else if t.VoteTx != nil {
 		b.Votes[t.VoteTx.Vote.PollID] = append(b.Votes[t.VoteTx.Vote.PollID], t.VoteTx)
 		fmt.Printf("BLOCKCHAIN ADD votetx for %v\n", t.VoteTx.Vote.PollID)
+	} else if t.RevoteTx != nil {
+		pollid := t.RevoteTx.Revote.Vote.PollID
+		b.Revotes[pollid] = append(b.Revotes[pollid], t.RevoteTx)
+		fmt.Printf("BLOCKCHAIN ADD revotetx for %v\n", pollid)
 	} else if t.RegisterTx != nil {
 		b.Registry = append(b.Registry, t.RegisterTx)
 		pubKey := t.RegisterTx.Registry.PublicKey.ToRSA()
@@ -232,13 +353,18 @@ func (b *Blockchain) AddTransaction(t *Transaction) {
 	}
 }
 
-func (b *Blockchain) addTransactions(t Transactions) {
+// Apply the transactions of a block with the given timestamp
+func (b *Blockchain) addTransactions(t Transactions, timestamp time.Time) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
 	for _, vote := range t.Votes {
 		b.Votes[vote.Vote.PollID] = append(b.Votes[vote.Vote.PollID], vote)
 	}
+	for _, revote := range t.Revotes {
+		pollid := revote.Revote.Vote.PollID
+		b.Revotes[pollid] = append(b.Revotes[pollid], revote)
+	}
 
 	fmt.Println(t.Polls)
 	for _, poll := range t.Polls {
@@ -249,24 +375,81 @@ func (b *Blockchain) addTransactions(t Transactions) {
 
 	for _, register := range t.Registers {
 		b.Registry = append(b.Registry, register)
+		pubKey := register.Registry.PublicKey.ToRSA()
+		b.PublicKeys[register.Registry.Origin] = &pubKey
 	}
 
 	for _, result := range t.Results {
 		b.Results[result.Result.PollId] = result
 	}
+
+	// After the results: a delegation doesn't apply to the polls that are counted in its block
+	for _, delegation := range t.Delegations {
+		b.delegations = append(b.delegations, b.newChainDelegation(delegation, timestamp))
+	}
 }
 
-func (b *Blockchain) PollKey(pollid uint32) (paillier.PublicKey, bool) {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+// Roll back the effects of addTransactions
+func (b *Blockchain) removeTransactions(t Transactions) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-	for _, poll := range b.Polls {
-		if poll.ID == pollid {
-			return poll.Poll.PublicKey.ToPaillier(), true
+	for _, vote := range t.Votes {
+		votes := b.Votes[vote.Vote.PollID]
+		for i, v := range votes {
+			if v == vote {
+				b.Votes[vote.Vote.PollID] = append(votes[:i:i], votes[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, revote := range t.Revotes {
+		pollid := revote.Revote.Vote.PollID
+		revotes := b.Revotes[pollid]
+		for i, r := range revotes {
+			if r == revote {
+				b.Revotes[pollid] = append(revotes[:i:i], revotes[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for _, poll := range t.Polls {
+		for i, p := range b.Polls {
+			if p == poll {
+				b.Polls = append(b.Polls[:i:i], b.Polls[i+1:]...)
+				b.nextPollId--
+				delete(b.Votes, poll.ID)
+				delete(b.Revotes, poll.ID)
+				break
+			}
+		}
+	}
+
+	for _, register := range t.Registers {
+		for i, r := range b.Registry {
+			if r == register {
+				b.Registry = append(b.Registry[:i:i], b.Registry[i+1:]...)
+				delete(b.PublicKeys, register.Registry.Origin)
+				break
+			}
+		}
+	}
+
+	for _, result := range t.Results {
+		if b.Results[result.Result.PollId] == result {
+			delete(b.Results, result.Result.PollId)
 		}
 	}
 
-	return paillier.PublicKey{}, false
+	for _, delegation := range t.Delegations {
+		for i, d := range b.delegations {
+			if d.tx == delegation {
+				b.delegations = append(b.delegations[:i:i], b.delegations[i+1:]...)
+				break
+			}
+		}
+	}
 }
 
 func (b *Blockchain) RegistryKey(origin string) (rsa.PublicKey, bool) {
@@ -282,20 +465,218 @@ func (b *Blockchain) RegistryKey(origin string) (rsa.PublicKey, bool) {
 	return rsa.PublicKey{}, false
 }
 
+// The ballots that count on a poll: the last ballot of every voter, in the order of their first vote
 func (b *Blockchain) RetrieveVotes(pollid uint32) []*EncryptedVote {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
 
+	latest := make(map[string]*EncryptedVote)
+	for _, revote := range b.Revotes[pollid] {
+		latest[revote.Revote.Vote.Origin] = revote.Revote.Vote
+	}
 	votes := make([]*EncryptedVote, 0)
 	for _, vote := range b.Votes[pollid] {
-		votes = append(votes, vote.Vote)
+		if revoted, exists := latest[vote.Vote.Origin]; exists {
+			votes = append(votes, revoted)
+		} else {
+			votes = append(votes, vote.Vote)
+		}
 	}
 
 	return votes
 }
 
-func (b *Blockchain) pollValid(pollTx *PollTx, id uint32) bool {
-	// TODO: check signature
+// Homomorphic tally of the votes of a poll: the product of an entry of the encrypted votes encrypts the sum
+// of that entry, so the individual votes never have to be decrypted. A ballot that counts with weight w
+// (see VoteWeights) adds w times its entries
+func (b *Blockchain) AggregateVotes(pollid uint32) ([][]byte, bool) {
+	poll := b.GetPoll(pollid)
+	if poll == nil {
+		return nil, false
+	}
+
+	aggregates := make([]*elgamal.Ciphertext, ballot.Size(poll.Poll))
+	for i := range aggregates {
+		aggregates[i] = elgamal.Zero()
+	}
+	weights := b.VoteWeights(pollid)
+	for _, vote := range b.RetrieveVotes(pollid) {
+		// The ballot encrypts the weight of its voter times the entries, the power w/weight mod q turns that
+		// into w times the entries
+		exponent := new(big.Int).ModInverse(big.NewInt(ballot.Weight(poll.Poll, vote.Origin)), b.group.Q)
+		exponent.Mul(exponent, big.NewInt(weights[vote.Origin])).Mod(exponent, b.group.Q)
+		for i, entry := range vote.Vote {
+			// The ballots on the chain are valid, so their entries are ciphertexts of the group
+			c, err := b.group.Unmarshal(entry)
+			if err != nil {
+				continue
+			}
+			aggregates[i] = b.group.Add(aggregates[i], b.group.Scale(c, exponent))
+		}
+	}
+
+	res := make([][]byte, len(aggregates))
+	for i, aggregate := range aggregates {
+		res[i] = b.group.Marshal(aggregate)
+	}
+	return res, true
+}
+
+// Group of the ElGamal keys of the polls
+func (b *Blockchain) Group() *elgamal.Group {
+	return b.group
+}
+
+// Check that the ballots of poll fit in a block, single choice and approval polls can have any number of options
+func (b *Blockchain) CheckBallotSize(poll *Poll) error {
+	return checkBallotSize(b.group, ballot.Size(poll), len(ballot.OneHotGroups(poll)), b.config.RSAKeyBits)
+}
+
+// Checks if the transactions of a block with the given timestamp are valid.
+// If all are valid, return same Transactions and True
+// Remove invalid Transactions and return False otherwise
+// The miner assigns the IDs of the polls of a new block with assignPollIDs, they have to be right otherwise
+func (b *Blockchain) checkTransactions(transactions Transactions, timestamp time.Time,
+	assignPollIDs bool) (Transactions, bool) {
+	valid := true
+
+	// Registrations first: the other transactions in the block can be signed with the registered keys
+	i := 0
+	registered := make(map[string]*rsa.PublicKey)
+	for _, registerTx := range transactions.Registers {
+		if !b.registerValid(registerTx, registered) {
+			fmt.Println("Invalid register")
+			valid = false
+		} else {
+			pubKey := registerTx.Registry.PublicKey.ToRSA()
+			registered[registerTx.Registry.Origin] = &pubKey
+			transactions.Registers[i] = registerTx
+			i++
+		}
+	}
+	transactions.Registers = transactions.Registers[:i]
+
+	i = 0
+	id := b.nextPollId
+	for _, pollTx := range transactions.Polls {
+		if assignPollIDs {
+			pollTx.ID = id
+		}
+		if !b.pollValid(pollTx, id, registered) {
+			valid = false
+			fmt.Println("Poll invalid")
+		} else {
+			id++
+			transactions.Polls[i] = pollTx
+			i++
+		}
+	}
+	transactions.Polls = transactions.Polls[:i]
+
+	// Results before votes: a poll is closed once its result is published
+	i = 0
+	counted := make(map[uint32]bool)
+	for _, resultTx := range transactions.Results {
+		if !b.resultValid(resultTx, counted, timestamp) {
+			fmt.Println("Invalid result")
+			valid = false
+		} else {
+			counted[resultTx.Result.PollId] = true
+			transactions.Results[i] = resultTx
+			i++
+		}
+	}
+	transactions.Results = transactions.Results[:i]
+
+	i = 0
+	ballots := make(map[uint32]map[string][]byte)
+	for _, voteTx := range transactions.Votes {
+		if !b.voteValid(voteTx, registered, counted, ballots, timestamp) {
+			fmt.Println("Invalid vote")
+			valid = false
+		} else {
+			addBallot(ballots, voteTx.Vote, voteTx.Hash())
+			transactions.Votes[i] = voteTx
+			i++
+		}
+	}
+	transactions.Votes = transactions.Votes[:i]
+
+	// Revotes last: they can replace a vote in the same block
+	i = 0
+	for _, revoteTx := range transactions.Revotes {
+		if !b.revoteValid(revoteTx, registered, counted, ballots, timestamp) {
+			fmt.Println("Invalid revote")
+			valid = false
+		} else {
+			addBallot(ballots, revoteTx.Revote.Vote, revoteTx.Hash())
+			transactions.Revotes[i] = revoteTx
+			i++
+		}
+	}
+	transactions.Revotes = transactions.Revotes[:i]
+
+	i = 0
+	delegations := make([]*DelegationTx, 0)
+	for _, delegationTx := range transactions.Delegations {
+		if !b.delegationValid(delegationTx, registered, counted, delegations, timestamp) {
+			fmt.Println("Invalid delegation")
+			valid = false
+		} else {
+			delegations = append(delegations, delegationTx)
+			transactions.Delegations[i] = delegationTx
+			i++
+		}
+	}
+	transactions.Delegations = transactions.Delegations[:i]
+
+	return transactions, valid
+}
+
+// The transactions of txs that are valid in a block on top of the main chain now
+func (b *Blockchain) validAtTip(txs Transactions) Transactions {
+	valid, _ := b.checkTransactions(txs, time.Now(), true)
+	return valid
+}
+
+// Checks of a received transaction before it enters the mempool: registrations and results get the checks
+// of a block, the other transactions have to be signed by their origin, registered on the chain or by a
+// pending registration. What depends on the other transactions of a block is checked in the block
+func (b *Blockchain) pendingValid(pending *pendingTx, pendingKeys map[string]*rsa.PublicKey) error {
+	var msg interface{}
+	var signature []byte
+	switch pending.kind {
+	case RegisterLeaf:
+		if !b.registerValid(pending.register, pendingKeys) {
+			return fmt.Errorf("invalid registration of %v", pending.origin)
+		}
+		return nil
+	case ResultLeaf:
+		if !b.resultValid(pending.result, make(map[uint32]bool), time.Now()) {
+			return fmt.Errorf("invalid result of poll %v", pending.result.Result.PollId)
+		}
+		return nil
+	case VoteLeaf:
+		msg, signature = pending.vote.Vote, pending.vote.Signature
+	case PollLeaf:
+		msg, signature = pending.poll.Poll, pending.poll.Signature
+	case RevoteLeaf:
+		msg, signature = pending.revote.Revote, pending.revote.Signature
+	case DelegationLeaf:
+		msg, signature = pending.delegation.Delegation, pending.delegation.Signature
+	}
+
+	pubKey := b.originKey(pending.origin, pendingKeys)
+	if pubKey == nil {
+		return fmt.Errorf("origin %v is not registered", pending.origin)
+	}
+	if !SignatureValid(pubKey, msg, signature) {
+		return fmt.Errorf("invalid signature of %v", pending.origin)
+	}
+	return nil
+}
+
+func (b *Blockchain) pollValid(pollTx *PollTx, id uint32, registered map[string]*rsa.PublicKey) bool {
 	// Check if ID is unique, in known polls and this transaction
 	if pollTx.ID != id {
 		fmt.Println("ID is wrong")
@@ -303,14 +684,65 @@ func (b *Blockchain) pollValid(pollTx *PollTx, id uint32) bool {
 		return false
 	}
 
-	if pollTx.Poll.Question == "" {
+	if pollTx.Poll == nil || pollTx.Poll.Question == "" {
+		return false
+	}
+	if err := ballot.CheckPoll(pollTx.Poll); err != nil {
+		fmt.Printf("INVALID POLLTX: %v\n", err)
+		return false
+	}
+	if err := b.CheckBallotSize(pollTx.Poll); err != nil {
+		fmt.Printf("INVALID POLLTX: %v\n", err)
+		return false
+	}
+	if !pollTx.Poll.Opening.IsZero() && !pollTx.Poll.Deadline.IsZero() && !pollTx.Poll.Deadline.After(pollTx.Poll.Opening) {
+		fmt.Printf("INVALID POLLTX: deadline before opening\n")
+		return false
+	}
+
+	// The trustees generated the key together, signing their dealings with their registered key
+	if pollTx.Poll.Threshold < 1 || int(pollTx.Poll.Threshold) > len(pollTx.Poll.Trustees) {
+		fmt.Printf("INVALID POLLTX: threshold %v for %v trustees\n", pollTx.Poll.Threshold, len(pollTx.Poll.Trustees))
+		return false
+	}
+	if !DistinctStrings(pollTx.Poll.Trustees) {
+		fmt.Printf("INVALID POLLTX: a trustee appears twice\n")
+		return false
+	}
+	for _, trustee := range pollTx.Poll.Trustees {
+		if b.originKey(trustee, registered) == nil {
+			fmt.Printf("INVALID POLLTX: trustee %v is not registered\n", trustee)
+			return false
+		}
+	}
+	if !b.dealingsValid(pollTx.Poll, registered) {
+		return false
+	}
+
+	// The creator has to be registered, and has to have signed the poll
+	pubKey := b.originKey(pollTx.Poll.Origin, registered)
+	if pubKey == nil {
+		fmt.Printf("INVALID POLLTX: cannot find origin %v\n", pollTx.Poll.Origin)
+		return false
+	}
+	if !SignatureValid(pubKey, pollTx.Poll, pollTx.Signature) {
+		fmt.Printf("INVALID POLLTX: invalid signature\n")
 		return false
 	}
 	return true
 }
 
-func (b *Blockchain) voteValid(voteTx *VoteTx) bool {
-	// TODO: check signature
+// Remember the hash of the last ballot of the voter of vote in this block, ballots has the hashes by pollID and voter
+func addBallot(ballots map[uint32]map[string][]byte, vote *EncryptedVote, hash []byte) {
+	if ballots[vote.PollID] == nil {
+		ballots[vote.PollID] = make(map[string][]byte)
+	}
+	ballots[vote.PollID][vote.Origin] = hash
+}
+
+// The vote has to be by a voter who didn't vote on the poll yet (on the chain, or in ballots)
+func (b *Blockchain) voteValid(voteTx *VoteTx, registered map[string]*rsa.PublicKey, counted map[uint32]bool,
+	ballots map[uint32]map[string][]byte, timestamp time.Time) bool {
 	// Check if ID is unique, in known polls and this transaction
 	nextVoteId := b.nextVoteId
 	if voteTx.ID != nextVoteId {
@@ -318,32 +750,322 @@ func (b *Blockchain) voteValid(voteTx *VoteTx) bool {
 	}
 	nextVoteId++
 
+	if voteTx.Vote == nil {
+		return false
+	}
+
+	// The voter has to be registered, and has to have signed the vote
+	pubKey := b.originKey(voteTx.Vote.Origin, registered)
+	if pubKey == nil {
+		fmt.Printf("INVALID VOTETX: cannot find origin %v\n", voteTx.Vote.Origin)
+		return false
+	}
+	if !SignatureValid(pubKey, voteTx.Vote, voteTx.Signature) {
+		fmt.Printf("INVALID VOTETX: invalid signature\n")
+		return false
+	}
+
+	// One vote per voter, changing it takes a revote
+	if ballots[voteTx.Vote.PollID][voteTx.Vote.Origin] != nil || b.HasVoted(voteTx.Vote.PollID, voteTx.Vote.Origin) {
+		fmt.Printf("INVALID VOTETX: %v already voted on poll %v\n", voteTx.Vote.Origin, voteTx.Vote.PollID)
+		return false
+	}
+	return b.ballotValid("VOTETX", voteTx.Vote, voteTx.Proofs, voteTx.SumProofs, counted, timestamp)
+}
+
+// The revote has to replace the last ballot of the voter on the poll (on the chain, or in ballots)
+func (b *Blockchain) revoteValid(revoteTx *RevoteTx, registered map[string]*rsa.PublicKey, counted map[uint32]bool,
+	ballots map[uint32]map[string][]byte, timestamp time.Time) bool {
+	if revoteTx.Revote == nil || revoteTx.Revote.Vote == nil {
+		return false
+	}
+	vote := revoteTx.Revote.Vote
+
+	// The voter has to be registered, and has to have signed the revote
+	pubKey := b.originKey(vote.Origin, registered)
+	if pubKey == nil {
+		fmt.Printf("INVALID REVOTETX: cannot find origin %v\n", vote.Origin)
+		return false
+	}
+	if !SignatureValid(pubKey, revoteTx.Revote, revoteTx.Signature) {
+		fmt.Printf("INVALID REVOTETX: invalid signature\n")
+		return false
+	}
+
+	latest := ballots[vote.PollID][vote.Origin]
+	if latest == nil {
+		latest = b.LatestBallot(vote.PollID, vote.Origin)
+	}
+	if latest == nil {
+		fmt.Printf("INVALID REVOTETX: %v did not vote on poll %v yet\n", vote.Origin, vote.PollID)
+		return false
+	}
+	if !bytes.Equal(revoteTx.Revote.Supersedes, latest) {
+		fmt.Printf("INVALID REVOTETX: does not replace the last ballot of %v on poll %v\n", vote.Origin, vote.PollID)
+		return false
+	}
+	return b.ballotValid("REVOTETX", vote, revoteTx.Proofs, revoteTx.SumProofs, counted, timestamp)
+}
+
+// The encrypted vote has to be a valid ballot of a voter of a poll that is open at timestamp and that has
+// no result yet (on the chain, or in counted). kind is the kind of transaction, for the logs
+func (b *Blockchain) ballotValid(kind string, vote *EncryptedVote, proofs []*BallotProof, sumProofs []*BallotProof,
+	counted map[uint32]bool, timestamp time.Time) bool {
 	// Poll exists
-	if voteTx.Vote.PollID >= b.nextPollId {
+	poll := b.GetPoll(vote.PollID)
+	if poll == nil {
+		fmt.Printf("INVALID %v: poll %v does not exist\n", kind, vote.PollID)
+		return false
+	}
+
+	// Votes can't change a published result
+	if counted[vote.PollID] || b.GetResult(vote.PollID) != nil {
+		fmt.Printf("INVALID %v: poll %v is already counted\n", kind, vote.PollID)
 		return false
 	}
 
+	// The block has to be mined while the poll is open
+	if !poll.Poll.IsOpen(timestamp) {
+		fmt.Printf("INVALID %v: poll %v is not open at %v\n", kind, vote.PollID, timestamp)
+		return false
+	}
+
+	// The voter is allowed to vote on the poll
+	weight := ballot.Weight(poll.Poll, vote.Origin)
+	if weight == 0 {
+		fmt.Printf("INVALID %v: %v is not allowed to vote on poll %v\n", kind, vote.Origin, vote.PollID)
+		return false
+	}
+
+	// The encrypted vote is a valid ballot for the poll
+	if len(vote.Vote) != ballot.Size(poll.Poll) {
+		fmt.Printf("INVALID %v: ballot has %v entries, expected %v\n", kind, len(vote.Vote), ballot.Size(poll.Poll))
+		return false
+	}
+	h := new(big.Int).SetBytes(poll.Poll.PublicKey)
+	context := zkp.BallotContext(vote.Origin, vote.PollID)
+	if !zkp.VerifyBallot(b.group, h, vote.Vote, proofs, sumProofs, weight, ballot.OneHotGroups(poll.Poll), context) {
+		fmt.Printf("INVALID %v: invalid ballot proof from %v\n", kind, vote.Origin)
+		return false
+	}
 	return true
 }
 
-func (b *Blockchain) registerValid(registerTx *RegisterTx) bool {
-	// TODO
+// The result has to be the decryption of the aggregated votes of a poll that has no result yet (on the
+// chain, or in counted). Every node can check this: the partial decryptions of the trustees come with
+// proofs, and are combined to the count
+func (b *Blockchain) resultValid(resultTx *ResultTx, counted map[uint32]bool, timestamp time.Time) bool {
+	if resultTx.Result == nil {
+		return false
+	}
+	result := resultTx.Result
+
+	poll := b.GetPoll(result.PollId)
+	if poll == nil {
+		fmt.Printf("INVALID RESULT: poll %v does not exist\n", result.PollId)
+		return false
+	}
+	if counted[result.PollId] || b.GetResult(result.PollId) != nil {
+		fmt.Printf("INVALID RESULT: poll %v already has a result\n", result.PollId)
+		return false
+	}
+	// Counting closes the poll, which can't happen before its deadline
+	if !poll.Poll.Deadline.IsZero() && !poll.Poll.IsClosed(timestamp) {
+		fmt.Printf("INVALID RESULT: poll %v is open until %v\n", result.PollId, poll.Poll.Deadline)
+		return false
+	}
+
+	aggregates, _ := b.AggregateVotes(result.PollId)
+	if len(result.Tallies) != len(aggregates) || len(result.Counts) != len(aggregates) {
+		fmt.Printf("INVALID RESULT: expected %v counts\n", len(aggregates))
+		return false
+	}
+	for i, tally := range result.Tallies {
+		if tally == nil || !bytes.Equal(aggregates[i], tally.Aggregate) {
+			fmt.Printf("INVALID RESULT: aggregate does not match the votes of poll %v\n", result.PollId)
+			return false
+		}
+		count, err := b.DecryptTally(poll.Poll, tally)
+		if err != nil {
+			fmt.Printf("INVALID RESULT: %v\n", err)
+			return false
+		}
+		if count != result.Counts[i] {
+			fmt.Printf("INVALID RESULT: count is %v, decryption gives %v\n", result.Counts[i], count)
+			return false
+		}
+	}
+	return true
+}
+
+// Verify the partial decryptions of the tally, and combine them to the count. The count is the discrete log
+// of the decryption, at most the total weight of the voters of the poll
+func (b *Blockchain) DecryptTally(poll *Poll, tally *Tally) (int64, error) {
+	c, err := b.group.Unmarshal(tally.Aggregate)
+	if err != nil {
+		return 0, err
+	}
+	partials := make(map[int]*big.Int)
+	for _, share := range tally.Decryption {
+		if share == nil || !b.VerifyDecryptionShare(poll, tally.Aggregate, share) {
+			return 0, fmt.Errorf("invalid partial decryption")
+		}
+		if _, exists := partials[int(share.Index)]; exists {
+			return 0, fmt.Errorf("duplicate partial decryption %v", share.Index)
+		}
+		partials[int(share.Index)] = new(big.Int).SetBytes(share.Partial)
+	}
+
+	gm, err := threshold.Combine(b.group, len(poll.Trustees), int(poll.Threshold), c, partials)
+	if err != nil {
+		return 0, err
+	}
+	return b.group.DiscreteLog(gm, ballot.TotalWeight(poll))
+}
+
+// Check the proof that share is a correct partial decryption of aggregate by a trustee of poll
+func (b *Blockchain) VerifyDecryptionShare(poll *Poll, aggregate []byte, share *DecryptionShare) bool {
+	if share.Index < 1 || int(share.Index) > len(poll.VerificationKeys) {
+		return false
+	}
+	c, err := b.group.Unmarshal(aggregate)
+	if err != nil {
+		return false
+	}
+	return threshold.VerifyDecryption(
+		b.group,
+		new(big.Int).SetBytes(poll.VerificationKeys[share.Index-1]),
+		c,
+		new(big.Int).SetBytes(share.Partial),
+		share.Proof,
+	)
+}
+
+// The key of the poll has to be generated by its trustees: at least threshold of them signed a dealing for
+// the terms of the poll with their registered key, and the public key and verification keys follow from the
+// commitments of these dealings
+func (b *Blockchain) dealingsValid(poll *Poll, registered map[string]*rsa.PublicKey) bool {
+	if len(poll.Dealings) < int(poll.Threshold) || len(poll.Dealings) > len(poll.Trustees) ||
+		len(poll.VerificationKeys) != len(poll.Trustees) {
+		fmt.Printf("INVALID POLLTX: expected the dealings of at least %v trustees and a verification key of every "+
+			"trustee\n", poll.Threshold)
+		return false
+	}
+
+	terms := poll.TermsHash()
+	commitments := make([][]*big.Int, len(poll.Dealings))
+	previous := uint32(0)
+	for i, d := range poll.Dealings {
+		if d == nil || d.Dealing == nil || d.Dealing.Index <= previous || int(d.Dealing.Index) > len(poll.Trustees) ||
+			d.Dealing.Session != poll.Dealings[0].Dealing.Session || !bytes.Equal(d.Dealing.Poll, terms) ||
+			!EqualStrings(d.Dealing.Trustees, poll.Trustees) || len(d.Dealing.Commitments) != int(poll.Threshold) {
+			fmt.Printf("INVALID POLLTX: dealing %v does not match the poll\n", i+1)
+			return false
+		}
+		previous = d.Dealing.Index
+		trustee := poll.Trustees[d.Dealing.Index-1]
+		if !SignatureValid(b.originKey(trustee, registered), d.Dealing, d.Signature) {
+			fmt.Printf("INVALID POLLTX: dealing %v is not signed by trustee %v\n", d.Dealing.Index, trustee)
+			return false
+		}
+		commitments[i] = make([]*big.Int, len(d.Dealing.Commitments))
+		for k, c := range d.Dealing.Commitments {
+			commitments[i][k] = new(big.Int).SetBytes(c)
+			if !b.group.Contains(commitments[i][k]) {
+				fmt.Printf("INVALID POLLTX: commitment of dealing %v is not in the group\n", d.Dealing.Index)
+				return false
+			}
+		}
+	}
+
+	if new(big.Int).SetBytes(poll.PublicKey).Cmp(threshold.PublicKey(b.group, commitments)) != 0 {
+		fmt.Printf("INVALID POLLTX: public key does not match the dealings\n")
+		return false
+	}
+	for i, vk := range poll.VerificationKeys {
+		if new(big.Int).SetBytes(vk).Cmp(threshold.VerificationKey(b.group, commitments, i+1)) != 0 {
+			fmt.Printf("INVALID POLLTX: verification key of trustee %v does not match the dealings\n", i+1)
+			return false
+		}
+	}
+	return true
+}
+
+// Whether no string appears twice in names
+func DistinctStrings(names []string) bool {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+	}
+	return true
+}
+
+// Whether a and b have the same strings in the same order
+func EqualStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Every origin can only be registered once, registrations can't be overwritten
+func (b *Blockchain) registerValid(registerTx *RegisterTx, registered map[string]*rsa.PublicKey) bool {
+	if registerTx.Registry == nil || registerTx.Registry.Origin == "" || len(registerTx.Registry.PublicKey.N) == 0 {
+		return false
+	}
+	if b.originKey(registerTx.Registry.Origin, registered) != nil {
+		fmt.Printf("INVALID REGISTERTX: origin %v already exists\n", registerTx.Registry.Origin)
+		return false
+	}
+	for _, authority := range append(append([]string{}, b.config.Signers...), b.config.Validators...) {
+		if authority == registerTx.Registry.Origin {
+			fmt.Printf("INVALID REGISTERTX: %v is an authority, its key is fixed in the genesis block\n", authority)
+			return false
+		}
+	}
+	if bits := registerTx.Registry.PublicKey.ToRSA().N.BitLen(); bits < int(b.config.RSAKeyBits) {
+		fmt.Printf("INVALID REGISTERTX: RSA key of %v bits, at least %v required\n", bits, b.config.RSAKeyBits)
+		return false
+	}
 	return true
 }
 
+// Public key of origin, registered either in the chain or in the block that is being checked
+func (b *Blockchain) originKey(origin string, registered map[string]*rsa.PublicKey) *rsa.PublicKey {
+	if pubKey, exists := registered[origin]; exists {
+		return pubKey
+	}
+	return b.GetPublicKey(origin)
+}
+
+// Check the RSA-PSS signature over the protobuf encoding of msg
+func SignatureValid(pubKey *rsa.PublicKey, msg interface{}, signature []byte) bool {
+	msgBytes, err := protobuf.Encode(msg)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(msgBytes)
+	return rsa.VerifyPSS(pubKey, crypto.SHA256, hash[:], signature, nil) == nil
+}
+
 func calculateHash(block *Block) string {
-	record := block.ToString()
-	h := sha256.New()
-	h.Write([]byte(record))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
+	return block.CalculateHash()
 }
 
 // When receiving a new block from another peer, this function checks if it is valid:
-// - Hash is correct and starts with necessary amount of zeros
+// - Hash is correct
+// - The Merkle root in the header is the root of the transactions of the block
 func hashesValid(block *Block) bool {
-	if !hashValid(block.Hash, block.Difficulty) {
-		fmt.Println("Invalid with difficulty")
+	if !bytes.Equal(block.MerkleRoot, block.Transactions.MerkleRoot()) {
+		fmt.Println("Merkle root different")
 		return false
 	}
 	if block.Hash != calculateHash(block) {
@@ -354,9 +1076,3 @@ func hashesValid(block *Block) bool {
 	}
 	return true
 }
-
-// Hash starts with necessary amount of 0's
-func hashValid(hash string, difficulty int) bool {
-	prefix := strings.Repeat("0", difficulty)
-	return strings.HasPrefix(hash, prefix)
-}
@@ -0,0 +1,188 @@
+package blockchain
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"github.com/dedis/protobuf"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
+	"github.com/lukasdeloose/decentralized-voting-system/project/threshold"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"github.com/lukasdeloose/decentralized-voting-system/project/zkp"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testSign(key *rsa.PrivateKey, msg interface{}) []byte {
+	msgBytes, _ := protobuf.Encode(msg)
+	hash := sha256.Sum256(msgBytes)
+	signature, _ := rsa.SignPSS(rand.Reader, key, crypto.SHA256, hash[:], nil)
+	return signature
+}
+
+func testKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func keyRegistration(origin string, key *rsa.PrivateKey) *RegisterTx {
+	return &RegisterTx{Registry: &Registry{Origin: origin, PublicKey: SerializableRSAPubKey{N: key.N.Bytes(), E: key.E}}}
+}
+
+// Mine a block with the transactions on top of the main chain
+func addTestBlock(t *testing.T, b *Blockchain, txs Transactions) {
+	if !b.AddBlock(mineBlock(b.lastBlock(), "miner", txs)) {
+		t.Fatal("block not added")
+	}
+}
+
+// Register users with new keys on the chain
+func testUsers(t *testing.T, b *Blockchain, names ...string) map[string]*rsa.PrivateKey {
+	keys := make(map[string]*rsa.PrivateKey)
+	registers := make([]*RegisterTx, len(names))
+	for i, name := range names {
+		keys[name] = testKey(t)
+		registers[i] = keyRegistration(name, keys[name])
+	}
+	addTestBlock(t, b, Transactions{Registers: registers})
+	return keys
+}
+
+// Signed poll of which the creator is the only trustee, with the key of the poll
+func testPoll(t *testing.T, b *Blockchain, keys map[string]*rsa.PrivateKey, poll *Poll) (*PollTx, *threshold.KeyShare) {
+	group := b.Group()
+	poll.Trustees = []string{poll.Origin}
+	poll.Threshold = 1
+	polynomial, err := threshold.Deal(group, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitments := [][]*big.Int{polynomial.Commitments()}
+	dealing := &Dealing{Session: "test", Poll: poll.TermsHash(), Trustees: poll.Trustees, Index: 1}
+	for _, c := range commitments[0] {
+		dealing.Commitments = append(dealing.Commitments, c.Bytes())
+	}
+	poll.Dealings = []*KeyDealing{{Dealing: dealing, Signature: testSign(keys[poll.Origin], dealing)}}
+	poll.PublicKey = threshold.PublicKey(group, commitments).Bytes()
+	poll.VerificationKeys = [][]byte{threshold.VerificationKey(group, commitments, 1).Bytes()}
+	share := threshold.NewKeyShare(group, 1, 1, 1, []*big.Int{polynomial.Share(1)})
+	return &PollTx{ID: b.nextPollId, Poll: poll, Signature: testSign(keys[poll.Origin], poll)}, share
+}
+
+// Ballot of voter on the poll with the entries, with its proofs
+func testBallot(t *testing.T, b *Blockchain, voter string, poll *PollTx, entries []int64) (*EncryptedVote,
+	[]*BallotProof, []*BallotProof) {
+	h := new(big.Int).SetBytes(poll.Poll.PublicKey)
+	weight := ballot.Weight(poll.Poll, voter)
+	if weight == 0 {
+		weight = 1
+	}
+	vote, proofs, sumProofs, err := zkp.EncryptBallot(b.Group(), h, entries, weight, ballot.OneHotGroups(poll.Poll),
+		zkp.BallotContext(voter, poll.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &EncryptedVote{Origin: voter, PollID: poll.ID, Vote: vote}, proofs, sumProofs
+}
+
+func testVote(t *testing.T, b *Blockchain, key *rsa.PrivateKey, voter string, poll *PollTx, entries []int64) *VoteTx {
+	vote, proofs, sumProofs := testBallot(t, b, voter, poll, entries)
+	return &VoteTx{Vote: vote, Signature: testSign(key, vote), Proofs: proofs, SumProofs: sumProofs}
+}
+
+func testRevote(t *testing.T, b *Blockchain, key *rsa.PrivateKey, voter string, poll *PollTx, entries []int64,
+	supersedes []byte) *RevoteTx {
+	vote, proofs, sumProofs := testBallot(t, b, voter, poll, entries)
+	revote := &Revote{Vote: vote, Supersedes: supersedes}
+	return &RevoteTx{Revote: revote, Signature: testSign(key, revote), Proofs: proofs, SumProofs: sumProofs}
+}
+
+func TestCheckTransactions(t *testing.T) {
+	b := testChain(t)
+	keys := testUsers(t, b, "alice", "bob", "carol")
+	keys["dave"] = testKey(t)
+	poll, _ := testPoll(t, b, keys, &Poll{Origin: "alice", Question: "q", Voters: []string{"alice", "bob", "dave"}})
+	addTestBlock(t, b, Transactions{Polls: []*PollTx{poll}})
+	bobsVote := testVote(t, b, keys["bob"], "bob", poll, []int64{1})
+	addTestBlock(t, b, Transactions{Votes: []*VoteTx{bobsVote}})
+
+	// Transactions of a new block, made for every test
+	vote := func(voter string, signer string, entries ...int64) *VoteTx {
+		return testVote(t, b, keys[signer], voter, poll, entries)
+	}
+	revote := func(voter string, supersedes []byte) *RevoteTx {
+		return testRevote(t, b, keys[voter], voter, poll, []int64{0}, supersedes)
+	}
+	newPoll := func(creator string, voters ...string) *PollTx {
+		tx, _ := testPoll(t, b, keys, &Poll{Origin: creator, Question: "q", Voters: voters})
+		return tx
+	}
+	alicesVote := vote("alice", "alice", 1)
+	otherBallot := &EncryptedVote{Origin: "alice", PollID: poll.ID, Vote: vote("alice", "alice", 0).Vote.Vote}
+
+	tests := []struct {
+		name string
+		txs  Transactions
+		kept int // Transactions left, the block is valid if none are removed
+	}{
+		{"vote", Transactions{Votes: []*VoteTx{vote("alice", "alice", 1)}}, 1},
+		{"registration and a vote signed with it", Transactions{
+			Registers: []*RegisterTx{keyRegistration("dave", keys["dave"])},
+			Votes:     []*VoteTx{vote("dave", "dave", 0)},
+		}, 2},
+		{"vote of an unregistered voter", Transactions{Votes: []*VoteTx{vote("dave", "dave", 0)}}, 0},
+		{"vote signed by someone else", Transactions{Votes: []*VoteTx{vote("alice", "bob", 1)}}, 0},
+		{"vote of someone who isn't a voter", Transactions{Votes: []*VoteTx{vote("carol", "carol", 1)}}, 0},
+		{"ballot with the proofs of another ballot", Transactions{Votes: []*VoteTx{{
+			Vote:      otherBallot,
+			Signature: testSign(keys["alice"], otherBallot),
+			Proofs:    alicesVote.Proofs,
+			SumProofs: alicesVote.SumProofs,
+		}}}, 0},
+		{"ballot proven for another voter", Transactions{Votes: []*VoteTx{{
+			Vote:      &EncryptedVote{Origin: "alice", PollID: poll.ID, Vote: bobsVote.Vote.Vote},
+			Signature: testSign(keys["alice"], &EncryptedVote{Origin: "alice", PollID: poll.ID, Vote: bobsVote.Vote.Vote}),
+			Proofs:    bobsVote.Proofs,
+			SumProofs: bobsVote.SumProofs,
+		}}}, 0},
+		{"second vote on the chain", Transactions{Votes: []*VoteTx{vote("bob", "bob", 0)}}, 0},
+		{"two votes in the block", Transactions{Votes: []*VoteTx{vote("alice", "alice", 1), vote("alice", "alice", 0)}}, 1},
+		{"revote", Transactions{Revotes: []*RevoteTx{revote("bob", bobsVote.Hash())}}, 1},
+		{"revote of a vote in the block", Transactions{
+			Votes:   []*VoteTx{alicesVote},
+			Revotes: []*RevoteTx{revote("alice", alicesVote.Hash())},
+		}, 2},
+		{"revote without vote", Transactions{Revotes: []*RevoteTx{revote("alice", bobsVote.Hash())}}, 0},
+		{"revote of a superseded ballot", Transactions{
+			Revotes: []*RevoteTx{revote("bob", bobsVote.Hash()), revote("bob", bobsVote.Hash())},
+		}, 1},
+		{"poll", Transactions{Polls: []*PollTx{newPoll("carol", "alice")}}, 1},
+		{"poll of an unregistered creator", Transactions{Polls: []*PollTx{newPoll("dave", "alice")}}, 0},
+		{"vote on a poll of the same block", Transactions{
+			Polls: []*PollTx{newPoll("carol", "alice")},
+			Votes: []*VoteTx{testVote(t, b, keys["alice"], "alice", &PollTx{ID: poll.ID + 1, Poll: poll.Poll}, []int64{1})},
+		}, 1},
+		{"registration of a registered user", Transactions{Registers: []*RegisterTx{keyRegistration("bob", keys["dave"])}}, 0},
+		{"registration twice in the block", Transactions{Registers: []*RegisterTx{
+			keyRegistration("dave", keys["dave"]), keyRegistration("dave", keys["carol"]),
+		}}, 1},
+		{"result of an unknown poll", Transactions{Results: []*ResultTx{{Result: &Result{PollId: 9}}}}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			total := len(test.txs.Leaves())
+			checked, valid := b.checkTransactions(test.txs, time.Now(), false)
+			if kept := len(checked.Leaves()); kept != test.kept {
+				t.Errorf("%v transactions kept, expected %v", kept, test.kept)
+			}
+			if valid != (test.kept == total) {
+				t.Errorf("valid = %v with %v of %v transactions kept", valid, test.kept, total)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+)
+
+const ProofOfWork = "pow"
+const ProofOfAuthority = "poa"
+
+// Consensus engine: decides who may propose blocks, how blocks are sealed so that others accept them,
+// and which branch is the main chain
+type Consensus interface {
+	// Fill in the fields of a new block on top of parent that are up to the engine.
+	// Returns false if we may not propose blocks
+	Prepare(block *Block, parent *blockNode) bool
+
+	// Seal the prepared block with its transactions, signing with key or searching with workers goroutines
+	// if the engine needs it. Returns false if ctx was cancelled before the block was sealed
+	Seal(ctx context.Context, block *Block, key *rsa.PrivateKey, workers int) bool
+
+	// Checks of a received block that don't need the chain, before the block is kept
+	VerifyHeader(block *Block) error
+
+	// Check the seal of a block on top of parent, which is the tip of the main chain
+	VerifySeal(b *Blockchain, block *Block, parent *blockNode) error
+
+	// Weight of a block for the fork choice: the branch with the most cumulative weight is the main chain
+	Weight(block *Block) *big.Int
+}
+
+// The consensus engine of a network, as configured in its genesis block
+func NewConsensus(config ChainConfig) (Consensus, error) {
+	switch config.Consensus {
+	case "", ProofOfWork:
+		if config.InitialDifficulty == 0 {
+			return NewProofOfWorkEngine(initialDifficulty), nil
+		}
+		return NewProofOfWorkEngine(int(config.InitialDifficulty)), nil
+	case ProofOfAuthority:
+		if len(config.Signers) == 0 {
+			return nil, fmt.Errorf("proof-of-authority needs signers")
+		}
+		return NewProofOfAuthorityEngine(config.Signers), nil
+	}
+	return nil, fmt.Errorf("unknown consensus %v", config.Consensus)
+}
+
+// Set the fields of a new block on top of the tip of the main chain, the consensus engine sets the rest.
+// Returns false if the consensus doesn't allow us to propose blocks
+func (b *Blockchain) prepareBlock(block *Block) bool {
+	b.chainMutex.Lock()
+	defer b.chainMutex.Unlock()
+
+	parent := b.tipNode()
+	block.ID = parent.block.ID + 1
+	block.PrevHash = parent.block.Hash
+	// The timestamp is part of the hash, and decides which votes are in time
+	if block.Timestamp.Before(parent.block.Timestamp) {
+		block.Timestamp = parent.block.Timestamp
+	}
+	return b.consensus.Prepare(block, parent)
+}
+
+// Hashes per second while mining the last block, 0 if the consensus is not proof-of-work
+func (b *Blockchain) HashRate() float64 {
+	if pow, ok := b.consensus.(*ProofOfWorkEngine); ok {
+		return pow.HashRate()
+	}
+	return 0
+}
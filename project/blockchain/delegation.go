@@ -0,0 +1,207 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"time"
+)
+
+// ID of a poll that doesn't exist yet, for the delegations that apply to all future polls of a creator
+const futurePoll = ^uint32(0)
+
+// Delegation on the chain
+type chainDelegation struct {
+	tx *DelegationTx
+	// Polls of the creator that were closed or counted when a delegation for all polls of the creator was
+	// added, it doesn't apply to them: a delegation can't change the votes on a poll after its deadline
+	closed map[uint32]bool
+}
+
+// b.mutex has to be held
+func (b *Blockchain) newChainDelegation(tx *DelegationTx, timestamp time.Time) *chainDelegation {
+	closed := make(map[uint32]bool)
+	if creator := tx.Delegation.Creator; creator != "" {
+		for _, poll := range b.Polls {
+			_, counted := b.Results[poll.ID]
+			if poll.Poll.Origin == creator && (counted || poll.Poll.IsClosed(timestamp)) {
+				closed[poll.ID] = true
+			}
+		}
+	}
+	return &chainDelegation{tx: tx, closed: closed}
+}
+
+// The delegations of the chain, followed by the delegations of a block that is validated
+func (b *Blockchain) allDelegations(pending []*DelegationTx) []*chainDelegation {
+	b.mutex.RLock()
+	delegations := make([]*chainDelegation, len(b.delegations), len(b.delegations)+len(pending))
+	copy(delegations, b.delegations)
+	b.mutex.RUnlock()
+
+	for _, tx := range pending {
+		delegations = append(delegations, &chainDelegation{tx: tx})
+	}
+	return delegations
+}
+
+// Delegate of origin on the poll with ID pollid of creator: of the last delegation of origin for the poll,
+// or for all polls of creator while the poll was open. Empty if origin didn't delegate, or revoked it
+func delegateOf(delegations []*chainDelegation, origin string, pollid uint32, creator string) string {
+	for i := len(delegations) - 1; i >= 0; i-- {
+		d := delegations[i].tx.Delegation
+		if d.Origin != origin {
+			continue
+		}
+		forPoll := d.Creator == "" && d.PollID == pollid
+		forCreator := d.Creator != "" && d.Creator == creator && !delegations[i].closed[pollid]
+		if forPoll || forCreator {
+			return d.Delegate
+		}
+	}
+	return ""
+}
+
+// Hash of the last delegation of origin with the same scope as d, nil if there is none
+func lastDelegation(delegations []*chainDelegation, d *Delegation) []byte {
+	for i := len(delegations) - 1; i >= 0; i-- {
+		last := delegations[i].tx.Delegation
+		if last.Origin == d.Origin && last.Creator == d.Creator && (d.Creator != "" || last.PollID == d.PollID) {
+			return delegations[i].tx.Hash()
+		}
+	}
+	return nil
+}
+
+// Whether delegating from origin to delegate closes a cycle of delegations on the poll
+func delegationCycle(delegations []*chainDelegation, origin string, delegate string, pollid uint32, creator string) bool {
+	seen := make(map[string]bool)
+	for d := delegate; d != ""; d = delegateOf(delegations, d, pollid, creator) {
+		if d == origin || seen[d] {
+			return true
+		}
+		seen[d] = true
+	}
+	return false
+}
+
+// Weight every ballot counts with, by voter: the weight of the voter, plus the weights of the voters of the poll
+// who delegated to them, directly or through delegates who didn't vote. A voter who voted is never
+// represented by a delegate. The votes of voters whose delegates didn't vote are lost
+func (b *Blockchain) VoteWeights(pollid uint32) map[string]int64 {
+	weights := make(map[string]int64)
+	poll := b.GetPoll(pollid)
+	if poll == nil {
+		return weights
+	}
+	voted := make(map[string]bool)
+	for _, vote := range b.RetrieveVotes(pollid) {
+		voted[vote.Origin] = true
+	}
+	delegations := b.allDelegations(nil)
+
+	counted := make(map[string]bool)
+	for _, voter := range poll.Poll.Voters {
+		if counted[voter] {
+			continue
+		}
+		counted[voter] = true
+		// Cycles are rejected by the validation, seen only guards against them
+		seen := make(map[string]bool)
+		for representative := voter; representative != "" && !seen[representative]; {
+			if voted[representative] {
+				weights[representative] += ballot.Weight(poll.Poll, voter)
+				break
+			}
+			seen[representative] = true
+			representative = delegateOf(delegations, representative, pollid, poll.Poll.Origin)
+		}
+	}
+	return weights
+}
+
+// The delegation has to be signed by its registered origin, replace the last delegation of the origin with
+// the same scope, and not close a cycle of delegations on any open poll in its scope (with the delegations
+// on the chain and in pending). A delegation for a single poll can only be made by a voter of the poll
+// before it closes
+func (b *Blockchain) delegationValid(delegationTx *DelegationTx, registered map[string]*rsa.PublicKey,
+	counted map[uint32]bool, pending []*DelegationTx, timestamp time.Time) bool {
+	d := delegationTx.Delegation
+	if d == nil {
+		return false
+	}
+
+	pubKey := b.originKey(d.Origin, registered)
+	if pubKey == nil {
+		fmt.Printf("INVALID DELEGATIONTX: cannot find origin %v\n", d.Origin)
+		return false
+	}
+	if !SignatureValid(pubKey, d, delegationTx.Signature) {
+		fmt.Printf("INVALID DELEGATIONTX: invalid signature\n")
+		return false
+	}
+	if d.Delegate == d.Origin || (d.Delegate != "" && b.originKey(d.Delegate, registered) == nil) {
+		fmt.Printf("INVALID DELEGATIONTX: cannot delegate from %v to %v\n", d.Origin, d.Delegate)
+		return false
+	}
+
+	// The open polls the delegation applies to
+	polls := make([]*PollTx, 0)
+	if d.Creator == "" {
+		poll := b.GetPoll(d.PollID)
+		if poll == nil {
+			fmt.Printf("INVALID DELEGATIONTX: poll %v does not exist\n", d.PollID)
+			return false
+		}
+		if counted[d.PollID] || b.GetResult(d.PollID) != nil || poll.Poll.IsClosed(timestamp) {
+			fmt.Printf("INVALID DELEGATIONTX: poll %v is closed\n", d.PollID)
+			return false
+		}
+		if ballot.Weight(poll.Poll, d.Origin) == 0 {
+			fmt.Printf("INVALID DELEGATIONTX: %v is not allowed to vote on poll %v\n", d.Origin, d.PollID)
+			return false
+		}
+		polls = append(polls, poll)
+	} else {
+		for _, poll := range b.GetPolls() {
+			if poll.Poll.Origin == d.Creator && !counted[poll.ID] && b.GetResult(poll.ID) == nil &&
+				!poll.Poll.IsClosed(timestamp) {
+				polls = append(polls, poll)
+			}
+		}
+		polls = append(polls, &PollTx{ID: futurePoll, Poll: &Poll{Origin: d.Creator}})
+	}
+
+	delegations := b.allDelegations(pending)
+	if !bytes.Equal(d.Supersedes, lastDelegation(delegations, d)) {
+		fmt.Printf("INVALID DELEGATIONTX: does not replace the last delegation of %v\n", d.Origin)
+		return false
+	}
+	if d.Delegate != "" {
+		for _, poll := range polls {
+			if delegationCycle(delegations, d.Origin, d.Delegate, poll.ID, poll.Poll.Origin) {
+				fmt.Printf("INVALID DELEGATIONTX: delegation from %v to %v is a cycle on poll %v\n", d.Origin,
+					d.Delegate, poll.ID)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Hash of the last delegation of origin on the chain for the poll, or for all polls of creator if it is not
+// empty. nil if there is none
+func (b *Blockchain) LastDelegation(origin string, pollid uint32, creator string) []byte {
+	return lastDelegation(b.allDelegations(nil), &Delegation{Origin: origin, PollID: pollid, Creator: creator})
+}
+
+// Delegate of origin on the poll, empty if origin didn't delegate
+func (b *Blockchain) DelegateOf(origin string, pollid uint32) string {
+	poll := b.GetPoll(pollid)
+	if poll == nil {
+		return ""
+	}
+	return delegateOf(b.allDelegations(nil), origin, pollid, poll.Poll.Origin)
+}
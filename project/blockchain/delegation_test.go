@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"reflect"
+	"testing"
+)
+
+// Delegation from origin to delegate on the poll with ID pollid
+func pollDelegation(origin string, delegate string, pollid uint32) *chainDelegation {
+	return &chainDelegation{tx: &DelegationTx{Delegation: &Delegation{Origin: origin, Delegate: delegate, PollID: pollid}}}
+}
+
+// Delegation from origin to delegate on all polls of creator, except the closed ones
+func creatorDelegation(origin string, delegate string, creator string, closed ...uint32) *chainDelegation {
+	d := &chainDelegation{
+		tx:     &DelegationTx{Delegation: &Delegation{Origin: origin, Delegate: delegate, Creator: creator}},
+		closed: make(map[uint32]bool),
+	}
+	for _, pollid := range closed {
+		d.closed[pollid] = true
+	}
+	return d
+}
+
+func TestVoteWeights(t *testing.T) {
+	// Of the voters of the poll, alice and dave voted
+	b := testChain(t)
+	keys := testUsers(t, b, "alice", "bob", "carol", "dave", "erin")
+	poll, _ := testPoll(t, b, keys, &Poll{Origin: "alice", Question: "q",
+		Voters: []string{"alice", "bob", "carol", "dave", "erin"}})
+	addTestBlock(t, b, Transactions{Polls: []*PollTx{poll}})
+	addTestBlock(t, b, Transactions{Votes: []*VoteTx{
+		testVote(t, b, keys["alice"], "alice", poll, []int64{1}),
+		testVote(t, b, keys["dave"], "dave", poll, []int64{0}),
+	}})
+	id := poll.ID
+
+	tests := []struct {
+		name        string
+		delegations []*chainDelegation // In the order of the chain
+		weights     map[string]int64
+	}{
+		{"no delegations", nil, map[string]int64{"alice": 1, "dave": 1}},
+		{"to a voter who voted", []*chainDelegation{pollDelegation("bob", "alice", id)},
+			map[string]int64{"alice": 2, "dave": 1}},
+		{"to a voter who didn't vote", []*chainDelegation{pollDelegation("bob", "carol", id)},
+			map[string]int64{"alice": 1, "dave": 1}},
+		{"through a voter who didn't vote", []*chainDelegation{
+			pollDelegation("bob", "carol", id), pollDelegation("carol", "dave", id),
+		}, map[string]int64{"alice": 1, "dave": 3}},
+		{"of a voter who voted", []*chainDelegation{pollDelegation("alice", "dave", id)},
+			map[string]int64{"alice": 1, "dave": 1}},
+		{"to someone who isn't a voter", []*chainDelegation{pollDelegation("bob", "mallory", id)},
+			map[string]int64{"alice": 1, "dave": 1}},
+		{"superseded", []*chainDelegation{pollDelegation("bob", "alice", id), pollDelegation("bob", "dave", id)},
+			map[string]int64{"alice": 1, "dave": 2}},
+		{"revoked", []*chainDelegation{pollDelegation("bob", "alice", id), pollDelegation("bob", "", id)},
+			map[string]int64{"alice": 1, "dave": 1}},
+		{"on another poll", []*chainDelegation{pollDelegation("bob", "alice", id+1)},
+			map[string]int64{"alice": 1, "dave": 1}},
+		{"for the polls of the creator", []*chainDelegation{creatorDelegation("bob", "alice", "alice")},
+			map[string]int64{"alice": 2, "dave": 1}},
+		{"for the polls of another creator", []*chainDelegation{creatorDelegation("bob", "alice", "carol")},
+			map[string]int64{"alice": 1, "dave": 1}},
+		{"for the polls of the creator after the poll closed", []*chainDelegation{
+			creatorDelegation("bob", "alice", "alice", id),
+		}, map[string]int64{"alice": 1, "dave": 1}},
+		{"for the poll, superseded for the polls of the creator", []*chainDelegation{
+			pollDelegation("bob", "alice", id), creatorDelegation("bob", "dave", "alice"),
+		}, map[string]int64{"alice": 1, "dave": 2}},
+		{"for the polls of the creator, superseded for the poll", []*chainDelegation{
+			creatorDelegation("bob", "dave", "alice"), pollDelegation("bob", "alice", id),
+		}, map[string]int64{"alice": 2, "dave": 1}},
+		{"cycle", []*chainDelegation{
+			pollDelegation("bob", "carol", id), pollDelegation("carol", "erin", id), pollDelegation("erin", "bob", id),
+		}, map[string]int64{"alice": 1, "dave": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b.mutex.Lock()
+			b.delegations = test.delegations
+			b.mutex.Unlock()
+			if weights := b.VoteWeights(id); !reflect.DeepEqual(weights, test.weights) {
+				t.Errorf("weights %v, expected %v", weights, test.weights)
+			}
+		})
+	}
+
+	if weights := b.VoteWeights(id + 1); len(weights) != 0 {
+		t.Errorf("weights %v of a poll that doesn't exist", weights)
+	}
+}
+
+func TestDelegationCycle(t *testing.T) {
+	tests := []struct {
+		name        string
+		delegations []*chainDelegation
+		origin      string // Of the new delegation
+		delegate    string
+		cycle       bool
+	}{
+		{"no delegations", nil, "alice", "bob", false},
+		{"back", []*chainDelegation{pollDelegation("bob", "alice", 1)}, "alice", "bob", true},
+		{"chain", []*chainDelegation{pollDelegation("bob", "carol", 1)}, "alice", "bob", false},
+		{"back through a chain", []*chainDelegation{
+			pollDelegation("bob", "carol", 1), pollDelegation("carol", "alice", 1),
+		}, "alice", "bob", true},
+		{"back on another poll", []*chainDelegation{pollDelegation("bob", "alice", 2)}, "alice", "bob", false},
+		{"back for the polls of the creator", []*chainDelegation{creatorDelegation("bob", "alice", "carol")},
+			"alice", "bob", true},
+		{"back for the polls of another creator", []*chainDelegation{creatorDelegation("bob", "alice", "dave")},
+			"alice", "bob", false},
+		{"back, superseded", []*chainDelegation{
+			pollDelegation("bob", "alice", 1), pollDelegation("bob", "carol", 1),
+		}, "alice", "bob", false},
+		{"back, revoked", []*chainDelegation{pollDelegation("bob", "alice", 1), pollDelegation("bob", "", 1)},
+			"alice", "bob", false},
+		{"into a cycle of others", []*chainDelegation{
+			pollDelegation("bob", "carol", 1), pollDelegation("carol", "bob", 1),
+		}, "alice", "bob", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if delegationCycle(test.delegations, test.origin, test.delegate, 1, "carol") != test.cycle {
+				t.Errorf("expected cycle = %v", test.cycle)
+			}
+		})
+	}
+}
+
+func TestLastDelegation(t *testing.T) {
+	forPoll := pollDelegation("alice", "bob", 1)
+	forOtherPoll := pollDelegation("alice", "bob", 2)
+	forCreator := creatorDelegation("alice", "bob", "carol")
+	revoked := pollDelegation("alice", "", 1)
+	delegations := []*chainDelegation{forPoll, forOtherPoll, forCreator, pollDelegation("bob", "carol", 1)}
+
+	tests := []struct {
+		name        string
+		delegations []*chainDelegation
+		delegation  *Delegation
+		last        *chainDelegation
+	}{
+		{"none", nil, &Delegation{Origin: "alice", PollID: 1}, nil},
+		{"for the poll", delegations, &Delegation{Origin: "alice", PollID: 1}, forPoll},
+		{"for the polls of the creator", delegations, &Delegation{Origin: "alice", Creator: "carol"}, forCreator},
+		{"for the polls of another creator", delegations, &Delegation{Origin: "alice", Creator: "dave"}, nil},
+		{"of another voter", delegations, &Delegation{Origin: "carol", PollID: 1}, nil},
+		{"revocation", append(delegations, revoked), &Delegation{Origin: "alice", PollID: 1}, revoked},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var expected []byte
+			if test.last != nil {
+				expected = test.last.tx.Hash()
+			}
+			if last := lastDelegation(test.delegations, test.delegation); !reflect.DeepEqual(last, expected) {
+				t.Errorf("last delegation %x, expected %x", last, expected)
+			}
+		})
+	}
+}
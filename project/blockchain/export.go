@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"io"
+)
+
+// Version of the export format
+const exportVersion = 1
+
+// Portable copy of the main chain, with all transactions, so the chain can be verified without a node
+type ChainExport struct {
+	Version     int      `json:"version"`
+	NetworkID   string   `json:"networkId"`
+	GenesisHash string   `json:"genesisHash"`
+	Blocks      []*Block `json:"blocks"` // From the genesis block to the tip
+	// Precommits of more than 2/3 of the validators for the last finalized block, none if only the
+	// genesis block is final
+	Finality []*FinalityVote `json:"finality,omitempty"`
+}
+
+// Copy of the main chain, up to the tip
+func (b *Blockchain) Export() *ChainExport {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	blocks := make([]*Block, len(b.Blocks))
+	copy(blocks, b.Blocks)
+	return &ChainExport{
+		Version:     exportVersion,
+		NetworkID:   b.config.NetworkID,
+		GenesisHash: blocks[0].Hash,
+		Blocks:      blocks,
+		Finality:    b.finality,
+	}
+}
+
+func WriteExport(w io.Writer, export *ChainExport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	return encoder.Encode(export)
+}
+
+func ReadExport(r io.Reader) (*ChainExport, error) {
+	export := &ChainExport{}
+	if err := json.NewDecoder(r).Decode(export); err != nil {
+		return nil, fmt.Errorf("invalid export: %v", err)
+	}
+	if export.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %v", export.Version)
+	}
+	return export, nil
+}
+
+// Replay the exported chain on top of its genesis block with all checks of a node: the hashes, the proof-of-work
+// or signatures of the blocks, the signatures and eligibility of all transactions, the proofs of the ballots
+// and the proofs of the decryptions of the results, and the precommits of the finalized block if the export
+// has them. Returns the verified chain, or the first error.
+// If genesis is not nil, the exported chain has to be of its network
+func VerifyChain(export *ChainExport, genesis *Genesis) (*Blockchain, error) {
+	if len(export.Blocks) == 0 {
+		return nil, fmt.Errorf("no blocks")
+	}
+	first := export.Blocks[0]
+	if first.ID != 0 || first.Config == nil || !hashesValid(first) {
+		return nil, fmt.Errorf("invalid genesis block")
+	}
+	if first.Hash != export.GenesisHash || first.Config.NetworkID != export.NetworkID {
+		return nil, fmt.Errorf("genesis block does not match the network of the export")
+	}
+	if genesis != nil {
+		expected, err := genesis.Block()
+		if err != nil {
+			return nil, err
+		}
+		if first.Hash != expected.Hash {
+			return nil, fmt.Errorf("chain of another network: genesis block %v, expected %v", first.Hash, expected.Hash)
+		}
+	}
+
+	b, err := newBlockChain(first)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range export.Blocks[1:] {
+		if err := b.blockValid(block); err != nil {
+			return nil, fmt.Errorf("block %v: %v", block.ID, err)
+		}
+		b.appendBlock(block)
+	}
+
+	if len(export.Finality) > 0 {
+		height := export.Finality[0].Height
+		if int(height) >= len(b.Blocks) {
+			return nil, fmt.Errorf("finalized block %v is not in the chain", height)
+		}
+		if err := b.verifyPrecommits(b.Blocks[height], export.Finality); err != nil {
+			return nil, fmt.Errorf("finality of block %v: %v", height, err)
+		}
+		b.finalized, b.finality = b.Blocks[height], export.Finality
+	}
+	return b, nil
+}
+
+// Verify the exported chain and write it to storage, which has to be empty. A node started on the storage
+// continues from the tip of the chain
+func ImportChain(export *ChainExport, genesis *Genesis, storage *Storage) error {
+	stored, err := storage.Load()
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		return fmt.Errorf("storage already has %v blocks", len(stored))
+	}
+	b, err := VerifyChain(export, genesis)
+	if err != nil {
+		return err
+	}
+	for _, block := range export.Blocks {
+		if err := storage.Append(block); err != nil {
+			return err
+		}
+	}
+
+	// We never voted on this chain: only vote for the blocks after its tip
+	height := b.height()
+	return storage.SaveFinality(&FinalityState{
+		Finalized:    b.finalized.Hash,
+		Precommits:   b.finality,
+		Prevoted:     height,
+		Precommitted: height,
+		Votes:        make([]*FinalityVote, 0),
+	})
+}
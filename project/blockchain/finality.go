@@ -0,0 +1,563 @@
+package blockchain
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	"github.com/lukasdeloose/decentralized-voting-system/project/udp"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"sync"
+	"time"
+)
+
+// Validators vote for a block once this many blocks of the main chain are on top of it
+const finalityDepth = 2
+
+// How often the finalizer checks for new blocks to vote for
+const finalityInterval = time.Second
+
+// Finality on top of the consensus: the validators of the network vote for the blocks of their main chain
+// in two steps. A validator prevotes for the block at every height once finalityDepth blocks are on top of
+// it. When more than 2/3 of the validators prevoted for the same block, a validator precommits it and locks
+// on it. When more than 2/3 of the validators precommitted the same block, the block is final: it and all
+// blocks before it stay on the main chain, whatever blocks arrive later.
+//
+// A validator prevotes and precommits at most once per height. While it is locked it only prevotes for
+// blocks on the branch of the block it is locked on, until more than 2/3 of the validators prevote for a
+// block of another branch at a greater height. It only precommits a block if all its prevotes at greater
+// heights are for descendants of that block. As long as less than 1/3 of the validators misbehave, two
+// blocks on different branches never both become final
+type Finalizer struct {
+	name       string
+	blockchain *Blockchain
+	validators []string
+	key        func() *rsa.PrivateKey // Our private key, to sign our votes with
+
+	in  chan *FinalityVote
+	out chan *AddrGossipPacket
+
+	votes        map[string]map[uint32]map[string]*FinalityVote // Valid votes by type, height and validator
+	prevoted     uint32                                         // Greatest height we prevoted at
+	precommitted uint32                                         // Greatest height we precommitted at
+	lock         *Block                                         // Block we last precommitted, nil if unlocked
+	changed      bool                                           // Whether there is state to store since the last step
+	mutex        *sync.Mutex
+}
+
+func NewFinalizer(name string, blockchain *Blockchain, in chan *FinalityVote, out chan *AddrGossipPacket,
+	key func() *rsa.PrivateKey) *Finalizer {
+	// Without stored votes, only vote for blocks that arrive from now on, so we don't vote twice at the same height
+	height := blockchain.height()
+	f := &Finalizer{
+		name:         name,
+		blockchain:   blockchain,
+		validators:   blockchain.Config().Validators,
+		key:          key,
+		in:           in,
+		out:          out,
+		votes:        map[string]map[uint32]map[string]*FinalityVote{Prevote: {}, Precommit: {}},
+		prevoted:     height,
+		precommitted: height,
+		mutex:        &sync.Mutex{},
+	}
+	f.restore()
+	return f
+}
+
+// Continue with the votes and the lock we stored before a restart
+func (f *Finalizer) restore() {
+	if f.blockchain.storage == nil {
+		return
+	}
+	state, err := f.blockchain.storage.LoadFinality()
+	if err != nil {
+		fmt.Printf("ERROR: could not load finality state: %v\n", err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	f.prevoted, f.precommitted, f.lock = state.Prevoted, state.Precommitted, state.Lock
+	for _, vote := range state.Votes {
+		if vote.Origin == f.name {
+			f.addVote(vote)
+		}
+	}
+}
+
+// Store our votes and lock, and the finalized block, before our new votes are sent
+func (f *Finalizer) save() {
+	storage := f.blockchain.storage
+	if !f.changed || storage == nil {
+		return
+	}
+	finalized, precommits := f.blockchain.Finality()
+	state := &FinalityState{
+		Finalized:    finalized.Hash,
+		Precommits:   precommits,
+		Prevoted:     f.prevoted,
+		Precommitted: f.precommitted,
+		Votes:        make([]*FinalityVote, 0),
+	}
+	if f.lock != nil {
+		lock := *f.lock
+		lock.Transactions = Transactions{}
+		state.Lock = &lock
+	}
+	for _, atHeights := range f.votes {
+		for _, atHeight := range atHeights {
+			if vote, voted := atHeight[f.name]; voted {
+				state.Votes = append(state.Votes, vote)
+			}
+		}
+	}
+	if err := storage.SaveFinality(state); err != nil {
+		fmt.Printf("ERROR: could not store finality state: %v\n", err)
+		return
+	}
+	f.changed = false
+}
+
+func (f *Finalizer) Run() {
+	if len(f.validators) == 0 {
+		// No finality in this network, drop the votes
+		go func() {
+			for range f.in {
+			}
+		}()
+		return
+	}
+	go f.listen()
+	go f.voteRegularly()
+}
+
+func (f *Finalizer) listen() {
+	for vote := range f.in {
+		f.mutex.Lock()
+		f.addVote(vote)
+		votes := f.step()
+		f.mutex.Unlock()
+		f.send(votes)
+	}
+}
+
+// Vote for the blocks added to the main chain every finalityInterval
+func (f *Finalizer) voteRegularly() {
+	for {
+		timer := time.NewTimer(finalityInterval)
+		<-timer.C
+
+		f.mutex.Lock()
+		votes := f.step()
+		f.mutex.Unlock()
+		f.send(votes)
+	}
+}
+
+func (f *Finalizer) isValidator(name string) bool {
+	for _, validator := range f.validators {
+		if validator == name {
+			return true
+		}
+	}
+	return false
+}
+
+// More than 2/3 of the validators
+func (f *Finalizer) isQuorum(votes int) bool {
+	return 3*votes > 2*len(f.validators)
+}
+
+// Keep vote if it is valid, and the first vote of its validator of its type at its height
+func (f *Finalizer) addVote(vote *FinalityVote) {
+	if vote.Type != Prevote && vote.Type != Precommit {
+		fmt.Printf("INVALID FINALITY VOTE from %v: unknown type %v\n", vote.Origin, vote.Type)
+		return
+	}
+	if !f.isValidator(vote.Origin) {
+		fmt.Printf("INVALID FINALITY VOTE from %v: not a validator\n", vote.Origin)
+		return
+	}
+	if vote.Height <= f.blockchain.finalizedHeight() {
+		return
+	}
+	// The keys of the validators are registered in the genesis block
+	pubKey := f.blockchain.GetPublicKey(vote.Origin)
+	if pubKey == nil {
+		fmt.Printf("INVALID FINALITY VOTE from %v: validator is not registered\n", vote.Origin)
+		return
+	}
+	if rsa.VerifyPSS(pubKey, crypto.SHA256, vote.Hash(), vote.Signature, nil) != nil {
+		fmt.Printf("INVALID FINALITY VOTE from %v: invalid signature\n", vote.Origin)
+		return
+	}
+
+	atHeight, exists := f.votes[vote.Type][vote.Height]
+	if !exists {
+		atHeight = make(map[string]*FinalityVote)
+		f.votes[vote.Type][vote.Height] = atHeight
+	}
+	if previous, voted := atHeight[vote.Origin]; voted {
+		if previous.BlockHash != vote.BlockHash {
+			fmt.Printf("EQUIVOCATION by %v: %v for %v and %v at height %v\n", vote.Origin, vote.Type,
+				previous.BlockHash, vote.BlockHash, vote.Height)
+		}
+		return
+	}
+	atHeight[vote.Origin] = vote
+	if Debug {
+		fmt.Printf("[DEBUG] %v by %v for block %v\n", vote.Type, vote.Origin, vote.Height)
+	}
+}
+
+// The block that more than 2/3 of the validators voted for at height, "" if there is none
+func (f *Finalizer) quorum(kind string, height uint32) string {
+	counts := make(map[string]int)
+	for _, vote := range f.votes[kind][height] {
+		counts[vote.BlockHash]++
+	}
+	for hash, count := range counts {
+		if f.isQuorum(count) {
+			return hash
+		}
+	}
+	return ""
+}
+
+// Cast the votes we can cast now, finalize the blocks that are final. Returns our new votes
+func (f *Finalizer) step() []*FinalityVote {
+	votes := make([]*FinalityVote, 0)
+	key := f.key()
+	if f.isValidator(f.name) && key != nil {
+		votes = append(votes, f.prevote(key)...)
+		votes = append(votes, f.precommit(key)...)
+	}
+	f.finalize()
+	f.save()
+	return votes
+}
+
+// Prevote for the blocks of the main chain that are deep enough
+func (f *Finalizer) prevote(key *rsa.PrivateKey) []*FinalityVote {
+	votes := make([]*FinalityVote, 0)
+	height := f.blockchain.height()
+	for height >= finalityDepth && f.prevoted < height-finalityDepth {
+		if f.lock != nil && !f.blockchain.isOnMainChain(f.lock) {
+			// Wait until our main chain switches back to the branch we are locked on, or we unlock
+			break
+		}
+		block := f.blockchain.mainChainBlock(f.prevoted + 1)
+		if block == nil {
+			break
+		}
+		if block.ID <= f.blockchain.finalizedHeight() {
+			f.prevoted = block.ID
+			continue
+		}
+		if vote := f.sign(key, Prevote, block); vote != nil {
+			votes = append(votes, vote)
+		}
+		f.prevoted = block.ID
+	}
+	return votes
+}
+
+// Precommit the blocks with a quorum of prevotes
+func (f *Finalizer) precommit(key *rsa.PrivateKey) []*FinalityVote {
+	votes := make([]*FinalityVote, 0)
+	for _, height := range sortedHeights(f.votes[Prevote]) {
+		hash := f.quorum(Prevote, height)
+		if hash == "" {
+			continue
+		}
+		block := f.blockchain.knownBlock(hash)
+		if block == nil {
+			continue
+		}
+		if f.lock != nil && block.ID > f.lock.ID && !f.blockchain.onBranch(hash, f.lock) {
+			// The validators moved on to another branch
+			fmt.Printf("FINALITY unlocking from block %v, quorum for block %v on another branch\n", f.lock.ID, block.ID)
+			f.lock = nil
+			f.changed = true
+		}
+		if height <= f.precommitted || !f.prevotesDescendFrom(block) {
+			continue
+		}
+		if vote := f.sign(key, Precommit, block); vote != nil {
+			votes = append(votes, vote)
+			f.precommitted = height
+			f.lock = block
+		}
+	}
+	return votes
+}
+
+// Whether all our prevotes after block are for descendants of block
+func (f *Finalizer) prevotesDescendFrom(block *Block) bool {
+	for height, atHeight := range f.votes[Prevote] {
+		if vote, voted := atHeight[f.name]; voted && height > block.ID && !f.blockchain.onBranch(vote.BlockHash, block) {
+			return false
+		}
+	}
+	return true
+}
+
+// Finalize the greatest block with a quorum of precommits
+func (f *Finalizer) finalize() {
+	heights := sortedHeights(f.votes[Precommit])
+	for i := len(heights) - 1; i >= 0; i-- {
+		hash := f.quorum(Precommit, heights[i])
+		if hash == "" || f.blockchain.knownBlock(hash) == nil {
+			continue
+		}
+		precommits := make([]*FinalityVote, 0)
+		for _, vote := range f.votes[Precommit][heights[i]] {
+			if vote.BlockHash == hash {
+				precommits = append(precommits, vote)
+			}
+		}
+		if err := f.blockchain.Finalize(hash, precommits); err != nil {
+			fmt.Printf("ERROR: could not finalize block %v: %v\n", heights[i], err)
+			continue
+		}
+		f.changed = true
+		break
+	}
+
+	// Votes at finalized heights are not needed anymore, and a lock on a block that is not after the
+	// finalized block only stands in the way
+	finalized := f.blockchain.finalizedHeight()
+	if f.lock != nil && f.lock.ID <= finalized {
+		f.lock = nil
+		f.changed = true
+	}
+	for _, atHeights := range f.votes {
+		for height := range atHeights {
+			if height <= finalized {
+				delete(atHeights, height)
+			}
+		}
+	}
+}
+
+// Our signed vote for block, which we count right away
+func (f *Finalizer) sign(key *rsa.PrivateKey, kind string, block *Block) *FinalityVote {
+	vote := &FinalityVote{
+		Origin:    f.name,
+		ID:        0,
+		Type:      kind,
+		Height:    block.ID,
+		BlockHash: block.Hash,
+	}
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, vote.Hash(), nil)
+	if err != nil {
+		fmt.Printf("ERROR: could not sign %v: %v\n", kind, err)
+		return nil
+	}
+	vote.Signature = signature
+	f.addVote(vote)
+	f.changed = true
+	return vote
+}
+
+func (f *Finalizer) send(votes []*FinalityVote) {
+	for _, vote := range votes {
+		f.out <- &AddrGossipPacket{
+			Address: udp.UDPAddr{},
+			Gossip:  &GossipPacket{FinalityVote: vote},
+		}
+	}
+}
+
+func sortedHeights(votes map[uint32]map[string]*FinalityVote) []uint32 {
+	heights := make([]uint32, 0, len(votes))
+	for height := range votes {
+		heights = append(heights, height)
+	}
+	for i := 1; i < len(heights); i++ {
+		for j := i; j > 0 && heights[j] < heights[j-1]; j-- {
+			heights[j], heights[j-1] = heights[j-1], heights[j]
+		}
+	}
+	return heights
+}
+
+// Make the block with hash final, precommits are the precommits of the quorum of validators for it: the main
+// chain switches to the heaviest branch containing it if needed, and blocks on other branches are dropped, so
+// the fork choice can't roll it back anymore
+func (b *Blockchain) Finalize(hash string, precommits []*FinalityVote) error {
+	b.chainMutex.Lock()
+	defer b.chainMutex.Unlock()
+
+	node, known := b.tree[hash]
+	if !known {
+		return fmt.Errorf("unknown block")
+	}
+	if node.block.ID <= b.finalized.ID {
+		return nil
+	}
+	if !descends(node, b.finalized) {
+		return fmt.Errorf("conflicts with finalized block %v", b.finalized.ID)
+	}
+
+	if !b.onMainChain(node.block) {
+		tip := node
+		for _, other := range b.tree {
+			if other.work.Cmp(tip.work) > 0 && descends(other, node.block) {
+				tip = other
+			}
+		}
+		b.reorg(tip)
+		if !b.onMainChain(node.block) {
+			return fmt.Errorf("block is not valid")
+		}
+	}
+
+	// Drop the blocks that are not on a branch through the finalized block
+	for id := b.finalized.ID; id < node.block.ID; id++ {
+		b.removeSideBranches(id)
+	}
+
+	b.mutex.Lock()
+	b.finalized = node.block
+	b.finality = precommits
+	b.mutex.Unlock()
+	fmt.Printf("FINALIZED block %v %v\n", node.block.ID, node.block.Hash)
+
+	for parent, orphans := range b.orphans {
+		if len(orphans) > 0 && orphans[0].ID <= node.block.ID {
+			delete(b.orphans, parent)
+		}
+	}
+	return nil
+}
+
+// Whether node is block or one of its descendants
+func descends(node *blockNode, block *Block) bool {
+	for n := node; n != nil && n.block.ID >= block.ID; n = n.parent {
+		if n.block.Hash == block.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the block with hash is block or one of its descendants
+func (b *Blockchain) onBranch(hash string, block *Block) bool {
+	b.chainMutex.Lock()
+	defer b.chainMutex.Unlock()
+
+	node, known := b.tree[hash]
+	return known && descends(node, block)
+}
+
+// The block with hash, if it is in the tree of blocks
+func (b *Blockchain) knownBlock(hash string) *Block {
+	b.chainMutex.Lock()
+	defer b.chainMutex.Unlock()
+
+	if node, known := b.tree[hash]; known {
+		return node.block
+	}
+	return nil
+}
+
+func (b *Blockchain) isOnMainChain(block *Block) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.onMainChain(block)
+}
+
+// Block of the main chain at height, nil if the main chain is shorter
+func (b *Blockchain) mainChainBlock(height uint32) *Block {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if int(height) >= len(b.Blocks) {
+		return nil
+	}
+	return b.Blocks[height]
+}
+
+// ID of the tip of the main chain
+func (b *Blockchain) height() uint32 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return uint32(len(b.Blocks) - 1)
+}
+
+// The last finalized block and the precommits that finalized it, none for the genesis block
+func (b *Blockchain) Finality() (*Block, []*FinalityVote) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.finalized, b.finality
+}
+
+// Check that precommits are signed precommits for block of more than 2/3 of the validators
+func (b *Blockchain) verifyPrecommits(block *Block, precommits []*FinalityVote) error {
+	voted := make(map[string]bool)
+	for _, vote := range precommits {
+		if vote.Type != Precommit || vote.Height != block.ID || vote.BlockHash != block.Hash {
+			return fmt.Errorf("vote of %v is not a precommit for block %v", vote.Origin, block.ID)
+		}
+		if !b.isValidator(vote.Origin) || voted[vote.Origin] {
+			return fmt.Errorf("precommit of %v is not of another validator", vote.Origin)
+		}
+		pubKey := b.GetPublicKey(vote.Origin)
+		if pubKey == nil || rsa.VerifyPSS(pubKey, crypto.SHA256, vote.Hash(), vote.Signature, nil) != nil {
+			return fmt.Errorf("invalid signature of the precommit of %v", vote.Origin)
+		}
+		voted[vote.Origin] = true
+	}
+	if 3*len(voted) <= 2*len(b.config.Validators) {
+		return fmt.Errorf("precommits of %v of the %v validators", len(voted), len(b.config.Validators))
+	}
+	return nil
+}
+
+// Finalize the stored finalized block of the main chain again, if its precommits are valid
+func (b *Blockchain) restoreFinality(storage *Storage) error {
+	state, err := storage.LoadFinality()
+	if err != nil || state == nil {
+		return err
+	}
+	node, known := b.tree[state.Finalized]
+	if !known || !b.onMainChain(node.block) {
+		return fmt.Errorf("finalized block %v is not on the stored chain", state.Finalized)
+	}
+	if node.block.ID == 0 {
+		return nil
+	}
+	if err := b.verifyPrecommits(node.block, state.Precommits); err != nil {
+		return err
+	}
+	b.finalized, b.finality = node.block, state.Precommits
+	return nil
+}
+
+func (b *Blockchain) isValidator(name string) bool {
+	for _, validator := range b.config.Validators {
+		if validator == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ID of the last finalized block, the genesis block is always final
+func (b *Blockchain) finalizedHeight() uint32 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.finalized.ID
+}
+
+// Whether the network has validators that finalize blocks
+func (b *Blockchain) HasFinality() bool {
+	return len(b.config.Validators) > 0
+}
@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"reflect"
+	"testing"
+)
+
+// Finality vote of origin for a block, signed with the key of signer, or of origin if there is no signer
+type finalityVote struct {
+	origin string
+	kind   string
+	block  string
+	signer string
+}
+
+func TestIsQuorum(t *testing.T) {
+	tests := []struct {
+		validators int
+		votes      int
+		quorum     bool
+	}{
+		{1, 0, false},
+		{1, 1, true},
+		{3, 2, false},
+		{3, 3, true},
+		{4, 2, false},
+		{4, 3, true},
+		{6, 4, false},
+		{6, 5, true},
+	}
+	for _, test := range tests {
+		f := &Finalizer{validators: make([]string, test.validators)}
+		if f.isQuorum(test.votes) != test.quorum {
+			t.Errorf("%v of %v validators: expected quorum = %v", test.votes, test.validators, test.quorum)
+		}
+	}
+}
+
+func TestFinalizer(t *testing.T) {
+	// We are v1, one of four validators: a quorum are three of them
+	validators := []string{"v1", "v2", "v3", "v4"}
+	genesis := testGenesis()
+	genesis.Validators = validators
+	keys := make(map[string]*rsa.PrivateKey)
+	for _, name := range validators {
+		keys[name] = testKey(t)
+		publicKey, err := EncodePublicKey(&keys[name].PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genesis.Authorities = append(genesis.Authorities, GenesisKey{Name: name, PublicKey: publicKey})
+	}
+	keys["mallory"] = testKey(t)
+
+	// Main chain a1 <- a2 <- a3 <- a4, on which we prevote a1 and a2, and the heavier b1 <- ... <- b5
+	chain, err := NewBlockChain(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := make(map[string]*Block)
+	labels := make(map[string]string) // Of the blocks by hash
+	parents := map[string]*Block{"a": chain.Blocks[0], "b": chain.Blocks[0]}
+	for i := 1; i <= 5; i++ {
+		for _, branch := range []string{"a", "b"} {
+			label := branch + string(rune('0'+i))
+			blocks[label] = mineBlock(parents[branch], branch, Transactions{})
+			labels[blocks[label].Hash] = label
+			parents[branch] = blocks[label]
+		}
+	}
+	mainChain := []string{"a1", "a2", "a3", "a4"}
+	reorg := []string{"b1", "b2", "b3", "b4", "b5"}
+
+	tests := []struct {
+		name       string
+		before     []finalityVote // Of the other validators, before the reorg
+		reorg      bool           // Whether the b branch arrives
+		after      []finalityVote
+		prevotes   []string // Our votes
+		precommits []string
+		lock       string
+		finalized  string
+	}{
+		{"no quorum", []finalityVote{{"v2", Prevote, "a2", ""}}, false, nil,
+			[]string{"a1", "a2"}, []string{}, "", ""},
+		{"precommit and lock", []finalityVote{{"v2", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}}, false, nil,
+			[]string{"a1", "a2"}, []string{"a2"}, "a2", ""},
+		{"finalize", []finalityVote{
+			{"v2", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}, {"v2", Precommit, "a2", ""}, {"v3", Precommit, "a2", ""},
+		}, false, nil, []string{"a1", "a2"}, []string{"a2"}, "", "a2"},
+		{"no quorum of precommits", []finalityVote{
+			{"v2", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}, {"v2", Precommit, "a2", ""}, {"v3", Precommit, "a1", ""},
+		}, false, nil, []string{"a1", "a2"}, []string{"a2"}, "a2", ""},
+		{"no prevotes on another branch while locked", []finalityVote{{"v2", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}},
+			true, nil, []string{"a1", "a2"}, []string{"a2"}, "a2", ""},
+		{"prevotes on another branch without lock", []finalityVote{{"v2", Prevote, "a2", ""}}, true, nil,
+			[]string{"a1", "a2", "b3"}, []string{}, "", ""},
+		{"unlock by a quorum on another branch", []finalityVote{{"v2", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}},
+			true, []finalityVote{{"v2", Prevote, "b3", ""}, {"v3", Prevote, "b3", ""}, {"v4", Prevote, "b3", ""}},
+			[]string{"a1", "a2"}, []string{"a2", "b3"}, "b3", ""},
+		{"no unlock by a quorum at a lower height", []finalityVote{{"v2", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}},
+			true, []finalityVote{{"v2", Prevote, "b1", ""}, {"v3", Prevote, "b1", ""}, {"v4", Prevote, "b1", ""}},
+			[]string{"a1", "a2"}, []string{"a2"}, "a2", ""},
+		{"second vote of a validator", []finalityVote{{"v2", Prevote, "b2", ""}, {"v2", Prevote, "a2", ""},
+			{"v3", Prevote, "a2", ""}}, false, nil, []string{"a1", "a2"}, []string{}, "", ""},
+		{"vote of someone who isn't a validator", []finalityVote{{"mallory", Prevote, "a2", ""}, {"v3", Prevote, "a2", ""}},
+			false, nil, []string{"a1", "a2"}, []string{}, "", ""},
+		{"vote signed by another validator", []finalityVote{{"v2", Prevote, "a2", "v3"}, {"v3", Prevote, "a2", ""}},
+			false, nil, []string{"a1", "a2"}, []string{}, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := NewBlockChain(genesis)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := NewFinalizer("v1", b, nil, nil, func() *rsa.PrivateKey { return keys["v1"] })
+			prevotes, precommits := make([]string, 0), make([]string, 0)
+			// Add the blocks and the votes, and take our votes of the next step
+			step := func(added []string, votes []finalityVote) {
+				for _, label := range added {
+					b.AddBlock(blocks[label])
+				}
+				for _, v := range votes {
+					signer := v.signer
+					if signer == "" {
+						signer = v.origin
+					}
+					vote := &FinalityVote{Origin: v.origin, Type: v.kind, Height: blocks[v.block].ID,
+						BlockHash: blocks[v.block].Hash}
+					vote.Signature, _ = rsa.SignPSS(rand.Reader, keys[signer], crypto.SHA256, vote.Hash(), nil)
+					f.addVote(vote)
+				}
+				for _, vote := range f.step() {
+					if vote.Type == Prevote {
+						prevotes = append(prevotes, labels[vote.BlockHash])
+					} else {
+						precommits = append(precommits, labels[vote.BlockHash])
+					}
+				}
+			}
+			step(mainChain, test.before)
+			if test.reorg {
+				step(reorg, test.after)
+			}
+
+			if !reflect.DeepEqual(prevotes, test.prevotes) {
+				t.Errorf("prevoted %v, expected %v", prevotes, test.prevotes)
+			}
+			if !reflect.DeepEqual(precommits, test.precommits) {
+				t.Errorf("precommitted %v, expected %v", precommits, test.precommits)
+			}
+			lock := ""
+			if f.lock != nil {
+				lock = labels[f.lock.Hash]
+			}
+			if lock != test.lock {
+				t.Errorf("locked on %q, expected %q", lock, test.lock)
+			}
+			finalized, _ := b.Finality()
+			if labels[finalized.Hash] != test.finalized {
+				t.Errorf("finalized %q, expected %q", labels[finalized.Hash], test.finalized)
+			}
+		})
+	}
+}
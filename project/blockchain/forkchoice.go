@@ -0,0 +1,231 @@
+package blockchain
+
+import (
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+)
+
+const maxOrphans = 256
+
+// Side branches that fork off the main chain more than pruneDepth blocks below its tip are dropped from the
+// tree, and blocks that would start such a branch are ignored: the main chain is never reorganized deeper
+const pruneDepth = 100
+
+// Node in the tree of all blocks we know of
+type blockNode struct {
+	block    *Block
+	parent   *blockNode
+	children []*blockNode
+	work     *big.Int // Cumulative weight of the chain ending in this block, see Consensus.Weight
+}
+
+// Add block to the tree of blocks, and make the branch with the most cumulative weight the main chain.
+// Returns true if the tip of the main chain changed
+func (b *Blockchain) AddBlock(block *Block) bool {
+	b.chainMutex.Lock()
+	defer b.chainMutex.Unlock()
+
+	oldTip := b.lastBlock().Hash
+	b.addBlock(block)
+	b.pruneBranches()
+	return b.lastBlock().Hash != oldTip
+}
+
+func (b *Blockchain) addBlock(block *Block) {
+	if _, known := b.tree[block.Hash]; known {
+		return
+	}
+	if block.ID <= b.finalized.ID {
+		fmt.Printf("Block %v from %v is not after finalized block %v\n", block.ID, block.Origin, b.finalized.ID)
+		return
+	}
+	if !hashesValid(block) {
+		fmt.Printf("Block %v from %v has invalid hashes\n", block.ID, block.Origin)
+		return
+	}
+	if err := b.consensus.VerifyHeader(block); err != nil {
+		fmt.Printf("Block %v from %v not valid: %v\n", block.ID, block.Origin, err)
+		return
+	}
+
+	parent, known := b.tree[block.PrevHash]
+	if !known {
+		// Keep the block until its parent arrives
+		if b.numOrphans() < maxOrphans {
+			fmt.Printf("ORPHAN block %v from %v, parent unknown\n", block.ID, block.Origin)
+			b.orphans[block.PrevHash] = append(b.orphans[block.PrevHash], block)
+			select {
+			case b.missingParents <- block.PrevHash:
+			default:
+			}
+		}
+		return
+	}
+	if block.ID != parent.block.ID+1 {
+		fmt.Printf("Block %v does not follow its parent %v\n", block.ID, parent.block.ID)
+		return
+	}
+	if parent.block.ID < b.pruned && b.onMainChain(parent.block) {
+		fmt.Printf("Block %v from %v forks off the main chain more than %v blocks deep, ignoring it\n", block.ID,
+			block.Origin, pruneDepth)
+		return
+	}
+
+	node := b.insertNode(block)
+	if parent.block.Hash == b.lastBlock().Hash {
+		// The block extends the main chain
+		if err := b.blockValid(block); err != nil {
+			fmt.Printf("Block %v not valid: %v\n", block.ID, err)
+			b.removeBranch(block)
+			return
+		}
+		b.appendBlock(block)
+	} else if node.work.Cmp(b.tipNode().work) > 0 {
+		// The block is on a side branch which now weighs more than the main chain
+		b.reorg(node)
+		if _, valid := b.tree[block.Hash]; !valid {
+			return
+		}
+	} else {
+		fmt.Printf("SIDE BRANCH block %v from %v\n", block.ID, block.Origin)
+	}
+
+	// Blocks that were waiting for this block can now be added
+	orphans := b.orphans[block.Hash]
+	delete(b.orphans, block.Hash)
+	for _, orphan := range orphans {
+		b.addBlock(orphan)
+	}
+}
+
+// Add block to the tree, its parent has to be in the tree already
+func (b *Blockchain) insertNode(block *Block) *blockNode {
+	if node, exists := b.tree[block.Hash]; exists {
+		return node
+	}
+	parent := b.tree[block.PrevHash]
+	node := &blockNode{
+		block:  block,
+		parent: parent,
+		work:   new(big.Int).Add(parent.work, b.consensus.Weight(block)),
+	}
+	parent.children = append(parent.children, node)
+	b.tree[block.Hash] = node
+	return node
+}
+
+// Remove block and all its descendants from the tree
+func (b *Blockchain) removeBranch(block *Block) {
+	node, known := b.tree[block.Hash]
+	if !known {
+		return
+	}
+	if parent := node.parent; parent != nil {
+		for i, child := range parent.children {
+			if child == node {
+				parent.children = append(parent.children[:i:i], parent.children[i+1:]...)
+				break
+			}
+		}
+	}
+	branch := []*blockNode{node}
+	for len(branch) > 0 {
+		n := branch[len(branch)-1]
+		branch = append(branch[:len(branch)-1], n.children...)
+		delete(b.tree, n.block.Hash)
+	}
+}
+
+// Remove the side branches that fork off the main chain at block id from the tree
+func (b *Blockchain) removeSideBranches(id uint32) {
+	node := b.tree[b.Blocks[id].Hash]
+	for _, child := range append([]*blockNode{}, node.children...) {
+		if !b.onMainChain(child.block) {
+			b.removeBranch(child.block)
+		}
+	}
+}
+
+// Remove the side branches that fork off the main chain more than pruneDepth blocks below its tip
+func (b *Blockchain) pruneBranches() {
+	for ; b.pruned+pruneDepth < b.lastBlock().ID; b.pruned++ {
+		b.removeSideBranches(b.pruned)
+	}
+}
+
+func (b *Blockchain) tipNode() *blockNode {
+	return b.tree[b.lastBlock().Hash]
+}
+
+func (b *Blockchain) onMainChain(block *Block) bool {
+	return int(block.ID) < b.length() && b.Blocks[block.ID].Hash == block.Hash
+}
+
+func (b *Blockchain) numOrphans() int {
+	num := 0
+	for _, blocks := range b.orphans {
+		num += len(blocks)
+	}
+	return num
+}
+
+// Switch the main chain to the branch ending in tip.
+// The blocks of the main chain after the common ancestor are rolled back, and their transactions become
+// unconfirmed again. If a block of the new branch turns out to be invalid, that block and its
+// descendants are dropped, and the old main chain is restored
+func (b *Blockchain) reorg(tip *blockNode) {
+	// Collect the new branch, up to the common ancestor with the main chain
+	branch := make([]*Block, 0)
+	node := tip
+	for !b.onMainChain(node.block) {
+		branch = append([]*Block{node.block}, branch...)
+		node = node.parent
+	}
+	ancestor := node.block
+	if ancestor.ID < b.finalized.ID {
+		fmt.Printf("REORG to %v would roll back finalized block %v, ignoring it\n", tip.block.ID, b.finalized.ID)
+		return
+	}
+	fmt.Printf("REORG from %v to %v, common ancestor %v\n", b.lastBlock().ID, tip.block.ID, ancestor.ID)
+
+	rolledBack := make([]*Block, 0)
+	for b.lastBlock().Hash != ancestor.Hash {
+		rolledBack = append([]*Block{b.lastBlock()}, rolledBack...)
+		b.popBlock()
+	}
+
+	for _, block := range branch {
+		if err := b.blockValid(block); err != nil {
+			fmt.Printf("REORG block %v not valid: %v, restoring the old chain\n", block.ID, err)
+			b.removeBranch(block)
+			for b.lastBlock().Hash != ancestor.Hash {
+				b.popBlock()
+			}
+			for _, old := range rolledBack {
+				b.appendBlock(old)
+			}
+			return
+		}
+		b.appendBlock(block)
+	}
+}
+
+// Remove the tip of the main chain: its transactions are rolled back and become unconfirmed again
+func (b *Blockchain) popBlock() {
+	block := b.lastBlock()
+
+	b.mutex.Lock()
+	b.Blocks = b.Blocks[:len(b.Blocks)-1]
+	b.indexTransactions(block, false)
+	b.mutex.Unlock()
+
+	b.removeTransactions(block.Transactions)
+	b.mempool.Reinsert(block.Transactions)
+
+	if b.storage != nil {
+		if err := b.storage.Truncate(block.ID); err != nil {
+			fmt.Printf("ERROR: could not remove block %v from storage: %v\n", block.ID, err)
+		}
+	}
+}
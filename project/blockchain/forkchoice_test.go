@@ -0,0 +1,207 @@
+package blockchain
+
+import (
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Difficulty of the blocks of test chains, so they are mined right away
+const testDifficulty = 1
+
+// Network with small keys and blocks of testDifficulty
+func testGenesis() *Genesis {
+	genesis := DefaultGenesis()
+	genesis.InitialDifficulty = testDifficulty
+	genesis.RSAKeyBits = 1024
+	genesis.ElGamalKeyBits = 1536
+	return genesis
+}
+
+func testChain(t *testing.T) *Blockchain {
+	b, err := NewBlockChain(testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Block with the transactions on top of parent, mined targetBlockTime after it so the difficulty stays
+// the same. The first block is mined an hour ago, so chains of up to 360 blocks are not in the future
+func mineBlock(parent *Block, origin string, txs Transactions) *Block {
+	timestamp := parent.Timestamp.Add(targetBlockTime)
+	if parent.ID == 0 {
+		timestamp = time.Now().Add(-time.Hour)
+	}
+	block := &Block{
+		ID:           parent.ID + 1,
+		Origin:       origin,
+		Timestamp:    timestamp,
+		Transactions: txs,
+		Difficulty:   testDifficulty,
+		PrevHash:     parent.Hash,
+		MerkleRoot:   txs.MerkleRoot(),
+	}
+	sealTestBlock(block)
+	return block
+}
+
+// Find a nonce for the difficulty of the block
+func sealTestBlock(block *Block) {
+	for nonce := 0; ; nonce++ {
+		block.Nonce = strconv.Itoa(nonce)
+		if block.Hash = calculateHash(block); hashValid(block.Hash, block.Difficulty) {
+			return
+		}
+	}
+}
+
+// Registration of origin with a key that is only long enough, nothing is signed with it
+func testRegistration(origin string) *RegisterTx {
+	n := new(big.Int).Lsh(big.NewInt(1), 1023)
+	return &RegisterTx{Registry: &Registry{Origin: origin, PublicKey: SerializableRSAPubKey{N: n.Bytes(), E: 3}}}
+}
+
+func TestAddBlock(t *testing.T) {
+	// Two branches off genesis: a1 <- a2 registering alice and carol, and b1 <- b2 <- b3 registering bob.
+	// x1 <- x2 <- x3 outweighs them both, but x1 holds the result of a poll that doesn't exist
+	b := testChain(t)
+	genesis := b.Blocks[0]
+	blocks := make(map[string]*Block)
+	blocks["a1"] = mineBlock(genesis, "a", Transactions{Registers: []*RegisterTx{testRegistration("alice")}})
+	blocks["a2"] = mineBlock(blocks["a1"], "a", Transactions{Registers: []*RegisterTx{testRegistration("carol")}})
+	blocks["b1"] = mineBlock(genesis, "b", Transactions{Registers: []*RegisterTx{testRegistration("bob")}})
+	blocks["b2"] = mineBlock(blocks["b1"], "b", Transactions{})
+	blocks["b3"] = mineBlock(blocks["b2"], "b", Transactions{})
+	blocks["x1"] = mineBlock(genesis, "x", Transactions{Results: []*ResultTx{{Result: &Result{PollId: 7}}}})
+	blocks["x2"] = mineBlock(blocks["x1"], "x", Transactions{})
+	blocks["x3"] = mineBlock(blocks["x2"], "x", Transactions{})
+
+	tests := []struct {
+		name       string
+		added      []string // Blocks, in the order they arrive
+		tip        string
+		registered []string // Users registered on the main chain
+		pending    int      // Transactions in the mempool
+		dropped    []string // Blocks that are not in the tree
+	}{
+		{"main chain", []string{"a1", "a2"}, "a2", []string{"alice", "carol"}, 0, nil},
+		{"lighter side branch", []string{"a1", "a2", "b1"}, "a2", []string{"alice", "carol"}, 0, nil},
+		{"equal side branch", []string{"a1", "a2", "b1", "b2"}, "a2", []string{"alice", "carol"}, 0, nil},
+		{"reorg", []string{"a1", "a2", "b1", "b2", "b3"}, "b3", []string{"bob"}, 2, nil},
+		{"orphans", []string{"a1", "b3", "b2", "b1"}, "b3", []string{"bob"}, 1, nil},
+		{"orphan without parent", []string{"a1", "b2"}, "a1", []string{"alice"}, 0, []string{"b2"}},
+		{"invalid block", []string{"x1"}, "", nil, 0, []string{"x1"}},
+		{"invalid heavier branch", []string{"a1", "a2", "x1", "x2", "x3"}, "a2", []string{"alice", "carol"}, 0,
+			[]string{"x1", "x2", "x3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := testChain(t)
+			for _, name := range test.added {
+				b.AddBlock(blocks[name])
+			}
+
+			tip := genesis.Hash
+			if test.tip != "" {
+				tip = blocks[test.tip].Hash
+			}
+			if b.lastBlock().Hash != tip {
+				t.Errorf("tip %v, expected %v", b.lastBlock().ID, test.tip)
+			}
+			for i, block := range b.Blocks[1:] {
+				if block.ID != uint32(i+1) || block.PrevHash != b.Blocks[i].Hash {
+					t.Errorf("block %v of the main chain does not follow block %v", block.ID, i)
+				}
+			}
+			if len(b.PublicKeys) != len(test.registered) {
+				t.Errorf("%v users registered, expected %v", len(b.PublicKeys), test.registered)
+			}
+			for _, name := range test.registered {
+				if b.GetPublicKey(name) == nil {
+					t.Errorf("%v not registered", name)
+				}
+			}
+			if b.mempool.Len() != test.pending {
+				t.Errorf("%v pending transactions, expected %v", b.mempool.Len(), test.pending)
+			}
+			for _, name := range test.dropped {
+				if _, exists := b.tree[blocks[name].Hash]; exists {
+					t.Errorf("%v in the tree", name)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneBranches(t *testing.T) {
+	b := testChain(t)
+	genesis := b.Blocks[0]
+	side := mineBlock(genesis, "side", Transactions{})
+	b.AddBlock(side)
+	tip := genesis
+	for i := 0; i < pruneDepth+2; i++ {
+		tip = mineBlock(tip, "main", Transactions{})
+		b.AddBlock(tip)
+	}
+
+	tests := []struct {
+		name   string
+		parent *Block // Parent of a new side branch
+		kept   bool   // Whether the side branch is added to the tree
+	}{
+		{"fork at the pruning depth", b.Blocks[b.lastBlock().ID-pruneDepth], true},
+		{"fork below the pruning depth", b.Blocks[1], false},
+		{"fork off the genesis block", genesis, false},
+		{"fork off a pruned branch", side, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := mineBlock(test.parent, "side", Transactions{})
+			b.AddBlock(block)
+			if _, kept := b.tree[block.Hash]; kept != test.kept {
+				t.Errorf("side branch kept = %v, expected %v", kept, test.kept)
+			}
+		})
+	}
+
+	if _, exists := b.tree[side.Hash]; exists {
+		t.Error("side branch off the genesis block not pruned")
+	}
+	if b.lastBlock() != tip {
+		t.Errorf("tip %v, expected %v", b.lastBlock().ID, tip.ID)
+	}
+}
+
+func TestPopBlock(t *testing.T) {
+	b := testChain(t)
+	register := testRegistration("alice")
+	b.AddBlock(mineBlock(b.Blocks[0], "a", Transactions{Registers: []*RegisterTx{register}}))
+	b.AddBlock(mineBlock(b.lastBlock(), "a", Transactions{}))
+
+	tests := []struct {
+		name       string
+		length     int  // Of the main chain after popping its tip
+		registered bool // Whether alice is still registered
+		pending    bool // Whether the registration of alice is in the mempool
+	}{
+		{"empty block", 2, true, false},
+		{"block with a registration", 1, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b.popBlock()
+			if b.length() != test.length {
+				t.Errorf("%v blocks, expected %v", b.length(), test.length)
+			}
+			if registered := b.GetPublicKey("alice") != nil; registered != test.registered {
+				t.Errorf("alice registered = %v, expected %v", registered, test.registered)
+			}
+			if pending := b.mempool.Contains(register.Hash()); pending != test.pending {
+				t.Errorf("registration pending = %v, expected %v", pending, test.pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package blockchain
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"os"
+	"time"
+)
+
+// Default minimum key sizes of a network
+const DefaultRSAKeyBits = 3072
+const DefaultElGamalKeyBits = 2048
+
+// Network ID of networks without a genesis file
+const DefaultNetworkID = "default"
+
+// Ranked ballots grow with the square of the number of options, every network supports this many
+const minRankedOptions = 4
+
+// Genesis file: the parameters of a network and the users that are registered from the start. Every node of
+// a network needs the same genesis file, nodes with a different genesis block don't talk to each other
+type Genesis struct {
+	NetworkID         string       `json:"networkId"`
+	Timestamp         time.Time    `json:"timestamp"`
+	InitialDifficulty int          `json:"initialDifficulty"` // Difficulty of the first blocks with proof-of-work
+	RSAKeyBits        uint32       `json:"rsaKeyBits"`
+	ElGamalKeyBits    uint32       `json:"elgamalKeyBits"`
+	Consensus         string       `json:"consensus"` // "pow" or "poa"
+	Signers           []string     `json:"signers"`
+	Validators        []string     `json:"validators"`
+	Authorities       []GenesisKey `json:"authorities"` // Keys of the signers and validators
+	Voters            []GenesisKey `json:"voters"`      // Keys of the other users
+}
+
+// User registered in the genesis block
+type GenesisKey struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"` // Base64 of the PKIX encoding of the RSA public key
+}
+
+// Genesis of a network with the default parameters and no registered users
+func DefaultGenesis() *Genesis {
+	return &Genesis{
+		NetworkID:         DefaultNetworkID,
+		Timestamp:         time.Unix(0, 0).UTC(),
+		InitialDifficulty: initialDifficulty,
+		RSAKeyBits:        DefaultRSAKeyBits,
+		ElGamalKeyBits:    DefaultElGamalKeyBits,
+		Consensus:         ProofOfWork,
+		Signers:           []string{},
+		Validators:        []string{},
+		Authorities:       []GenesisKey{},
+		Voters:            []GenesisKey{},
+	}
+}
+
+// Read a genesis file, the parameters that are missing get their default value
+func LoadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	genesis := DefaultGenesis()
+	genesis.NetworkID = ""
+	if err := json.Unmarshal(data, genesis); err != nil {
+		return nil, fmt.Errorf("invalid genesis file: %v", err)
+	}
+	if genesis.NetworkID == "" {
+		return nil, fmt.Errorf("genesis file without networkId")
+	}
+	return genesis, nil
+}
+
+func (g *Genesis) Config() ChainConfig {
+	return ChainConfig{
+		NetworkID:         g.NetworkID,
+		InitialDifficulty: uint32(g.InitialDifficulty),
+		RSAKeyBits:        g.RSAKeyBits,
+		ElGamalKeyBits:    g.ElGamalKeyBits,
+		Consensus:         g.Consensus,
+		Signers:           g.Signers,
+		Validators:        g.Validators,
+	}
+}
+
+// The genesis block, in which the authorities and voters are registered
+func (g *Genesis) Block() (*Block, error) {
+	pow := g.Consensus == "" || g.Consensus == ProofOfWork
+	if pow && (g.InitialDifficulty < minDifficulty || g.InitialDifficulty > maxDifficulty) {
+		return nil, fmt.Errorf("initial difficulty must be between %v and %v", minDifficulty, maxDifficulty)
+	}
+	config := g.Config()
+	if _, err := NewConsensus(config); err != nil {
+		return nil, err
+	}
+	group, err := elgamal.StandardGroup(int(g.ElGamalKeyBits))
+	if err != nil {
+		return nil, err
+	}
+	// Ballots grow with the group, ranked polls of a few options have to stay possible
+	ranked := &Poll{BallotType: ballot.Ranked, Options: make([]string, minRankedOptions)}
+	if err := checkBallotSize(group, ballot.Size(ranked), len(ballot.OneHotGroups(ranked)), g.RSAKeyBits); err != nil {
+		return nil, fmt.Errorf("elgamalKeyBits too large for ranked polls of %v options: %v", minRankedOptions, err)
+	}
+
+	// The keys of the signers and validators are fixed here, they can't be registered later
+	authorities := make(map[string]bool)
+	for _, key := range g.Authorities {
+		authorities[key.Name] = true
+	}
+	for _, signer := range g.Signers {
+		if !authorities[signer] {
+			return nil, fmt.Errorf("signer %v is not one of the authorities", signer)
+		}
+	}
+	for _, validator := range g.Validators {
+		if !authorities[validator] {
+			return nil, fmt.Errorf("validator %v is not one of the authorities", validator)
+		}
+	}
+
+	registers := make([]*RegisterTx, 0)
+	registered := make(map[string]bool)
+	for _, key := range append(append([]GenesisKey{}, g.Authorities...), g.Voters...) {
+		if key.Name == "" || registered[key.Name] {
+			return nil, fmt.Errorf("user %q registered twice or without name", key.Name)
+		}
+		pubKey, err := DecodePublicKey(key.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key of %v: %v", key.Name, err)
+		}
+		if pubKey.N.BitLen() < int(g.RSAKeyBits) {
+			return nil, fmt.Errorf("public key of %v has %v bits, at least %v required", key.Name, pubKey.N.BitLen(), g.RSAKeyBits)
+		}
+		registered[key.Name] = true
+		registers = append(registers, &RegisterTx{
+			ID: uint32(len(registers)),
+			Registry: &Registry{
+				Origin:    key.Name,
+				PublicKey: SerializableRSAPubKey{N: pubKey.N.Bytes(), E: pubKey.E},
+			},
+		})
+	}
+
+	block := &Block{
+		ID:           0,
+		Timestamp:    g.Timestamp.UTC(),
+		Transactions: Transactions{Registers: registers},
+		Difficulty:   1,
+		Nonce:        "",
+		PrevHash:     "0",
+		Config:       &config,
+	}
+	block.MerkleRoot = block.Transactions.MerkleRoot()
+	block.Hash = calculateHash(block)
+	return block, nil
+}
+
+// Public key in the format of the genesis file
+func EncodePublicKey(pubKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+func DecodePublicKey(encoded string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,190 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+)
+
+// Receipt of the transaction with hash txHash
+func (b *Blockchain) Receipt(txHash []byte) *Receipt {
+	if proof := b.ProveInclusion(txHash); proof != nil {
+		b.mutex.RLock()
+		length := uint32(len(b.Blocks))
+		b.mutex.RUnlock()
+		confirmations := uint32(0)
+		if proof.Header.ID < length {
+			confirmations = length - proof.Header.ID
+		}
+		return &Receipt{
+			TxHash:        hex.EncodeToString(txHash),
+			Status:        TxIncluded,
+			BlockID:       proof.Header.ID,
+			Confirmations: confirmations,
+			Final:         proof.Header.ID <= b.finalizedHeight(),
+			Proof:         proof,
+		}
+	}
+	if b.mempool.Contains(txHash) {
+		return &Receipt{TxHash: hex.EncodeToString(txHash), Status: TxPending}
+	}
+	return &Receipt{TxHash: hex.EncodeToString(txHash), Status: TxUnknown}
+}
+
+// Whether the transaction with hash txHash is in a finalized block
+func (b *Blockchain) IsFinal(txHash []byte) bool {
+	proof := b.ProveInclusion(txHash)
+	return proof != nil && proof.Header.ID <= b.finalizedHeight()
+}
+
+// Proof that the transaction with hash txHash is in a block of the main chain, nil if it isn't
+func (b *Blockchain) ProveInclusion(txHash []byte) *InclusionProof {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	id, exists := b.txBlocks[string(txHash)]
+	if !exists || int(id) >= len(b.Blocks) {
+		return nil
+	}
+	return proveInclusion(b.Blocks[id], txHash)
+}
+
+// Add the transactions of block to the index of the main chain, or remove them. Locked by b.mutex
+func (b *Blockchain) indexTransactions(block *Block, add bool) {
+	for _, hash := range txHashes(block.Transactions) {
+		if add {
+			b.txBlocks[string(hash)] = block.ID
+		} else if b.txBlocks[string(hash)] == block.ID {
+			delete(b.txBlocks, string(hash))
+		}
+	}
+}
+
+func txHashes(t Transactions) [][]byte {
+	hashes := make([][]byte, 0, len(t.Votes)+len(t.Polls)+len(t.Registers)+len(t.Results)+len(t.Revotes)+
+		len(t.Delegations))
+	for _, tx := range t.Votes {
+		hashes = append(hashes, tx.Hash())
+	}
+	for _, tx := range t.Polls {
+		hashes = append(hashes, tx.Hash())
+	}
+	for _, tx := range t.Registers {
+		hashes = append(hashes, tx.Hash())
+	}
+	for _, tx := range t.Results {
+		hashes = append(hashes, tx.Hash())
+	}
+	for _, tx := range t.Revotes {
+		hashes = append(hashes, tx.Hash())
+	}
+	for _, tx := range t.Delegations {
+		hashes = append(hashes, tx.Hash())
+	}
+	return hashes
+}
+
+// The complete genesis block followed by the headers of the other blocks of the main chain, without their
+// transactions. Whoever holds an inclusion proof can check with VerifyHeaders that its block is on the chain
+func (b *Blockchain) Headers() []*Block {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	headers := make([]*Block, len(b.Blocks))
+	headers[0] = b.Blocks[0]
+	for i, block := range b.Blocks[1:] {
+		header := *block
+		header.Transactions = Transactions{}
+		headers[i+1] = &header
+	}
+	return headers
+}
+
+// Verify headers as returned by Headers the way a node verifies the blocks it receives, without their
+// transactions: the hashes, the links to the parents and the proof-of-work or the signatures of the signers
+func VerifyHeaders(headers []*Block) error {
+	if len(headers) == 0 {
+		return fmt.Errorf("no headers")
+	}
+	genesis := headers[0]
+	if genesis.ID != 0 || genesis.Config == nil || !hashesValid(genesis) {
+		return fmt.Errorf("invalid genesis block")
+	}
+	b, err := newBlockChain(genesis)
+	if err != nil {
+		return err
+	}
+
+	parent := b.tipNode()
+	for _, header := range headers[1:] {
+		if header.ID != parent.block.ID+1 || header.PrevHash != parent.block.Hash {
+			return fmt.Errorf("header %v does not follow block %v", header.ID, parent.block.ID)
+		}
+		if calculateHash(header) != header.Hash {
+			return fmt.Errorf("header %v: invalid hash", header.ID)
+		}
+		if err := b.consensus.VerifyHeader(header); err != nil {
+			return fmt.Errorf("header %v: %v", header.ID, err)
+		}
+		if err := b.consensus.VerifySeal(b, header, parent); err != nil {
+			return fmt.Errorf("header %v: %v", header.ID, err)
+		}
+		parent = &blockNode{block: header, parent: parent}
+	}
+	return nil
+}
+
+func proveInclusion(block *Block, txHash []byte) *InclusionProof {
+	// The leaves are in the same order as in Transactions.Leaves
+	index := 0
+	proof := func(kind byte, id uint32) *InclusionProof {
+		header := *block
+		header.Transactions = Transactions{}
+		return &InclusionProof{
+			Header: &header,
+			Kind:   kind,
+			TxID:   id,
+			TxHash: txHash,
+			Proof:  NewMerkleProof(block.Transactions.Leaves(), index),
+		}
+	}
+
+	for _, tx := range block.Transactions.Votes {
+		if bytes.Equal(tx.Hash(), txHash) {
+			return proof(VoteLeaf, tx.ID)
+		}
+		index++
+	}
+	for _, tx := range block.Transactions.Polls {
+		if bytes.Equal(tx.Hash(), txHash) {
+			return proof(PollLeaf, tx.ID)
+		}
+		index++
+	}
+	for _, tx := range block.Transactions.Registers {
+		if bytes.Equal(tx.Hash(), txHash) {
+			return proof(RegisterLeaf, tx.ID)
+		}
+		index++
+	}
+	for _, tx := range block.Transactions.Results {
+		if bytes.Equal(tx.Hash(), txHash) {
+			return proof(ResultLeaf, tx.ID)
+		}
+		index++
+	}
+	for _, tx := range block.Transactions.Revotes {
+		if bytes.Equal(tx.Hash(), txHash) {
+			return proof(RevoteLeaf, tx.ID)
+		}
+		index++
+	}
+	for _, tx := range block.Transactions.Delegations {
+		if bytes.Equal(tx.Hash(), txHash) {
+			return proof(DelegationLeaf, tx.ID)
+		}
+		index++
+	}
+	return nil
+}
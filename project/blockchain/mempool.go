@@ -0,0 +1,372 @@
+package blockchain
+
+import (
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"sync"
+	"time"
+)
+
+const maxMempoolSize = 4096
+const maxPendingPerOrigin = 64
+const mempoolExpiry = 30 * time.Minute
+
+// Transaction waiting to be mined
+type pendingTx struct {
+	kind   byte // VoteLeaf to DelegationLeaf
+	origin string
+	added  time.Time
+
+	vote       *VoteTx
+	poll       *PollTx
+	register   *RegisterTx
+	result     *ResultTx
+	revote     *RevoteTx
+	delegation *DelegationTx
+}
+
+// Transactions that are not in a block of the main chain yet, by hash: a transaction that is gossiped
+// more than once is only kept once. Received transactions are verified before they are added, those that
+// are no longer valid on top of a new block are evicted, and those that are not mined within mempoolExpiry
+// are dropped
+type Mempool struct {
+	txs       map[string]*pendingTx
+	order     []string       // Hashes in order of arrival
+	perOrigin map[string]int // Number of pending transactions of every origin
+	verify    verifyFunc     // nil if the transactions are not verified
+	check     checkFunc      // nil if the transactions are not checked against the chain
+	mutex     *sync.Mutex
+}
+
+// Check a received transaction, the origins registered by pending transactions can sign with pendingKeys
+type verifyFunc func(pending *pendingTx, pendingKeys map[string]*rsa.PublicKey) error
+
+// The transactions of txs that are valid in a block on top of the main chain
+type checkFunc func(txs Transactions) Transactions
+
+func NewMempool(verify verifyFunc, check checkFunc) *Mempool {
+	return &Mempool{
+		txs:       make(map[string]*pendingTx),
+		order:     make([]string, 0),
+		perOrigin: make(map[string]int),
+		verify:    verify,
+		check:     check,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// The hashes of transactions of different kinds don't share a key, even if they would be equal
+func mempoolKey(kind byte, hash []byte) string {
+	return string(kind) + hex.EncodeToString(hash)
+}
+
+func newPendingTx(tx *Transaction) (string, *pendingTx, error) {
+	pending := &pendingTx{added: time.Now()}
+	var hash []byte
+	switch {
+	case tx.VoteTx != nil && tx.VoteTx.Vote != nil:
+		pending.kind, pending.vote, pending.origin = VoteLeaf, tx.VoteTx, tx.VoteTx.Vote.Origin
+		hash = tx.VoteTx.Hash()
+	case tx.PollTx != nil && tx.PollTx.Poll != nil:
+		pending.kind, pending.poll, pending.origin = PollLeaf, tx.PollTx, tx.PollTx.Poll.Origin
+		hash = tx.PollTx.Hash()
+	case tx.RegisterTx != nil && tx.RegisterTx.Registry != nil:
+		pending.kind, pending.register, pending.origin = RegisterLeaf, tx.RegisterTx, tx.RegisterTx.Registry.Origin
+		hash = tx.RegisterTx.Hash()
+	case tx.ResultTx != nil && tx.ResultTx.Result != nil:
+		// Results have no origin: anyone who collected the partial decryptions can publish them
+		pending.kind, pending.result = ResultLeaf, tx.ResultTx
+		hash = tx.ResultTx.Hash()
+	case tx.RevoteTx != nil && tx.RevoteTx.Revote != nil && tx.RevoteTx.Revote.Vote != nil:
+		pending.kind, pending.revote, pending.origin = RevoteLeaf, tx.RevoteTx, tx.RevoteTx.Revote.Vote.Origin
+		hash = tx.RevoteTx.Hash()
+	case tx.DelegationTx != nil && tx.DelegationTx.Delegation != nil:
+		pending.kind, pending.delegation = DelegationLeaf, tx.DelegationTx
+		pending.origin = tx.DelegationTx.Delegation.Origin
+		hash = tx.DelegationTx.Hash()
+	default:
+		return "", nil, fmt.Errorf("empty transaction")
+	}
+	return mempoolKey(pending.kind, hash), pending, nil
+}
+
+// Add a transaction that was received, it is rejected if it is invalid, if it is already pending, if its
+// origin has too many pending transactions, or if the mempool is full
+func (m *Mempool) Add(tx *Transaction) error {
+	key, pending, err := newPendingTx(tx)
+	if err != nil {
+		return err
+	}
+	// Not under the lock, checking the signature takes a while
+	if m.verify != nil {
+		if err := m.verify(pending, m.pendingKeys()); err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+	if _, exists := m.txs[key]; exists {
+		return fmt.Errorf("duplicate transaction")
+	}
+	if pending.origin != "" && m.perOrigin[pending.origin] >= maxPendingPerOrigin {
+		return fmt.Errorf("too many pending transactions from %v", pending.origin)
+	}
+	if len(m.txs) >= maxMempoolSize {
+		return fmt.Errorf("mempool is full")
+	}
+	m.insert(key, pending)
+	return nil
+}
+
+// Put the transactions of a block that was rolled back in the mempool again. They were valid once,
+// so the limits do not apply
+func (m *Mempool) Reinsert(txs Transactions) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, tx := range splitTransactions(txs) {
+		key, pending, err := newPendingTx(tx)
+		if err != nil {
+			continue
+		}
+		if _, exists := m.txs[key]; !exists {
+			m.insert(key, pending)
+		}
+	}
+}
+
+// Remove the transactions of a block that was added to the main chain, and evict the pending transactions
+// that are no longer valid on top of it, e.g. votes on a poll that closed or a second vote of a voter
+func (m *Mempool) Remove(txs Transactions) {
+	m.mutex.Lock()
+	for _, tx := range splitTransactions(txs) {
+		if key, _, err := newPendingTx(tx); err == nil {
+			m.delete(key)
+		}
+	}
+	m.compact()
+	m.mutex.Unlock()
+
+	if m.check == nil {
+		return
+	}
+	// Not under the lock, checking the transactions takes a while. Transactions added meanwhile stay
+	pending := m.Transactions()
+	valid := make(map[string]bool)
+	for _, tx := range splitTransactions(m.check(pending)) {
+		if key, _, err := newPendingTx(tx); err == nil {
+			valid[key] = true
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, tx := range splitTransactions(pending) {
+		key, evicted, err := newPendingTx(tx)
+		if err == nil && !valid[key] {
+			fmt.Printf("MEMPOOL evicting transaction from %v, it is invalid on the new tip\n", evicted.origin)
+			m.delete(key)
+		}
+	}
+	m.compact()
+}
+
+// Whether a transaction with hash txHash is pending
+func (m *Mempool) Contains(txHash []byte) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, kind := range []byte{VoteLeaf, PollLeaf, RegisterLeaf, ResultLeaf, RevoteLeaf, DelegationLeaf} {
+		if _, exists := m.txs[mempoolKey(kind, txHash)]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys of the origins registered by pending transactions
+func (m *Mempool) pendingKeys() map[string]*rsa.PublicKey {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, pending := range m.txs {
+		if pending.kind == RegisterLeaf {
+			pubKey := pending.register.Registry.PublicKey.ToRSA()
+			keys[pending.origin] = &pubKey
+		}
+	}
+	return keys
+}
+
+func (m *Mempool) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.txs)
+}
+
+// The pending transactions by kind, which checkTransactions applies in dependency order (registrations before
+// the polls and votes signed with them, and so on). Within a kind they are in order of arrival, except that
+// revotes and delegations come after the pending transaction they supersede. The polls are copies: the miner
+// assigns them an ID, which must not change the pending transactions
+func (m *Mempool) Transactions() Transactions {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+	txs := Transactions{
+		Votes:       make([]*VoteTx, 0),
+		Polls:       make([]*PollTx, 0),
+		Registers:   make([]*RegisterTx, 0),
+		Results:     make([]*ResultTx, 0),
+		Revotes:     make([]*RevoteTx, 0),
+		Delegations: make([]*DelegationTx, 0),
+	}
+	for _, key := range m.order {
+		pending, exists := m.txs[key]
+		if !exists {
+			continue
+		}
+		switch pending.kind {
+		case VoteLeaf:
+			txs.Votes = append(txs.Votes, pending.vote)
+		case PollLeaf:
+			pollCopy := *pending.poll
+			txs.Polls = append(txs.Polls, &pollCopy)
+		case RegisterLeaf:
+			txs.Registers = append(txs.Registers, pending.register)
+		case ResultLeaf:
+			txs.Results = append(txs.Results, pending.result)
+		case RevoteLeaf:
+			txs.Revotes = append(txs.Revotes, pending.revote)
+		case DelegationLeaf:
+			txs.Delegations = append(txs.Delegations, pending.delegation)
+		}
+	}
+
+	hashes := make([][]byte, len(txs.Revotes))
+	supersedes := make([][]byte, len(txs.Revotes))
+	for i, tx := range txs.Revotes {
+		hashes[i], supersedes[i] = tx.Hash(), tx.Revote.Supersedes
+	}
+	revotes := make([]*RevoteTx, 0, len(txs.Revotes))
+	for _, i := range dependencyOrder(hashes, supersedes) {
+		revotes = append(revotes, txs.Revotes[i])
+	}
+	txs.Revotes = revotes
+
+	hashes = make([][]byte, len(txs.Delegations))
+	supersedes = make([][]byte, len(txs.Delegations))
+	for i, tx := range txs.Delegations {
+		hashes[i], supersedes[i] = tx.Hash(), tx.Delegation.Supersedes
+	}
+	delegations := make([]*DelegationTx, 0, len(txs.Delegations))
+	for _, i := range dependencyOrder(hashes, supersedes) {
+		delegations = append(delegations, txs.Delegations[i])
+	}
+	txs.Delegations = delegations
+	return txs
+}
+
+// Order of transactions with the given hashes in which every transaction comes after the one it supersedes,
+// if that one is among them. Otherwise the order is kept
+func dependencyOrder(hashes [][]byte, supersedes [][]byte) []int {
+	index := make(map[string]int)
+	for i, hash := range hashes {
+		index[string(hash)] = i
+	}
+	order := make([]int, 0, len(hashes))
+	placed := make([]bool, len(hashes))
+	var place func(i int)
+	place = func(i int) {
+		if placed[i] {
+			return
+		}
+		// Marked before the transaction it supersedes is placed, so a cycle of hashes ends
+		placed[i] = true
+		if j, exists := index[string(supersedes[i])]; exists {
+			place(j)
+		}
+		order = append(order, i)
+	}
+	for i := range hashes {
+		place(i)
+	}
+	return order
+}
+
+func (m *Mempool) insert(key string, pending *pendingTx) {
+	m.txs[key] = pending
+	m.order = append(m.order, key)
+	if pending.origin != "" {
+		m.perOrigin[pending.origin]++
+	}
+}
+
+func (m *Mempool) delete(key string) {
+	pending, exists := m.txs[key]
+	if !exists {
+		return
+	}
+	delete(m.txs, key)
+	if pending.origin != "" {
+		m.perOrigin[pending.origin]--
+		if m.perOrigin[pending.origin] == 0 {
+			delete(m.perOrigin, pending.origin)
+		}
+	}
+}
+
+// Drop the transactions that are pending for longer than mempoolExpiry
+func (m *Mempool) expire() {
+	deadline := time.Now().Add(-mempoolExpiry)
+	for key, pending := range m.txs {
+		if pending.added.Before(deadline) {
+			fmt.Printf("MEMPOOL dropping expired transaction from %v\n", pending.origin)
+			m.delete(key)
+		}
+	}
+	m.compact()
+}
+
+// Remove the hashes of deleted transactions from the order
+func (m *Mempool) compact() {
+	order := m.order[:0]
+	for _, key := range m.order {
+		if _, exists := m.txs[key]; exists {
+			order = append(order, key)
+		}
+	}
+	m.order = order
+}
+
+// Wrap every transaction in its own Transaction
+func splitTransactions(txs Transactions) []*Transaction {
+	split := make([]*Transaction, 0)
+	for _, tx := range txs.Votes {
+		split = append(split, &Transaction{VoteTx: tx})
+	}
+	for _, tx := range txs.Polls {
+		split = append(split, &Transaction{PollTx: tx})
+	}
+	for _, tx := range txs.Registers {
+		split = append(split, &Transaction{RegisterTx: tx})
+	}
+	for _, tx := range txs.Results {
+		split = append(split, &Transaction{ResultTx: tx})
+	}
+	for _, tx := range txs.Revotes {
+		split = append(split, &Transaction{RevoteTx: tx})
+	}
+	for _, tx := range txs.Delegations {
+		split = append(split, &Transaction{DelegationTx: tx})
+	}
+	return split
+}
@@ -0,0 +1,205 @@
+package blockchain
+
+import (
+	"crypto/rsa"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func pendingPoll(origin string, question string) *Transaction {
+	return &Transaction{PollTx: &PollTx{Poll: &Poll{Origin: origin, Question: question}}}
+}
+
+func pendingResult(pollid uint32) *Transaction {
+	return &Transaction{ResultTx: &ResultTx{Result: &Result{PollId: pollid}}}
+}
+
+// Revote of voter on poll 0, distinguished by i
+func pendingRevote(voter string, i int, supersedes []byte) *RevoteTx {
+	vote := &EncryptedVote{Origin: voter, Vote: [][]byte{[]byte(strconv.Itoa(i))}}
+	return &RevoteTx{Revote: &Revote{Vote: vote, Supersedes: supersedes}}
+}
+
+func TestMempoolAdd(t *testing.T) {
+	register := testRegistration("alice")
+	tests := []struct {
+		name    string
+		pending func(m *Mempool) // Adds the transactions that are pending before
+		tx      *Transaction
+		verify  verifyFunc
+		added   bool
+	}{
+		{"registration", func(m *Mempool) {}, &Transaction{RegisterTx: register}, nil, true},
+		{"duplicate", func(m *Mempool) {
+			m.Add(&Transaction{RegisterTx: register})
+		}, &Transaction{RegisterTx: register}, nil, false},
+		{"empty transaction", func(m *Mempool) {}, &Transaction{}, nil, false},
+		{"invalid transaction", func(m *Mempool) {}, &Transaction{RegisterTx: register},
+			func(pending *pendingTx, pendingKeys map[string]*rsa.PublicKey) error { return fmt.Errorf("invalid") }, false},
+		{"too many of the origin", func(m *Mempool) {
+			for i := 0; i < maxPendingPerOrigin; i++ {
+				m.Add(pendingPoll("bob", strconv.Itoa(i)))
+			}
+		}, pendingPoll("bob", "last"), nil, false},
+		{"many of another origin", func(m *Mempool) {
+			for i := 0; i < maxPendingPerOrigin; i++ {
+				m.Add(pendingPoll("bob", strconv.Itoa(i)))
+			}
+		}, pendingPoll("carol", "last"), nil, true},
+		{"many results", func(m *Mempool) {
+			for i := 0; i < maxPendingPerOrigin; i++ {
+				m.Add(pendingResult(uint32(i)))
+			}
+		}, pendingResult(maxPendingPerOrigin), nil, true},
+		{"full", func(m *Mempool) {
+			for i := 0; i < maxMempoolSize; i++ {
+				m.Add(pendingResult(uint32(i)))
+			}
+		}, pendingResult(maxMempoolSize), nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMempool(nil, nil)
+			test.pending(m)
+			m.verify = test.verify
+			before := m.Len()
+			err := m.Add(test.tx)
+			if (err == nil) != test.added {
+				t.Errorf("added = %v (%v), expected %v", err == nil, err, test.added)
+			}
+			if added := m.Len() - before; (added == 1) != test.added {
+				t.Errorf("%v transactions added", added)
+			}
+		})
+	}
+}
+
+func TestMempoolExpire(t *testing.T) {
+	m := NewMempool(nil, nil)
+	old, recent := pendingPoll("alice", "old"), pendingPoll("alice", "recent")
+	m.Add(old)
+	m.Add(recent)
+	for _, pending := range m.txs {
+		if pending.poll == old.PollTx {
+			pending.added = time.Now().Add(-mempoolExpiry - time.Second)
+		}
+	}
+
+	polls := m.Transactions().Polls
+	if len(polls) != 1 || polls[0].Poll.Question != "recent" || m.Len() != 1 {
+		t.Errorf("%v polls pending after expiry", len(polls))
+	}
+	if m.Contains(old.PollTx.Hash()) || m.perOrigin["alice"] != 1 {
+		t.Error("expired poll still counted")
+	}
+	// The expired poll can be added again
+	if err := m.Add(old); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMempoolReinsert(t *testing.T) {
+	m := NewMempool(nil, nil)
+	for i := 0; i < maxPendingPerOrigin; i++ {
+		m.Add(pendingPoll("alice", strconv.Itoa(i)))
+	}
+	mined := Transactions{Polls: []*PollTx{pendingPoll("alice", "mined").PollTx, pendingPoll("alice", "0").PollTx}}
+
+	// The rolled back poll is pending again even though alice reached the limit, the other one was pending already
+	m.Reinsert(mined)
+	if m.Len() != maxPendingPerOrigin+1 || !m.Contains(mined.Polls[0].Hash()) {
+		t.Errorf("%v transactions pending after reinserting", m.Len())
+	}
+	m.Remove(mined)
+	if m.Len() != maxPendingPerOrigin-1 || m.perOrigin["alice"] != maxPendingPerOrigin-1 {
+		t.Errorf("%v transactions pending after removing", m.Len())
+	}
+}
+
+// Remove evicts the pending transactions that are invalid on top of the new tip
+func TestMempoolRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   checkFunc
+		pending int
+	}{
+		{"no check", nil, 2},
+		{"all valid", func(txs Transactions) Transactions { return txs }, 2},
+		{"results invalid", func(txs Transactions) Transactions {
+			txs.Results = nil
+			return txs
+		}, 1},
+		{"all invalid", func(txs Transactions) Transactions { return Transactions{} }, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMempool(nil, test.check)
+			mined := pendingPoll("alice", "mined")
+			for _, tx := range []*Transaction{mined, pendingPoll("alice", "pending"), pendingResult(1)} {
+				m.Add(tx)
+			}
+			m.Remove(Transactions{Polls: []*PollTx{mined.PollTx}})
+			if m.Len() != test.pending || m.Contains(mined.PollTx.Hash()) {
+				t.Errorf("%v transactions pending, expected %v", m.Len(), test.pending)
+			}
+		})
+	}
+}
+
+func TestMempoolTransactions(t *testing.T) {
+	m := NewMempool(nil, nil)
+	vote := &VoteTx{Vote: &EncryptedVote{Origin: "alice"}}
+	first := pendingRevote("alice", 1, vote.Hash())
+	second := pendingRevote("alice", 2, first.Hash())
+	other := pendingRevote("bob", 3, []byte("mined"))
+	// The second revote arrives before the first one it supersedes
+	for _, tx := range []*Transaction{{RevoteTx: second}, {RevoteTx: other}, {VoteTx: vote}, {RevoteTx: first},
+		pendingPoll("alice", "poll")} {
+		m.Add(tx)
+	}
+
+	txs := m.Transactions()
+	if len(txs.Votes) != 1 || len(txs.Polls) != 1 {
+		t.Errorf("%v votes and %v polls pending", len(txs.Votes), len(txs.Polls))
+	}
+	if !reflect.DeepEqual(txs.Revotes, []*RevoteTx{first, second, other}) {
+		t.Error("revotes not after the revotes they supersede")
+	}
+	// The miner assigns IDs to the polls, which doesn't change the pending polls
+	txs.Polls[0].ID = 7
+	if m.Transactions().Polls[0].ID != 0 {
+		t.Error("pending poll changed")
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		supersedes []string // Hash superseded by every transaction, the hashes are "0", "1", ...
+		order      []int
+	}{
+		{"independent", []string{"x", "y", "z"}, []int{0, 1, 2}},
+		{"in order", []string{"x", "0", "1"}, []int{0, 1, 2}},
+		{"reversed", []string{"1", "2", "x"}, []int{2, 1, 0}},
+		{"two chains", []string{"2", "3", "x", "y"}, []int{2, 0, 3, 1}},
+		{"two superseding the same", []string{"2", "2", "x"}, []int{2, 0, 1}},
+		{"cycle", []string{"1", "0", "x"}, []int{1, 0, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hashes := make([][]byte, len(test.supersedes))
+			supersedes := make([][]byte, len(test.supersedes))
+			for i := range hashes {
+				hashes[i] = []byte(strconv.Itoa(i))
+				supersedes[i] = []byte(test.supersedes[i])
+			}
+			if order := dependencyOrder(hashes, supersedes); !reflect.DeepEqual(order, test.order) {
+				t.Errorf("order %v, expected %v", order, test.order)
+			}
+		})
+	}
+}
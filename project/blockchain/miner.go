@@ -1,153 +1,127 @@
 package blockchain
 
 import (
-	"bitbucket.org/ustraca/crypto/paillier"
+	"context"
+	"crypto/rsa"
 	"fmt"
+	"github.com/dedis/protobuf"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
 	"github.com/lukasdeloose/decentralized-voting-system/project/udp"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"sync"
 	"time"
 )
 
 const numTxBeforeMine = 1
 const numTxBeforeGossip = 1
-const secondsPerBlock = 10 * time.Second
-const initialDifficulty = 3
+
+// Blocks are gossiped in a single UDP packet, leave room for the headers of the rumor around it
+const maxBlockSize = udp.BUFFERSIZE - 1024
+
+// Length of the names in the largest ballot a network has to carry, see checkBallotSize
+const ballotNameSize = 32
 
 type Miner struct {
-	blockchain       *Blockchain
-	forkedBlockchain *Blockchain
-	difficulty       int
-	transActionsIn   chan *Transaction
-	blocksIn         chan *Block
-	blocksOut        chan *AddrGossipPacket
-	stopMining       chan uint32 // ID of block where to stop mining for
-	fork             bool
-	mining           bool // To make sure that we don't start mining multiple times
-	name             string
+	blockchain     *Blockchain
+	transActionsIn chan *Transaction
+	blocksIn       chan *Block
+	blocksOut      chan *AddrGossipPacket
+	stopMining     context.CancelFunc // Stops mining the current block, nil if we are not mining
+	mining         bool               // To make sure that we don't start mining multiple times
+	miningMutex    *sync.Mutex
+	name           string
+	key            func() *rsa.PrivateKey // Our private key, to sign blocks with if the consensus needs it
+	workers        int                    // Number of goroutines searching for a nonce in parallel
 }
 
-func NewMiner(name string, blockchain *Blockchain, transActionsIn chan *Transaction, blockIn chan *Block, blocksOut chan *AddrGossipPacket) *Miner {
+func NewMiner(name string, blockchain *Blockchain, transActionsIn chan *Transaction, blockIn chan *Block, blocksOut chan *AddrGossipPacket,
+	key func() *rsa.PrivateKey, workers int) *Miner {
 	return &Miner{
 		blockchain:     blockchain,
-		difficulty:     initialDifficulty,
 		transActionsIn: transActionsIn,
 		blocksIn:       blockIn,
 		blocksOut:      blocksOut,
-		stopMining:     make(chan uint32, 10),
 		mining:         false,
+		miningMutex:    &sync.Mutex{},
 		name:           name,
+		key:            key,
+		workers:        workers,
 	}
 }
 
-func (miner Miner) Run() {
+func (miner *Miner) Run() {
 	go miner.listenTransactions()
 	go miner.listenBlocks()
 }
 
-func (miner Miner) listenTransactions() {
+func (miner *Miner) listenTransactions() {
 	for tx := range miner.transActionsIn {
-		miner.blockchain.addUnconfirmedTransaction(*tx)
-		numTrans := len(miner.blockchain.unconfirmedTransactions.Polls) + len(miner.blockchain.unconfirmedTransactions.Registers) + len(miner.blockchain.unconfirmedTransactions.Votes)
-		if numTrans > numTxBeforeMine {
-			miner.generateBlock()
-		}
-	}
-}
-
-func (miner Miner) handleFork(block *Block) {
-	if block.ID == uint32(len(miner.blockchain.Blocks)) {
-		// Next block
-		if block.PrevHash == miner.blockchain.lastBlock().Hash {
-			miner.stopMining <- block.ID
-			miner.blockchain.Blocks = append(miner.blockchain.Blocks, block)
-			miner.blockchain.addTransactions(block.Transactions)
-			miner.blockchain.removeConfirmedTx(block.Transactions)
+		if err := miner.blockchain.mempool.Add(tx); err != nil {
+			if Debug {
+				fmt.Printf("[DEBUG] Transaction from %v not added to the mempool: %v\n", tx.Origin, err)
+			}
+			continue
 		}
-	} else if block.ID == uint32(len(miner.forkedBlockchain.Blocks)) {
-		if block.PrevHash == miner.forkedBlockchain.lastBlock().Hash {
-			miner.forkedBlockchain.Blocks = append(miner.forkedBlockchain.Blocks, block)
-			miner.forkedBlockchain.addTransactions(block.Transactions)
-			miner.forkedBlockchain.removeConfirmedTx(block.Transactions)
+		if miner.blockchain.mempool.Len() > numTxBeforeMine {
+			miner.generateBlock()
 		}
-	} else if len(miner.forkedBlockchain.Blocks) > len(miner.blockchain.Blocks) {
-		temp := miner.blockchain
-		miner.blockchain = miner.forkedBlockchain
-		miner.forkedBlockchain = temp
-	} else if len(miner.blockchain.Blocks)-len(miner.forkedBlockchain.Blocks) > 4 {
-		miner.forkedBlockchain = nil
-		miner.fork = false
 	}
 }
 
-func (miner Miner) listenBlocks() {
+func (miner *Miner) listenBlocks() {
 	for block := range miner.blocksIn {
-		fmt.Println("Received block from", block.Origin, "with id", block.ID, "in miner")
-		if !miner.validBlock(block) {
-			fmt.Println("Block not valid")
-		} else if miner.fork == true {
-			fmt.Println("handling fork")
-			miner.handleFork(block)
-		} else if block.ID == uint32(len(miner.blockchain.Blocks)) {
-			fmt.Println("It's the next block")
-			// Next block
-			if block.PrevHash == miner.blockchain.lastBlock().Hash {
-				fmt.Println("Hash is correct! Adding block")
-				miner.stopMining <- block.ID
-				fmt.Println("Transactions are:", block.Transactions)
-				miner.blockchain.Blocks = append(miner.blockchain.Blocks, block)
-				miner.blockchain.addTransactions(block.Transactions)
-				miner.blockchain.removeConfirmedTx(block.Transactions)
-			}
-		} else if block.ID == uint32(len(miner.blockchain.Blocks))-1 {
-			if block.PrevHash == miner.blockchain.Blocks[len(miner.blockchain.Blocks)-1].Hash {
-				fmt.Println("Fork detected")
-				miner.fork = true
-				miner.forkedBlockchain = miner.blockchain
-				miner.forkedBlockchain.Blocks = append(miner.blockchain.Blocks, block)
-				miner.forkedBlockchain.addTransactions(block.Transactions)
-				miner.forkedBlockchain.removeConfirmedTx(block.Transactions)
+		if Debug {
+			fmt.Println("[DEBUG] Received block from", block.Origin, "with id", block.ID, "in miner")
+		}
+		if miner.blockchain.AddBlock(block) {
+			// The main chain changed: stop mining on the old tip
+			miner.miningMutex.Lock()
+			if miner.stopMining != nil {
+				miner.stopMining()
 			}
+			miner.miningMutex.Unlock()
 		}
 	}
 }
 
-func (miner Miner) validBlock(block *Block) bool {
-	if !hashesValid(block) {
-		fmt.Println("Invalid hashes")
-		return false
-	}
-	if _, ok := miner.checkTransactions(block.Transactions); !ok {
-		fmt.Println("Invalid transactions")
-		return false
-	}
-	return true
-}
-
-// Calculates the difficulty (amount of 0's necessary for the hashing problem) for the PoW algorithm
-func (miner Miner) adaptDifficulty() {
-	prevTime := miner.blockchain.Blocks[miner.blockchain.length()-10].Timestamp
-	timeDiff := time.Now().Sub(prevTime)
-	if timeDiff/10 < 10*secondsPerBlock {
-		miner.difficulty++
-	}
-}
-
 // Take the current unconfirmed transactions and try to mine new block from these
-func (miner Miner) generateBlock() {
+func (miner *Miner) generateBlock() {
+	// Cancelled as soon as the tip of the main chain changes, so before the block is prepared on top of it
+	ctx, cancel := context.WithCancel(context.Background())
+	miner.miningMutex.Lock()
+	miner.stopMining = cancel
+	miner.miningMutex.Unlock()
+	defer func() {
+		miner.miningMutex.Lock()
+		miner.stopMining = nil
+		miner.miningMutex.Unlock()
+		cancel()
+	}()
+
 	newBlock := &Block{
-		ID:             uint32(len(miner.blockchain.Blocks)),
-		Origin:         miner.name,
-		PaillierPublic: paillier.PublicKey{},
-		Difficulty:     miner.difficulty,
-		PrevHash:       miner.blockchain.Blocks[len(miner.blockchain.Blocks)-1].Hash,
+		Origin:    miner.name,
+		Timestamp: time.Now(),
+	}
+	if !miner.blockchain.prepareBlock(newBlock) {
+		if Debug {
+			fmt.Println("[DEBUG] Not allowed to propose blocks")
+		}
+		return
+	}
+	transactions, valid := miner.blockchain.checkTransactions(miner.blockchain.mempool.Transactions(),
+		newBlock.Timestamp, true)
+	if Debug {
+		fmt.Println("[DEBUG] Transactions are valid?", valid)
 	}
-	transactions, valid := miner.checkTransactionsCreate(miner.blockchain.unconfirmedTransactions)
-	fmt.Println("Transactions are valid?", valid)
 	newBlock.Transactions = transactions
+	limitSize(newBlock)
+	newBlock.MerkleRoot = newBlock.Transactions.MerkleRoot()
 	// Start mining until block found, or received from other peer
-	newBlock = miner.mine(newBlock)
-	if newBlock == nil {
-		fmt.Println("Stopped mining, other person found block")
+	if !miner.blockchain.consensus.Seal(ctx, newBlock, miner.key(), miner.workers) {
+		if Debug {
+			fmt.Println("[DEBUG] Stopped mining, other person found block")
+		}
 		return
 	}
 	miner.blocksOut <- &AddrGossipPacket{
@@ -162,266 +136,96 @@ func (miner Miner) generateBlock() {
 	}
 }
 
-// Checks if the transactions are valid.
-// If all are valid, return same Transactions and True
-// Remove invalid Transactions and return False otherwise
-func (miner Miner) checkTransactions(transactions Transactions) (Transactions, bool) {
-	valid := true
-	i := 0
-	id := miner.blockchain.nextPollId
-	for _, pollTx := range transactions.Polls {
-		if !miner.blockchain.pollValid(pollTx, id) {
-			valid = false
-			fmt.Println("Poll invalid")
-		} else {
-			id++
-			transactions.Polls[i] = pollTx
-			i++
+// Leave transactions out of the block until it fits in a packet, they stay unconfirmed for a next block.
+// Delegations go first, and registrations last: later kinds of transactions can depend on earlier ones
+func limitSize(block *Block) {
+	for {
+		encoded, err := protobuf.Encode(block)
+		if err != nil || len(encoded) <= maxBlockSize {
+			return
+		}
+		tx := &block.Transactions
+		switch {
+		case len(tx.Delegations) > 0:
+			tx.Delegations = tx.Delegations[:len(tx.Delegations)-1]
+		case len(tx.Revotes) > 0:
+			tx.Revotes = tx.Revotes[:len(tx.Revotes)-1]
+		case len(tx.Votes) > 0:
+			tx.Votes = tx.Votes[:len(tx.Votes)-1]
+		case len(tx.Results) > 0:
+			tx.Results = tx.Results[:len(tx.Results)-1]
+		case len(tx.Polls) > 0:
+			tx.Polls = tx.Polls[:len(tx.Polls)-1]
+		case len(tx.Registers) > 0:
+			tx.Registers = tx.Registers[:len(tx.Registers)-1]
+		default:
+			return
 		}
 	}
-	transactions.Polls = transactions.Polls[:i]
-
-	i = 0
-	for _, voteTx := range transactions.Votes {
-		if !miner.blockchain.voteValid(voteTx) {
-			fmt.Println("Invalid vote")
-			valid = false
-		} else {
-			transactions.Votes[i] = voteTx
-			i++
-		}
-	}
-	transactions.Votes = transactions.Votes[:i]
-
-	i = 0
-	for _, registerTx := range transactions.Registers {
-		if !miner.blockchain.registerValid(registerTx) {
-			fmt.Println("Invalid register")
-			valid = false
-		} else {
-			transactions.Registers[i] = registerTx
-			i++
-		}
-	}
-	transactions.Registers = transactions.Registers[:i]
-
-	return transactions, valid
-}
-
-func (miner Miner) checkTransactionsCreate(transactions Transactions) (Transactions, bool) {
-	valid := true
-	i := 0
-	nextPollId := miner.blockchain.nextPollId
-	for _, pollTx := range transactions.Polls {
-		if !miner.blockchain.pollValid(pollTx, 0) {
-			valid = false
-			fmt.Println("Poll invalid")
-		} else {
-			pollTx.ID = nextPollId
-			nextPollId++
-			transactions.Polls[i] = pollTx
-			i++
-		}
-	}
-	transactions.Polls = transactions.Polls[:i]
-
-	i = 0
-	for _, voteTx := range transactions.Votes {
-		if !miner.blockchain.voteValid(voteTx) {
-			fmt.Println("Invalid vote")
-			valid = false
-		} else {
-			transactions.Votes[i] = voteTx
-			i++
-		}
-	}
-	transactions.Votes = transactions.Votes[:i]
-
-	i = 0
-	for _, registerTx := range transactions.Registers {
-		if !miner.blockchain.registerValid(registerTx) {
-			fmt.Println("Invalid register")
-			valid = false
-		} else {
-			transactions.Registers[i] = registerTx
-			i++
-		}
-	}
-	transactions.Registers = transactions.Registers[:i]
-
-	return transactions, valid
-}
-
-func (miner Miner) mine(newBlock *Block) *Block {
-	for i := 0; ; i++ {
-		for len(miner.stopMining) > 0 {
-			if <-miner.stopMining >= newBlock.ID {
-				miner.mining = false
-				fmt.Println("Setting mining to false")
-				return nil
-			}
-		}
-		hex := fmt.Sprintf("%x", i)
-		newBlock.Nonce = hex
-		if !hashValid(calculateHash(newBlock), newBlock.Difficulty) {
-			fmt.Println(calculateHash(newBlock), " do more work!")
-			//time.Sleep(time.Second / 10)
-		} else {
-			fmt.Println(calculateHash(newBlock), " work done!")
-			newBlock.Hash = calculateHash(newBlock)
-			newBlock.Timestamp = time.Now()
-			miner.mining = false
-			fmt.Println("Setting mining to false")
-			break
-		}
-	}
-	return newBlock
 }
 
-/*
-func (m *Miner) verifyPollTransaction(tx *PollTx) bool {
-	// Verify the signature
-	pubKey := m.blockchain.GetPublicKey(tx.Poll.Origin)
-	if pubKey == nil {
-		fmt.Printf("INVALIDE POLLTX: cannot find origin\n")
-		return false
-	}
-
-	pollBytes, _ := protobuf.Encode(tx.Poll)
-	hash := sha256.Sum256(pollBytes)
-	err := rsa.VerifyPSS(pubKey, crypto.SHA256, hash[:], tx.Signature, nil)
-	if err != nil {
-		fmt.Printf("INVALID POLLTX: invalid signature\n")
-		return false
-	}
-
-	for _, poll :=  range m.blockchain.Polls {
-		if poll.ID == tx.ID {
-			fmt.Printf("INVALID POLLTX: id already exists\n") // TODO +1 check?
-			return false
-		}
-	}
-	return true
-}
-
-
-func (m *Miner) verifyVoteTransaction(tx *VoteTx) bool {
-	pubKey := m.blockchain.GetPublicKey(tx.Vote.Origin)
-	if pubKey == nil {
-		fmt.Printf("INVALIDE VOTETX: cannot find origin\n")
-		return false
-	}
-
-	pollBytes, _ := protobuf.Encode(tx.Vote)
-	hash := sha256.Sum256(pollBytes)
-	err := rsa.VerifyPSS(pubKey, crypto.SHA256, hash[:], tx.Signature, nil)
+// Check that a block with a single ballot of the given number of entries and one-hot groups fits in a
+// packet. limitSize would leave such a ballot out of every block, so it could never be confirmed. The ballot
+// is the largest a voter can send: a revote with proofs for every entry and group, every number as large as
+// the group allows, and signatures of keys of rsaKeyBits
+func checkBallotSize(group *elgamal.Group, entries int, oneHotGroups int, rsaKeyBits uint32) error {
+	element := make([]byte, group.ElementSize())
+	elements := func(n int) [][]byte {
+		res := make([][]byte, n)
+		for i := range res {
+			res[i] = element
+		}
+		return res
+	}
+	proof := func(allowed int) *BallotProof {
+		return &BallotProof{
+			Commitments: elements(2 * allowed),
+			Challenges:  elements(allowed),
+			Responses:   elements(allowed),
+		}
+	}
+
+	vote := make([][]byte, entries)
+	proofs := make([]*BallotProof, entries)
+	for i := range vote {
+		vote[i] = make([]byte, 2*group.ElementSize())
+		proofs[i] = proof(2)
+	}
+	sumProofs := make([]*BallotProof, oneHotGroups)
+	for i := range sumProofs {
+		sumProofs[i] = proof(1)
+	}
+	name := string(make([]byte, ballotNameSize))
+	signature := make([]byte, (rsaKeyBits+7)/8)
+	block := &Block{
+		ID:        ^uint32(0),
+		Timestamp: time.Now(),
+		Transactions: Transactions{Revotes: []*RevoteTx{{
+			ID: ^uint32(0),
+			Revote: &Revote{
+				Vote:       &EncryptedVote{Origin: name, PollID: ^uint32(0), Vote: vote},
+				Supersedes: make([]byte, 32),
+			},
+			Signature: signature,
+			Proofs:    proofs,
+			SumProofs: sumProofs,
+		}}},
+		Difficulty: maxDifficulty,
+		Origin:     name,
+		Nonce:      string(make([]byte, 16)),
+		PrevHash:   string(make([]byte, 64)),
+		MerkleRoot: make([]byte, 32),
+		Hash:       string(make([]byte, 64)),
+		Signature:  signature,
+	}
+
+	encoded, err := protobuf.Encode(block)
 	if err != nil {
-		fmt.Printf("INVALID VOTETX: invalid signature\n")
-		return false
-	}
-
-	for _, votes :=  range m.blockchain.Votes {
-		for _, vote := range votes {
-			if vote.ID == tx.ID {
-				fmt.Printf("INVALID VOTETX: id already exists\n") // TODO +1 check?
-				return false
-			}
-		}
-	}
-
-	var poll *PollTx
-	for _, p := range m.blockchain.Polls {
-		if p.ID == tx.Vote.PollID {
-			poll = p
-			break
-		}
-	}
-	if poll == nil {
-		fmt.Printf("INVALID VOTETX: poll does not exist\n") // TODO necessary?
-		return false
-	}
-
-	allowed := false
-	for _, voter := range poll.Poll.Voters {
-		if voter == m.name {
-			allowed = true
-			break
-		}
-	}
-	if !allowed {
-		fmt.Printf("INVALID VOTETX: you are not allowed to vote\n")
-		return false
-	}
-
-	return true
-}
-
-func (m *Miner) verifyRegistration(reg *RegisterTx) bool {
-	exists := false
-	for _, r := range m.blockchain.Registry {
-		if r.ID == reg.ID {
-			exists = true
-			break
-		}
-	}
-	if exists {
-		fmt.Printf("INVALIDE REGISTERTX: id already exists\n")
-		return false
-	}
-
-	originExists := false
-	for _, r := range m.blockchain.Registry {
-		if r.Registry.Origin == reg.Registry.Origin {
-			originExists = true
-			break
-		}
+		return err
 	}
-	if originExists {
-		fmt.Printf("INVALID REGISTERTX: origin already exists\n")
-		return false
+	if len(encoded) > maxBlockSize {
+		return fmt.Errorf("a ballot with %v entries takes %v bytes with %v bit keys, more than the %v bytes of a block",
+			entries, len(encoded), group.P.BitLen(), maxBlockSize)
 	}
-
-	return true
+	return nil
 }
-
-func (m *Miner) verifyResults(res *ResultTx) bool {
-	exists := false
-	for _, r := range m.blockchain.Results {
-		if r.ID == res.ID {
-			exists = true
-			break
-		}
-	}
-	if exists {
-		fmt.Printf("INVALID RESULT: id already exists\n")
-		return false
-	}
-
-	poll := m.blockchain.GetPoll(res.Result.PollId)
-	if poll == nil {
-		fmt.Printf("INVALID RESULT: poll does not exist\n")
-		return false
-	}
-
-	votes := m.blockchain.GetVotes(res.Result.PollId)
-	ourCount := &big.Int{}
-	for _, vote := range votes {
-		ourCount = big.Int{}.Add(ourCount, big.Int{}.SetBytes(vote.Vote.Vote))
-	}
-
-	// TODO: this verification always returns false, skip it...
-	return true
-
-	encrCount, err := poll.Poll.PublicKey.ToPaillier().Encrypt(big.NewInt(res.Result.Count), rand.Reader)
-	if err != nil {
-		fmt.Printf("INVALID RESULT: could not encrypt votes\n")
-		return false
-	}
-	if ourCount.Cmp(encrCount.C) != 0 {
-		fmt.Printf("INVALID RESULT: count is incorrect")
-		return false
-	}
-
-	return true
-
-}*/
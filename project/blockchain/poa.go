@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+	"time"
+)
+
+// Minimum time between two blocks with proof-of-authority
+const blockPeriod = 5 * time.Second
+
+// When the signer whose turn it is doesn't sign a block, the other signers may sign it after this delay
+const outOfTurnDelay = 30 * time.Second
+
+// Proof-of-authority: the signers take turns signing blocks with the key they registered. The signer of
+// block i is Signers[i % len(Signers)], if it is offline another signer may sign instead after a delay.
+// The keys of the signers are registered in the genesis block, no one can register a signer later
+type ProofOfAuthorityEngine struct {
+	signers []string
+}
+
+func NewProofOfAuthorityEngine(signers []string) *ProofOfAuthorityEngine {
+	return &ProofOfAuthorityEngine{signers: signers}
+}
+
+func (poa *ProofOfAuthorityEngine) isSigner(name string) bool {
+	for _, signer := range poa.signers {
+		if signer == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (poa *ProofOfAuthorityEngine) inTurn(block *Block) bool {
+	return poa.signers[int(block.ID)%len(poa.signers)] == block.Origin
+}
+
+// Earliest timestamp of block on top of parent
+func (poa *ProofOfAuthorityEngine) earliest(block *Block, parent *Block) time.Time {
+	if parent.ID == 0 {
+		// The genesis block has a fixed timestamp in the past
+		return parent.Timestamp
+	}
+	if poa.inTurn(block) {
+		return parent.Timestamp.Add(blockPeriod)
+	}
+	return parent.Timestamp.Add(blockPeriod + outOfTurnDelay)
+}
+
+func (poa *ProofOfAuthorityEngine) Prepare(block *Block, parent *blockNode) bool {
+	if !poa.isSigner(block.Origin) {
+		return false
+	}
+	block.Difficulty = 0
+	if earliest := poa.earliest(block, parent.block); block.Timestamp.Before(earliest) {
+		block.Timestamp = earliest
+	}
+	return true
+}
+
+// Wait until the timestamp of the block, then sign it
+func (poa *ProofOfAuthorityEngine) Seal(ctx context.Context, block *Block, key *rsa.PrivateKey, workers int) bool {
+	if key == nil {
+		fmt.Println("ERROR: no private key to sign blocks with")
+		return false
+	}
+	if wait := time.Until(block.Timestamp); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	block.Nonce = ""
+	block.Hash = calculateHash(block)
+	hash, _ := hex.DecodeString(block.Hash)
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, hash, nil)
+	if err != nil {
+		fmt.Printf("ERROR: could not sign block: %v\n", err)
+		return false
+	}
+	block.Signature = signature
+	fmt.Printf("SIGNED block %v\n", block.ID)
+	return true
+}
+
+func (poa *ProofOfAuthorityEngine) VerifyHeader(block *Block) error {
+	if block.Difficulty != 0 || block.Nonce != "" {
+		return fmt.Errorf("not a proof-of-authority block")
+	}
+	if !poa.isSigner(block.Origin) {
+		return fmt.Errorf("%v is not a signer", block.Origin)
+	}
+	if len(block.Signature) == 0 {
+		return fmt.Errorf("block is not signed")
+	}
+	return nil
+}
+
+func (poa *ProofOfAuthorityEngine) VerifySeal(b *Blockchain, block *Block, parent *blockNode) error {
+	if block.Timestamp.Before(poa.earliest(block, parent.block)) {
+		return fmt.Errorf("block signed too early")
+	}
+
+	pubKey := b.GetPublicKey(block.Origin)
+	if pubKey == nil {
+		return fmt.Errorf("signer %v is not registered", block.Origin)
+	}
+	hash, _ := hex.DecodeString(block.Hash)
+	if rsa.VerifyPSS(pubKey, crypto.SHA256, hash, block.Signature, nil) != nil {
+		return fmt.Errorf("invalid signature of %v", block.Origin)
+	}
+	return nil
+}
+
+// Blocks signed in turn weigh more, so the branch of the signers that are online wins
+func (poa *ProofOfAuthorityEngine) Weight(block *Block) *big.Int {
+	if block.ID == 0 || poa.inTurn(block) {
+		return big.NewInt(2)
+	}
+	return big.NewInt(1)
+}
@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The difficulty is retargeted every retargetInterval blocks, so that blocks are found every
+// targetBlockTime. Every level of difficulty makes finding a block 16 times harder, so the difficulty
+// only changes when blocks are found more than retargetMargin times too fast or too slow
+const retargetInterval = 10
+const targetBlockTime = 10 * time.Second
+const retargetMargin = 4
+const initialDifficulty = 3 // Unless the genesis file sets another one
+const minDifficulty = 1
+const maxDifficulty = 64
+
+// Workers check whether mining was cancelled every nonceBatch nonces
+const nonceBatch = 1024
+
+// Proof-of-work: the hash of a block has to start with Difficulty zeros
+type ProofOfWorkEngine struct {
+	initialDifficulty int
+	hashRate          float64 // Hashes per second while mining the last block we mined or stopped mining
+	mutex             *sync.Mutex
+}
+
+func NewProofOfWorkEngine(initialDifficulty int) *ProofOfWorkEngine {
+	return &ProofOfWorkEngine{initialDifficulty: initialDifficulty, mutex: &sync.Mutex{}}
+}
+
+func (pow *ProofOfWorkEngine) Prepare(block *Block, parent *blockNode) bool {
+	block.Difficulty = pow.difficultyAfter(parent)
+	return true
+}
+
+// Try nonces until the hash of the block starts with enough zeros. Worker i of the workers tries
+// the nonces i, i+workers, i+2*workers, ...
+func (pow *ProofOfWorkEngine) Seal(ctx context.Context, block *Block, key *rsa.PrivateKey, workers int) bool {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	found := make(chan *Block, workers)
+	var hashes uint64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			attempt := *block
+			tried := uint64(0)
+			defer func() { atomic.AddUint64(&hashes, tried) }()
+			for nonce := first; ; nonce += uint64(workers) {
+				if tried%nonceBatch == 0 && ctx.Err() != nil {
+					return
+				}
+				attempt.Nonce = strconv.FormatUint(nonce, 16)
+				hash := attempt.CalculateHash()
+				tried++
+				if hashValid(hash, attempt.Difficulty) {
+					attempt.Hash = hash
+					found <- &attempt
+					cancel()
+					return
+				}
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	rate := float64(hashes) / elapsed.Seconds()
+	pow.mutex.Lock()
+	pow.hashRate = rate
+	pow.mutex.Unlock()
+
+	select {
+	case sealed := <-found:
+		block.Nonce = sealed.Nonce
+		block.Hash = sealed.Hash
+		fmt.Printf("MINED block %v after %v hashes in %v (%.0f hashes/s)\n", block.ID, hashes, elapsed, rate)
+		return true
+	default:
+		if Debug {
+			fmt.Printf("[DEBUG] Stopped mining block %v after %v hashes (%.0f hashes/s)\n", block.ID, hashes, rate)
+		}
+		return false
+	}
+}
+
+// Hashes per second while mining the last block
+func (pow *ProofOfWorkEngine) HashRate() float64 {
+	pow.mutex.Lock()
+	defer pow.mutex.Unlock()
+
+	return pow.hashRate
+}
+
+func (pow *ProofOfWorkEngine) VerifyHeader(block *Block) error {
+	if block.Difficulty < minDifficulty || !hashValid(block.Hash, block.Difficulty) {
+		return fmt.Errorf("not enough work")
+	}
+	return nil
+}
+
+func (pow *ProofOfWorkEngine) VerifySeal(b *Blockchain, block *Block, parent *blockNode) error {
+	if expected := pow.difficultyAfter(parent); block.Difficulty != expected {
+		return fmt.Errorf("expected difficulty %v, got %v", expected, block.Difficulty)
+	}
+	return nil
+}
+
+// Expected amount of hashes needed to find the block: every level of difficulty is an extra leading hex zero
+func (pow *ProofOfWorkEngine) Weight(block *Block) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(4*block.Difficulty))
+}
+
+// Hash starts with necessary amount of 0's
+func hashValid(hash string, difficulty int) bool {
+	prefix := strings.Repeat("0", difficulty)
+	return strings.HasPrefix(hash, prefix)
+}
+
+// Difficulty the block following parent must have. It only depends on the timestamps of the blocks
+// before it, so every node expects the same difficulty
+func (pow *ProofOfWorkEngine) difficultyAfter(parent *blockNode) int {
+	id := parent.block.ID + 1
+	if parent.block.ID == 0 {
+		return pow.initialDifficulty
+	}
+	// The first window would contain the genesis block, of which the timestamp is fixed
+	if id%retargetInterval != 0 || id <= retargetInterval {
+		return parent.block.Difficulty
+	}
+
+	first := parent
+	for i := 1; i < retargetInterval; i++ {
+		first = first.parent
+	}
+	elapsed := parent.block.Timestamp.Sub(first.block.Timestamp)
+	expected := (retargetInterval - 1) * targetBlockTime
+
+	difficulty := parent.block.Difficulty
+	if elapsed < expected/retargetMargin && difficulty < maxDifficulty {
+		difficulty++
+	} else if elapsed > expected*retargetMargin && difficulty > minDifficulty {
+		difficulty--
+	}
+	return difficulty
+}
@@ -0,0 +1,85 @@
+package blockchain
+
+import (
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"testing"
+	"time"
+)
+
+// Branch of blocks after a genesis block, the blocks are interval apart
+func timedBranch(length int, difficulty int, interval time.Duration) *blockNode {
+	start := time.Now().Add(-time.Hour)
+	node := &blockNode{block: &Block{ID: 0, Difficulty: 1, Timestamp: start}}
+	for i := 1; i < length; i++ {
+		block := &Block{ID: uint32(i), Difficulty: difficulty, Timestamp: start.Add(time.Duration(i) * interval)}
+		node = &blockNode{block: block, parent: node}
+	}
+	return node
+}
+
+func TestDifficultyAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		length     int // Blocks of the branch, including genesis
+		difficulty int // Of the blocks after genesis
+		interval   time.Duration
+		expected   int
+	}{
+		{"first block", 1, 5, time.Second, initialDifficulty},
+		{"no retarget", 15, 5, time.Second, 5},
+		{"first window is not retargeted", retargetInterval, 5, time.Second, 5},
+		{"on target", 2 * retargetInterval, 5, targetBlockTime, 5},
+		{"somewhat fast", 2 * retargetInterval, 5, targetBlockTime / retargetMargin, 5},
+		{"too fast", 2 * retargetInterval, 5, targetBlockTime/retargetMargin - time.Second, 6},
+		{"somewhat slow", 2 * retargetInterval, 5, targetBlockTime * retargetMargin, 5},
+		{"too slow", 2 * retargetInterval, 5, targetBlockTime*retargetMargin + time.Second, 4},
+		{"too fast at the maximum", 2 * retargetInterval, maxDifficulty, time.Second, maxDifficulty},
+		{"too slow at the minimum", 2 * retargetInterval, minDifficulty, time.Hour, minDifficulty},
+		{"after a retarget", 2*retargetInterval + 1, 5, time.Second, 5},
+	}
+	pow := NewProofOfWorkEngine(initialDifficulty)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent := timedBranch(test.length, test.difficulty, test.interval)
+			if difficulty := pow.difficultyAfter(parent); difficulty != test.expected {
+				t.Errorf("difficulty %v, expected %v", difficulty, test.expected)
+			}
+		})
+	}
+}
+
+// Blocks have to have the retargeted difficulty
+func TestRetargetedBlock(t *testing.T) {
+	b := testChain(t)
+	// Blocks a second apart, the block after the second window has to be harder
+	timestamp := time.Now().Add(-time.Minute)
+	for i := 1; i < 2*retargetInterval; i++ {
+		block := mineBlock(b.lastBlock(), "miner", Transactions{})
+		block.Timestamp = timestamp.Add(time.Duration(i) * time.Second)
+		sealTestBlock(block)
+		if !b.AddBlock(block) {
+			t.Fatalf("block %v not added", i)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		difficulty int
+		added      bool
+	}{
+		{"old difficulty", testDifficulty, false},
+		{"too hard", testDifficulty + 2, false},
+		{"retargeted", testDifficulty + 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := mineBlock(b.lastBlock(), "miner", Transactions{})
+			block.Timestamp = b.lastBlock().Timestamp.Add(time.Second)
+			block.Difficulty = test.difficulty
+			sealTestBlock(block)
+			if b.AddBlock(block) != test.added {
+				t.Errorf("added = %v, expected %v", !test.added, test.added)
+			}
+		})
+	}
+}
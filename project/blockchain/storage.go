@@ -0,0 +1,203 @@
+package blockchain
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const blockLogFile = "blocks.log"
+const finalityFile = "finality.json"
+
+// On-disk storage for the blockchain
+// Blocks are kept in an append-only log (one JSON encoded block per line), the offset of every block
+// in the log is kept in memory and rebuilt when the log is loaded. The offsets are not written to disk:
+// every block is read and re-validated on startup anyway, so a stored index would save nothing and could
+// only disagree with the log after a crash
+type Storage struct {
+	dir     string
+	log     *os.File
+	offsets []int64 // Offset in the log by block ID
+	mutex   *sync.Mutex
+}
+
+// Open (or create) the storage in dir
+func NewStorage(dir string) (*Storage, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, blockLogFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{
+		dir:     dir,
+		log:     log,
+		offsets: make([]int64, 0),
+		mutex:   &sync.Mutex{},
+	}, nil
+}
+
+// Read all blocks from the log, the offsets are rebuilt while reading
+// A trailing block that could not be decoded (e.g. because the node crashed while writing it)
+// is cut off the log
+func (s *Storage) Load() ([]*Block, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	s.offsets = make([]int64, 0)
+	blocks := make([]*Block, 0)
+	reader := bufio.NewReader(s.log)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Printf("STORAGE dropping incomplete block at offset %v\n", offset)
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		block := &Block{}
+		if err := json.Unmarshal(line, block); err != nil {
+			fmt.Printf("STORAGE dropping undecodable block at offset %v: %v\n", offset, err)
+			break
+		}
+		blocks = append(blocks, block)
+		s.offsets = append(s.offsets, offset)
+		offset += int64(len(line))
+	}
+
+	// Cut off whatever could not be read, so new blocks are appended after the last valid one
+	if err := s.truncate(offset); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// Append block to the log
+func (s *Storage) Append(block *Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if int(block.ID) != len(s.offsets) {
+		return fmt.Errorf("block %v does not follow stored block %v", block.ID, len(s.offsets)-1)
+	}
+
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	offset, err := s.log.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	s.offsets = append(s.offsets, offset)
+	return nil
+}
+
+// Remove block id and all blocks after it from the storage
+func (s *Storage) Truncate(id uint32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if int(id) >= len(s.offsets) {
+		return nil
+	}
+	offset := s.offsets[id]
+	s.offsets = s.offsets[:id]
+	return s.truncate(offset)
+}
+
+// What the finalizer has to remember across restarts: the last finalized block with the precommits that
+// finalized it, and our own votes and lock, so we never vote twice at the same height
+type FinalityState struct {
+	Finalized    string          `json:"finalized"`  // Hash of the last finalized block
+	Precommits   []*FinalityVote `json:"precommits"` // Of more than 2/3 of the validators for the finalized block
+	Prevoted     uint32          `json:"prevoted"`
+	Precommitted uint32          `json:"precommitted"`
+	Lock         *Block          `json:"lock"`  // Header of the block we are locked on, nil if unlocked
+	Votes        []*FinalityVote `json:"votes"` // Our votes after the finalized block
+}
+
+// Replace the stored finality state. It is written to a temporary file first, so a crash leaves
+// either the old or the new state
+func (s *Storage) SaveFinality(state *FinalityState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := filepath.Join(s.dir, finalityFile)
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// The stored finality state, nil if none was stored
+func (s *Storage) LoadFinality() (*FinalityState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, finalityFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &FinalityState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid finality state: %v", err)
+	}
+	return state, nil
+}
+
+func (s *Storage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.log.Close()
+}
+
+func (s *Storage) truncate(offset int64) error {
+	if err := s.log.Truncate(offset); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
@@ -0,0 +1,129 @@
+package blockchain
+
+import (
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func storedBlocks(n int) []*Block {
+	blocks := make([]*Block, n)
+	for i := range blocks {
+		blocks[i] = &Block{ID: uint32(i), Origin: "alice", Nonce: "0"}
+		blocks[i].Hash = blocks[i].CalculateHash()
+	}
+	return blocks
+}
+
+func TestStorageLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		tail     string // Written after 3 complete blocks, as if the node crashed while writing
+		expected int    // Blocks loaded
+	}{
+		{"complete log", "", 3},
+		{"partial block", `{"ID":3,"Orig`, 3},
+		{"undecodable block", "garbage\n", 3},
+		{"block after an undecodable block", "garbage\n" + `{"ID":3}` + "\n", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage, err := NewStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, block := range storedBlocks(3) {
+				if err := storage.Append(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+			storage.Close()
+			log, err := os.OpenFile(filepath.Join(dir, blockLogFile), os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			log.WriteString(test.tail)
+			log.Close()
+
+			storage, err = NewStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+			blocks, err := storage.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != test.expected {
+				t.Fatalf("%v blocks loaded, expected %v", len(blocks), test.expected)
+			}
+			for i, block := range blocks {
+				if block.ID != uint32(i) || block.Hash != block.CalculateHash() {
+					t.Errorf("block %v loaded as block %v", i, block.ID)
+				}
+			}
+
+			// The next block is appended after the last complete one, and loaded again
+			next := storedBlocks(test.expected + 1)[test.expected]
+			if err := storage.Append(next); err != nil {
+				t.Fatal(err)
+			}
+			blocks, err = storage.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != test.expected+1 || blocks[test.expected].Hash != next.Hash {
+				t.Errorf("%v blocks loaded after appending block %v", len(blocks), next.ID)
+			}
+		})
+	}
+}
+
+func TestStorageTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       uint32 // First block removed
+		expected int    // Blocks left
+	}{
+		{"last block", 4, 4},
+		{"all but genesis", 1, 1},
+		{"after the last block", 5, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage, err := NewStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+			blocks := storedBlocks(5)
+			for _, block := range blocks {
+				if err := storage.Append(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := storage.Truncate(test.id); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := storage.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != test.expected {
+				t.Fatalf("%v blocks loaded, expected %v", len(loaded), test.expected)
+			}
+			if test.expected+1 < len(blocks) && storage.Append(blocks[test.expected+1]) == nil {
+				t.Errorf("block %v appended after %v blocks", test.expected+1, test.expected)
+			}
+			// The removed blocks can be appended again
+			for _, block := range blocks[test.expected:] {
+				if err := storage.Append(block); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
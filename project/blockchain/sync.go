@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"time"
+)
+
+// Blocks are up to 64 KB, sent as separate UDP datagrams without pacing: a request is answered with only a
+// few of them, the requester asks for the next ones when the last one arrived
+const maxBlocksPerResponse = 4
+const syncInterval = 10 * time.Second
+
+// Synchronises the blockchain with peers: nodes that fall behind (e.g. because they joined late)
+// request the blocks they miss, and answer the requests of other nodes
+type Syncer struct {
+	name       string
+	blockchain *Blockchain
+	peers      *Set
+
+	in       chan *AddrGossipPacket // BlockRequests and BlockResponses from peers
+	out      chan *AddrGossipPacket
+	blocksIn chan *Block // Received blocks are handed to the miner on this channel
+}
+
+func NewSyncer(name string, blockchain *Blockchain, peers *Set, in chan *AddrGossipPacket, out chan *AddrGossipPacket, blocksIn chan *Block) *Syncer {
+	return &Syncer{
+		name:       name,
+		blockchain: blockchain,
+		peers:      peers,
+		in:         in,
+		out:        out,
+		blocksIn:   blocksIn,
+	}
+}
+
+func (s *Syncer) Run() {
+	go s.listen()
+	go s.requestMissing()
+	go s.syncPeriodically()
+}
+
+func (s *Syncer) listen() {
+	for packet := range s.in {
+		if packet.Gossip.BlockRequest != nil {
+			s.handleRequest(packet.Gossip.BlockRequest, packet.Address)
+		} else if packet.Gossip.BlockResponse != nil {
+			s.handleResponse(packet.Gossip.BlockResponse, packet.Address)
+		}
+	}
+}
+
+// Ask a random peer for the blocks following our tip, every syncInterval (starting right away)
+func (s *Syncer) syncPeriodically() {
+	for {
+		if peer, ok := s.peers.Rand(); ok {
+			s.request(peer, nil)
+		}
+
+		timer := time.NewTimer(syncInterval)
+		<-timer.C
+	}
+}
+
+// When a block arrives of which we don't know the parent, we fell behind: catch up with a random peer
+func (s *Syncer) requestMissing() {
+	for hash := range s.blockchain.missingParents {
+		if Debug {
+			fmt.Printf("[DEBUG] Missing block %v, requesting blocks\n", hash)
+		}
+		if peer, ok := s.peers.Rand(); ok {
+			s.request(peer, nil)
+		}
+	}
+}
+
+// Send a BlockRequest to peer, the hashes in from are put in front of the locator of our main chain
+func (s *Syncer) request(peer UDPAddr, from []string) {
+	locator := append(from, s.blockchain.locator()...)
+	s.out <- &AddrGossipPacket{
+		Address: peer,
+		Gossip: &GossipPacket{BlockRequest: &BlockRequest{
+			Origin:  s.name,
+			Locator: locator,
+		}},
+	}
+}
+
+func (s *Syncer) handleRequest(req *BlockRequest, peer UDPAddr) {
+	blocks, height := s.blockchain.blocksAfter(req.Locator, maxBlocksPerResponse)
+	if len(blocks) > 0 {
+		fmt.Printf("SYNC sending blocks %v to %v to %v\n", blocks[0].ID, blocks[len(blocks)-1].ID, req.Origin)
+	}
+	for i, block := range blocks {
+		s.out <- &AddrGossipPacket{
+			Address: peer,
+			Gossip: &GossipPacket{BlockResponse: &BlockResponse{
+				Origin: s.name,
+				Block:  block,
+				Height: height,
+				Last:   i == len(blocks)-1,
+			}},
+		}
+	}
+}
+
+func (s *Syncer) handleResponse(resp *BlockResponse, peer UDPAddr) {
+	if resp.Block == nil {
+		return
+	}
+	if Debug {
+		fmt.Printf("[DEBUG] SYNC received block %v from %v\n", resp.Block.ID, resp.Origin)
+	}
+	s.blocksIn <- resp.Block
+
+	// The peer has more blocks: continue after the last one it sent
+	// The miner might not have added the received blocks yet, so put it in front of the locator ourselves
+	if resp.Last && resp.Block.ID+1 < resp.Height {
+		s.request(peer, []string{resp.Block.Hash})
+	}
+}
+
+// Hashes of blocks on the main chain, from the tip back to genesis: the 10 most recent blocks,
+// and then exponentially further apart
+func (b *Blockchain) locator() []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	locator := make([]string, 0)
+	step := 1
+	for i := len(b.Blocks) - 1; i > 0; i -= step {
+		locator = append(locator, b.Blocks[i].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, b.Blocks[0].Hash)
+}
+
+// At most max blocks of the main chain following the first block of locator that is on the main
+// chain, together with the length of the main chain
+func (b *Blockchain) blocksAfter(locator []string, max int) ([]*Block, uint32) {
+	b.chainMutex.Lock()
+	defer b.chainMutex.Unlock()
+
+	height := uint32(len(b.Blocks))
+	for _, hash := range locator {
+		node, exists := b.tree[hash]
+		if !exists || int(node.block.ID) >= len(b.Blocks) || b.Blocks[node.block.ID].Hash != hash {
+			continue
+		}
+		start := int(node.block.ID) + 1
+		end := start + max
+		if end > len(b.Blocks) {
+			end = len(b.Blocks)
+		}
+		return append([]*Block{}, b.Blocks[start:end]...), height
+	}
+
+	// No common block: the peer is on another network
+	return nil, height
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Tool to archive the blockchain of a node and verify an archived chain offline:
+//
+//	chaintool export -UIPort 8080 -out chain.json
+//	chaintool verify -in chain.json [-genesis genesis.json]
+//	chaintool import -in chain.json -dataDir dir [-genesis genesis.json]
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	uiPort := flags.String("UIPort", "8080", "port for the UI of the node to export from")
+	out := flags.String("out", "chain.json", "file to export the chain to")
+	in := flags.String("in", "chain.json", "exported chain to verify or import")
+	genesisPath := flags.String("genesis", "", "genesis file of the network the chain has to be of, any network if empty")
+	dataDir := flags.String("dataDir", "", "empty data directory of a node to import the chain into")
+	flags.Parse(os.Args[2:])
+
+	switch os.Args[1] {
+	case "export":
+		export(*uiPort, *out)
+	case "verify":
+		verify(*in, loadGenesis(*genesisPath))
+	case "import":
+		if *dataDir == "" {
+			log.Fatal("Please provide the data directory with the '-dataDir' flag")
+		}
+		importChain(*in, loadGenesis(*genesisPath), *dataDir)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Println("Usage: chaintool export|verify|import [flags], see chaintool <command> -h")
+	os.Exit(2)
+}
+
+func loadGenesis(path string) *Genesis {
+	if path == "" {
+		return nil
+	}
+	genesis, err := LoadGenesis(path)
+	if err != nil {
+		log.Fatalf("Could not load the genesis file %v: %v", path, err)
+	}
+	return genesis
+}
+
+func readExport(path string) *ChainExport {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Could not open %v: %v", path, err)
+	}
+	defer file.Close()
+	export, err := ReadExport(file)
+	if err != nil {
+		log.Fatalf("Could not read %v: %v", path, err)
+	}
+	return export
+}
+
+// Fetch the main chain from the node, and write it to path
+func export(uiPort string, path string) {
+	resp, err := http.Get("http://127.0.0.1:" + uiPort + "/voting/export")
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer resp.Body.Close()
+	export, err := ReadExport(resp.Body)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Could not create %v: %v", path, err)
+	}
+	if err := WriteExport(file, export); err != nil {
+		log.Fatalf("Could not write %v: %v", path, err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("Could not write %v: %v", path, err)
+	}
+	fmt.Printf("EXPORTED %v blocks of network %v to %v\n", len(export.Blocks), export.NetworkID, path)
+}
+
+// Verify the exported chain, and print the polls with their votes and results
+func verify(path string, genesis *Genesis) {
+	export := readExport(path)
+	b, err := VerifyChain(export, genesis)
+	if err != nil {
+		fmt.Printf("INVALID chain: %v\n", err)
+		os.Exit(1)
+	}
+
+	tip := b.Blocks[len(b.Blocks)-1]
+	fmt.Printf("VALID chain of network %v: %v blocks, genesis %v, tip %v\n", export.NetworkID, len(b.Blocks),
+		export.GenesisHash, tip.Hash)
+	if finalized, precommits := b.Finality(); len(precommits) > 0 {
+		fmt.Printf("FINAL up to block %v %v, precommitted by %v of the %v validators\n", finalized.ID,
+			finalized.Hash, len(precommits), len(b.Config().Validators))
+	} else if b.HasFinality() {
+		fmt.Printf("NOT FINAL: no precommits of the validators in the export\n")
+	}
+	fmt.Printf("REGISTERED %v users\n", len(b.Registry))
+	for _, poll := range b.GetPolls() {
+		fmt.Printf("POLL %v QUESTION %v FROM %v: %v votes\n", poll.ID, poll.Poll.Question, poll.Poll.Origin,
+			len(b.RetrieveVotes(poll.ID)))
+		if result := b.GetResult(poll.ID); result != nil {
+			fmt.Printf("  RESULT %v, decryption of every count verified\n", result.Result.Counts)
+		}
+	}
+}
+
+// Verify the exported chain and store it in the data directory of a fresh node
+func importChain(path string, genesis *Genesis, dataDir string) {
+	export := readExport(path)
+	storage, err := NewStorage(dataDir)
+	if err != nil {
+		log.Fatalf("Could not open storage in %v: %v", dataDir, err)
+	}
+	defer storage.Close()
+	if err := ImportChain(export, genesis, storage); err != nil {
+		log.Fatalf("Could not import %v: %v", path, err)
+	}
+	fmt.Printf("IMPORTED %v blocks of network %v into %v\n", len(export.Blocks), export.NetworkID, dataDir)
+}
@@ -1,24 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/dedis/protobuf"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
+	"github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	UIPort  string
-	msg     string
-	dest    string
-	vote    bool
-	pollid  int
-	question string
-	voters string
-	count bool
+	UIPort     string
+	msg        string
+	dest       string
+	vote       bool
+	pollid     int
+	question   string
+	voters     string
+	count      bool
+	trustees   string
+	threshold  int
+	options    string
+	ballotType string
+	choices    string
+	opening    string
+	deadline   string
+	receipt    string
+	headers    string
+	delegate   string
+	creator    string
+	revoke     bool
 )
 
 func main() {
@@ -27,21 +48,165 @@ func main() {
 	flag.StringVar(&msg, "msg", "", "message to be sent; if the -dest flag is present, "+
 		"this is a private message, otherwise it’s a rumor message")
 	flag.StringVar(&dest, "dest", "", "destination for the private message; can be omitted")
-	flag.BoolVar(&vote, "vote", false, "Your vote for poll 'pollid'")
+	flag.BoolVar(&vote, "vote", false, "Your vote for poll 'pollid', voting again replaces your earlier vote")
 	flag.IntVar(&pollid, "pollid", -1, "The poll you want to vote for")
 	flag.StringVar(&question, "question", "", "The question you want to create a poll for")
-	flag.StringVar(&voters, "voters", "", "The people that are allowed to vote for your question, as a" +
-		"comma seperated list of ciphers")
+	flag.StringVar(&voters, "voters", "", "The people that are allowed to vote for your question, as a"+
+		"comma seperated list of ciphers. Weighted votes as cipher:weight")
 	flag.BoolVar(&count, "count", false, "Use this command to count the votes for pollid")
+	flag.StringVar(&trustees, "trustees", "", "The people that get a share of the key of your poll, as a "+
+		"comma seperated list. Only you if empty")
+	flag.IntVar(&threshold, "threshold", 1, "The number of trustees needed to count the votes of your poll")
+	flag.StringVar(&options, "options", "", "The options of your poll, as a comma seperated list. A yes/no "+
+		"question if empty")
+	flag.StringVar(&ballotType, "ballot", "", "The type of ballot of your poll: single, approval or ranked. "+
+		"Ranked ballots grow with the square of the number of options, counted with the Borda count")
+	flag.StringVar(&opening, "opening", "", "When your poll opens for votes, in RFC3339 format. Right away if empty")
+	flag.StringVar(&deadline, "deadline", "", "When your poll closes, in RFC3339 format. Never if empty")
+	flag.StringVar(&choices, "choices", "", "The indices of the options you vote for in poll 'pollid', as a "+
+		"comma seperated list. For ranked polls all options, from most to least preferred")
+	flag.StringVar(&delegate, "delegate", "", "The user you delegate your vote on poll 'pollid' to, or on all polls "+
+		"of 'creator'. Your own vote takes precedence")
+	flag.StringVar(&creator, "creator", "", "Delegate your vote on all polls of this creator instead of one poll")
+	flag.BoolVar(&revoke, "revoke", false, "Revoke your delegation on poll 'pollid', or on all polls of 'creator'")
+	flag.StringVar(&receipt, "receipt", "", "Hash of a vote transaction: shows whether it is in the blockchain, "+
+		"and checks the proof that it is")
+	flag.StringVar(&headers, "headers", "", "UI port of the node to check the chain of a receipt against. The "+
+		"node of 'UIPort' if empty")
 	flag.Parse()
 
 	// TODO Check if valid command
 
+	if receipt != "" {
+		if headers == "" {
+			headers = UIPort
+		}
+		CheckReceipt(receipt, "http://127.0.0.1:"+UIPort, "http://127.0.0.1:"+headers)
+		return
+	}
+
+	// Votes go through the web API, which answers with the hash of the vote transaction
+	if pollid >= 0 && delegate == "" && !revoke && !count {
+		PostVote(&NewVote{Pollid: uint32(pollid), Vote: vote, Choices: parseChoices()}, "http://127.0.0.1:"+UIPort)
+		return
+	}
+
 	// Send message to the Gossiper
 	addr := "127.0.0.1" + ":" + UIPort
 	SendMsg(msg, dest, addr)
 }
 
+// Cast a vote through the web API of the gossiper, and show the hash of the vote transaction for its receipt
+func PostVote(newVote *NewVote, url string) {
+	data := struct {
+		Vote    string   `json:"vote"`
+		Choices []uint32 `json:"choices"`
+	}{"0", newVote.Choices}
+	if newVote.Vote {
+		data.Vote = "1"
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	resp, err := http.Post(fmt.Sprintf("%v/voting/poll/%v/vote", url, newVote.Pollid), "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(resp.Body)
+		log.Fatalf("ERROR: %v", strings.TrimSpace(string(reason)))
+	}
+	var res struct {
+		TxHash string `json:"txHash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		log.Fatalf("ERROR: could not decode vote: %v", err)
+	}
+	fmt.Printf("VOTE TX %v\n", res.TxHash)
+	fmt.Printf("Check that it is in the blockchain with -receipt %v\n", res.TxHash)
+}
+
+// Ask the gossiper for the receipt of a transaction, and verify its proof of inclusion ourselves. The block
+// of the proof has to be on the main chain of the headers from headersURL, of which we verify the seals
+func CheckReceipt(txHash, url, headersURL string) {
+	resp, err := http.Get(url + "/voting/receipt/" + txHash)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var rec Receipt
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		log.Fatalf("ERROR: could not decode receipt: %v", err)
+	}
+
+	switch rec.Status {
+	case TxIncluded:
+		hashBytes, _ := hex.DecodeString(txHash)
+		if rec.Proof == nil || !bytes.Equal(rec.Proof.TxHash, hashBytes) || !rec.Proof.Verify() {
+			log.Fatalf("INVALID PROOF: transaction %v is not proven to be in block %v", txHash, rec.BlockID)
+		}
+		chain := FetchHeaders(headersURL)
+		id := rec.Proof.Header.ID
+		if int(id) >= len(chain) || chain[id].Hash != rec.Proof.Header.Hash {
+			log.Fatalf("INVALID PROOF: block %v (%v) is not on the main chain of %v", id, rec.Proof.Header.Hash,
+				headersURL)
+		}
+		fmt.Printf("INCLUDED in block %v (%v), %v confirmations\n", id, rec.Proof.Header.Hash, len(chain)-int(id))
+		if rec.Final {
+			fmt.Printf("FINAL: the block is finalized by the validators\n")
+		}
+		fmt.Printf("MERKLE ROOT %x\n", rec.Proof.Header.MerkleRoot)
+		fmt.Printf("PROOF leaf %v of %v\n", rec.Proof.Proof.Index, rec.Proof.Proof.NumLeaves)
+		for _, sibling := range rec.Proof.Proof.Siblings {
+			fmt.Printf("  %x\n", sibling)
+		}
+	case TxPending:
+		fmt.Printf("PENDING transaction %v is waiting to be mined\n", txHash)
+	default:
+		fmt.Printf("UNKNOWN transaction %v\n", txHash)
+	}
+}
+
+// The headers of the main chain of the gossiper at url, after verifying their hashes, links and seals
+func FetchHeaders(url string) []*Block {
+	resp, err := http.Get(url + "/voting/headers")
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer resp.Body.Close()
+
+	headers := make([]*Block, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&headers); err != nil {
+		log.Fatalf("ERROR: could not decode headers: %v", err)
+	}
+	if err := blockchain.VerifyHeaders(headers); err != nil {
+		log.Fatalf("INVALID HEADERS from %v: %v", url, err)
+	}
+	fmt.Printf("CHAIN of %v verified up to block %v (%v)\n", url, len(headers)-1, headers[len(headers)-1].Hash)
+	return headers
+}
+
+// The choices of a vote, from the choices flag
+func parseChoices() []uint32 {
+	choiceInts := make([]uint32, 0)
+	for _, choice := range strings.Split(choices, ",") {
+		if choice == "" {
+			continue
+		}
+		choiceInt, err := strconv.Atoi(choice)
+		if err != nil || choiceInt < 0 {
+			log.Fatalf("Invalid choice %v", choice)
+		}
+		choiceInts = append(choiceInts, uint32(choiceInt))
+	}
+	return choiceInts
+}
+
 func SendMsg(msg, dest, addr string) {
 	// Set up UDP socket
 	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
@@ -62,12 +227,25 @@ func SendMsg(msg, dest, addr string) {
 	if pollid >= 0 {
 		message.Voting = &VotingMessage{
 			NewVote: &NewVote{
-				Pollid: uint32(pollid),
-				Vote:   vote,
+				Pollid:  uint32(pollid),
+				Vote:    vote,
+				Choices: parseChoices(),
 			},
 		}
 	}
 
+	// Delegate instead of voting
+	if delegate != "" || revoke {
+		if pollid < 0 && creator == "" {
+			log.Fatalf("Please provide the poll or the creator of the polls you want to delegate your vote on")
+		}
+		newDelegation := &NewDelegation{Delegate: delegate, Creator: creator}
+		if pollid >= 0 {
+			newDelegation.Pollid = uint32(pollid)
+		}
+		message.Voting = &VotingMessage{NewDelegation: newDelegation}
+	}
+
 	if count {
 		if pollid > 0 {
 			message.Voting.CountRequest = &CountRequest{Pollid: uint32(pollid)}
@@ -82,12 +260,54 @@ func SendMsg(msg, dest, addr string) {
 			voterStrings = append(voterStrings, voter)
 		}
 	}
+	voterStrings, weights, err := ballot.ParseVoters(voterStrings)
+	if err != nil {
+		log.Fatalf("Invalid voters: %v", err)
+	}
+
+	trusteeStrings := make([]string, 0)
+	for _, trustee := range strings.Split(trustees, ",") {
+		if trustee != "" {
+			trusteeStrings = append(trusteeStrings, trustee)
+		}
+	}
+
+	optionStrings := make([]string, 0)
+	for _, option := range strings.Split(options, ",") {
+		if option != "" {
+			optionStrings = append(optionStrings, option)
+		}
+	}
+
+	var openingTime, deadlineTime time.Time
+	if opening != "" {
+		if openingTime, err = time.Parse(time.RFC3339, opening); err != nil {
+			log.Fatalf("Invalid opening %v", opening)
+		}
+	}
+	if deadline != "" {
+		if deadlineTime, err = time.Parse(time.RFC3339, deadline); err != nil {
+			log.Fatalf("Invalid deadline %v", deadline)
+		}
+	}
 
 	if question != "" {
+		err := ballot.CheckPoll(&Poll{Options: optionStrings, BallotType: ballotType, Voters: voterStrings,
+			Weights: weights})
+		if err != nil {
+			log.Fatalf("Invalid poll: %v", err)
+		}
 		message.Voting = &VotingMessage{
 			NewPoll: &NewPoll{
-				Question: question,
-				Voters:   voterStrings,
+				Question:   question,
+				Voters:     voterStrings,
+				Weights:    weights,
+				Trustees:   trusteeStrings,
+				Threshold:  uint32(threshold),
+				Options:    optionStrings,
+				BallotType: ballotType,
+				Opening:    openingTime,
+				Deadline:   deadlineTime,
 			},
 		}
 	}
@@ -0,0 +1,177 @@
+package elgamal
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ElGamal encryption in the exponent, in the subgroup of prime order q of the quadratic residues modulo a
+// safe prime p = 2q+1. A message m is encrypted with the public key h = g^x as (g^r, h^r * g^m), so
+// multiplying ciphertexts adds their messages. Decryption gives g^m, of which the discrete log can be
+// found when m is small, like a count of votes.
+//
+// In a group of prime order every element but 1 is a generator, and all exponents but 0 are invertible,
+// which the threshold decryption and the zero-knowledge proofs about ciphertexts rely on
+
+type Group struct {
+	P *big.Int // Safe prime
+	Q *big.Int // (P-1)/2, the order of the group
+	G *big.Int // Generator of the group
+}
+
+// Group of the quadratic residues modulo the safe prime p, generated by 4 (which is a square)
+func NewGroup(p *big.Int) *Group {
+	return &Group{
+		P: new(big.Int).Set(p),
+		Q: new(big.Int).Rsh(p, 1),
+		G: big.NewInt(4),
+	}
+}
+
+// The smallest group of RFC 3526 with a prime of at least bits bits
+func StandardGroup(bits int) (*Group, error) {
+	for _, hex := range standardPrimes {
+		p, _ := new(big.Int).SetString(hex, 16)
+		if p.BitLen() >= bits {
+			return NewGroup(p), nil
+		}
+	}
+	return nil, fmt.Errorf("no group of %v bits, at most 4096 bits are supported", bits)
+}
+
+// Size of an element of the group in bytes
+func (g *Group) ElementSize() int {
+	return (g.P.BitLen() + 7) / 8
+}
+
+// Whether x is an element of the group: 0 < x < p, and x is a quadratic residue modulo p
+func (g *Group) Contains(x *big.Int) bool {
+	return x.Sign() > 0 && x.Cmp(g.P) < 0 && big.Jacobi(x, g.P) == 1
+}
+
+// Random exponent modulo q
+func (g *Group) RandomExponent() (*big.Int, error) {
+	return rand.Int(rand.Reader, g.Q)
+}
+
+// x^e mod p, e can be negative
+func (g *Group) Exp(x *big.Int, e *big.Int) *big.Int {
+	if e.Sign() < 0 {
+		inv := new(big.Int).ModInverse(x, g.P)
+		return inv.Exp(inv, new(big.Int).Neg(e), g.P)
+	}
+	return new(big.Int).Exp(x, e, g.P)
+}
+
+// g^e mod p
+func (g *Group) Pow(e *big.Int) *big.Int {
+	return g.Exp(g.G, e)
+}
+
+// x * y mod p
+func (g *Group) Mul(x *big.Int, y *big.Int) *big.Int {
+	res := new(big.Int).Mul(x, y)
+	return res.Mod(res, g.P)
+}
+
+// x / y mod p
+func (g *Group) Div(x *big.Int, y *big.Int) *big.Int {
+	res := new(big.Int).ModInverse(y, g.P)
+	res.Mul(res, x)
+	return res.Mod(res, g.P)
+}
+
+// Discrete log m of y = g^m, for 0 <= m <= max (baby-step giant-step)
+func (g *Group) DiscreteLog(y *big.Int, max int64) (int64, error) {
+	if max < 0 {
+		return 0, errors.New("negative bound")
+	}
+	steps := int64(1)
+	for steps*steps <= max {
+		steps++
+	}
+
+	// Baby steps: g^j for 0 <= j < steps
+	baby := make(map[string]int64, steps)
+	x := big.NewInt(1)
+	for j := int64(0); j < steps; j++ {
+		baby[string(x.Bytes())] = j
+		x = g.Mul(x, g.G)
+	}
+
+	// Giant steps: y / g^(i*steps)
+	giant := g.Pow(big.NewInt(-steps))
+	x = new(big.Int).Set(y)
+	for i := int64(0); i < steps; i++ {
+		if j, found := baby[string(x.Bytes())]; found && i*steps+j <= max {
+			return i*steps + j, nil
+		}
+		x = g.Mul(x, giant)
+	}
+	return 0, fmt.Errorf("no discrete log of at most %v", max)
+}
+
+// Ciphertext (g^r, h^r * g^m) of message m with public key h and randomness r
+type Ciphertext struct {
+	A *big.Int
+	B *big.Int
+}
+
+// The encryption of 0 with randomness 0, the neutral element of Add
+func Zero() *Ciphertext {
+	return &Ciphertext{A: big.NewInt(1), B: big.NewInt(1)}
+}
+
+// Encrypt m with the public key h, returning the ciphertext and the randomness that was used
+func (g *Group) Encrypt(h *big.Int, m *big.Int) (*Ciphertext, *big.Int, error) {
+	r, err := g.RandomExponent()
+	if err != nil {
+		return nil, nil, err
+	}
+	return g.EncryptWith(h, m, r), r, nil
+}
+
+// Encrypt m with the public key h and randomness r
+func (g *Group) EncryptWith(h *big.Int, m *big.Int, r *big.Int) *Ciphertext {
+	return &Ciphertext{
+		A: g.Pow(r),
+		B: g.Mul(g.Exp(h, r), g.Pow(m)),
+	}
+}
+
+// Encryption of the sum of the messages of c1 and c2
+func (g *Group) Add(c1 *Ciphertext, c2 *Ciphertext) *Ciphertext {
+	return &Ciphertext{A: g.Mul(c1.A, c2.A), B: g.Mul(c1.B, c2.B)}
+}
+
+// Encryption of k times the message of c
+func (g *Group) Scale(c *Ciphertext, k *big.Int) *Ciphertext {
+	return &Ciphertext{A: g.Exp(c.A, k), B: g.Exp(c.B, k)}
+}
+
+// Encoding of c: A and B, both padded to the size of an element
+func (g *Group) Marshal(c *Ciphertext) []byte {
+	size := g.ElementSize()
+	bs := make([]byte, 2*size)
+	c.A.FillBytes(bs[:size])
+	c.B.FillBytes(bs[size:])
+	return bs
+}
+
+// Decode a ciphertext encoded with Marshal, both parts have to be elements of the group
+func (g *Group) Unmarshal(bs []byte) (*Ciphertext, error) {
+	size := g.ElementSize()
+	if len(bs) != 2*size {
+		return nil, fmt.Errorf("ciphertext of %v bytes, expected %v", len(bs), 2*size)
+	}
+	c := &Ciphertext{
+		A: new(big.Int).SetBytes(bs[:size]),
+		B: new(big.Int).SetBytes(bs[size:]),
+	}
+	if !g.Contains(c.A) || !g.Contains(c.B) {
+		return nil, errors.New("ciphertext is not in the group")
+	}
+	return c, nil
+}
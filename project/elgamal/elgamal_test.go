@@ -0,0 +1,81 @@
+package elgamal
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestStandardGroups(t *testing.T) {
+	tests := []struct {
+		bits     int
+		expected int // Size of the prime of the group, 0 if there is none
+	}{
+		{0, 2048},
+		{2048, 2048},
+		{2049, 3072},
+		{3072, 3072},
+		{4096, 4096},
+		{4097, 0},
+	}
+	for _, test := range tests {
+		group, err := StandardGroup(test.bits)
+		if test.expected == 0 {
+			if err == nil {
+				t.Errorf("group of %v bits", test.bits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group.P.BitLen() != test.expected {
+			t.Errorf("group of %v bits for %v bits", group.P.BitLen(), test.bits)
+		}
+		// p = 2q+1 with p and q prime, and g generates the subgroup of order q
+		if !group.P.ProbablyPrime(20) || !group.Q.ProbablyPrime(20) {
+			t.Errorf("prime of %v bits is not a safe prime", test.expected)
+		}
+		if !group.Contains(group.G) || group.Exp(group.G, group.Q).Cmp(big.NewInt(1)) != 0 {
+			t.Errorf("generator of the group of %v bits is not of order q", test.expected)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	group, _ := StandardGroup(2048)
+	x, _ := group.RandomExponent()
+	h := group.Pow(x)
+
+	tests := []struct {
+		name     string
+		messages []int64
+		scale    int64
+	}{
+		{"no messages", nil, 1},
+		{"sum", []int64{1, 0, 3}, 1},
+		{"scaled sum", []int64{2, 5}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sum := Zero()
+			expected := int64(0)
+			for _, m := range test.messages {
+				c, _, err := group.Encrypt(h, big.NewInt(m))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sum = group.Add(sum, c)
+				expected += m * test.scale
+			}
+			c, err := group.Unmarshal(group.Marshal(group.Scale(sum, big.NewInt(test.scale))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Decrypt: B / A^x
+			gm := group.Div(c.B, group.Exp(c.A, x))
+			if m, err := group.DiscreteLog(gm, 1000); err != nil || m != expected {
+				t.Errorf("decrypted %v (%v), expected %v", m, err, expected)
+			}
+		})
+	}
+}
@@ -41,10 +41,19 @@ type Dispatcher struct {
 
 	BlockRumorerIn  chan *Block
 	BlockRumorerOut chan *Block
+
+	// To dispatch block requests and responses to the syncer
+	SyncerIn chan *AddrGossipPacket
+
+	// To dispatch the votes of validators to the finalizer
+	FinalityIn chan *FinalityVote
+
+	// Only gossip from peers of our network is dispatched
+	Handshaker *Handshaker
 }
 
-func NewDispatcher(name string, uiPort string, gossipAddr string) *Dispatcher {
-	return &Dispatcher{
+func NewDispatcher(name string, uiPort string, gossipAddr string, peers *Set, networkID string, genesisHash string) *Dispatcher {
+	d := &Dispatcher{
 		name:         name,
 		UIServer:     NewServer("127.0.0.1:" + uiPort),
 		GossipServer: NewServer(gossipAddr),
@@ -65,13 +74,20 @@ func NewDispatcher(name string, uiPort string, gossipAddr string) *Dispatcher {
 		BlockRumorerIn:  make(chan *Block),
 		BlockRumorerOut: make(chan *Block),
 
+		SyncerIn: make(chan *AddrGossipPacket),
+
+		FinalityIn: make(chan *FinalityVote),
+
 		TransactionRumorerIn: make(chan *Transaction),
 	}
+	d.Handshaker = NewHandshaker(name, networkID, genesisHash, peers, d.RumorerOut)
+	return d
 }
 
 func (d *Dispatcher) Run() {
 	d.UIServer.Run()
 	d.GossipServer.Run()
+	go d.Handshaker.GreetPeers()
 
 	go func() {
 		for pack := range d.UIServer.Ingress() {
@@ -103,8 +119,14 @@ func (d *Dispatcher) Run() {
 	}()
 
 	go func() {
-		for range d.PrivateRumorerLocalOut {
+		for packet := range d.PrivateRumorerLocalOut {
 			// Process private messages for different parts of the application
+			if packet.Gossip.KeyGenRequest != nil || packet.Gossip.Dealing != nil || packet.Gossip.KeyShare != nil ||
+				packet.Gossip.KeyGenComplaint != nil || packet.Gossip.KeyGenReveal != nil ||
+				packet.Gossip.KeyGenResult != nil || packet.Gossip.DecryptionRequest != nil ||
+				packet.Gossip.PartialDecryption != nil {
+				d.VoteRumorerIn <- packet
+			}
 		}
 	}()
 
@@ -119,6 +141,8 @@ func (d *Dispatcher) Run() {
 				fmt.Println("Received block in dispatcher")
 				d.BlockRumorerIn <- mongerable.ToGossip().MongerableBlock.Block
 				fmt.Println("Sent block to BlockRumorerIn")
+			} else if mongerable.ToGossip().FinalityVote != nil {
+				d.FinalityIn <- mongerable.ToGossip().FinalityVote
 			}
 		}
 	}()
@@ -145,11 +169,16 @@ func (d *Dispatcher) Run() {
 }
 
 func (d *Dispatcher) dispatchFromPeer(gossip *AddrGossipPacket) {
+	if !d.Handshaker.Accept(gossip) {
+		return
+	}
+
 	if gossip.Gossip.ToMongerableMessage() != nil {
 		d.RumorerGossipIn <- gossip
 	}
 
-	if gossip.Gossip.Rumor != nil {
+	if gossip.Gossip.ToMongerableMessage() != nil {
+		// The private rumorer learns routes from all mongered messages
 		d.PrivateRumorerGossipIn <- gossip
 	}
 
@@ -157,9 +186,13 @@ func (d *Dispatcher) dispatchFromPeer(gossip *AddrGossipPacket) {
 		d.RumorerGossipIn <- gossip
 	}
 
-	if gossip.Gossip.Private != nil {
+	if gossip.Gossip.ToP2PMessage() != nil {
 		d.PrivateRumorerGossipIn <- gossip
 	}
+
+	if gossip.Gossip.BlockRequest != nil || gossip.Gossip.BlockResponse != nil {
+		d.SyncerIn <- gossip
+	}
 }
 
 func (d *Dispatcher) dispatchFromClient(msg *Message) {
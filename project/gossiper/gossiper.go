@@ -2,11 +2,13 @@ package gossiper
 
 import (
 	. "github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
+	"github.com/lukasdeloose/decentralized-voting-system/project/keystore"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/privateRumorer"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/rumorer"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/voting"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/web"
+	"log"
 )
 
 type Gossiper struct {
@@ -26,14 +28,38 @@ type Gossiper struct {
 
 	miner *Miner
 
+	syncer *Syncer
+
+	finalizer *Finalizer
+
 	N               int
 	stubbornTimeout int
 }
 
 func NewGossiper(name string, peers *Set, uiPort string, gossipAddr string,
-	antiEntropy int, routeRumoringTimeout int, N int, stubbornTimeout int, hopLimit int) *Gossiper {
-	// Create the dispatcher
-	disp := NewDispatcher(name, uiPort, gossipAddr)
+	antiEntropy int, routeRumoringTimeout int, N int, stubbornTimeout int, hopLimit int, dataDir string,
+	keystorePath string, passphrase string, genesis *Genesis, miningWorkers int) *Gossiper {
+	// Create the blockchain, restore it from disk if a data directory is given
+	var blockchain *Blockchain
+	if dataDir == "" {
+		var err error
+		blockchain, err = NewBlockChain(genesis)
+		if err != nil {
+			log.Fatalf("ERROR could not create blockchain: %v", err)
+		}
+	} else {
+		storage, err := NewStorage(dataDir)
+		if err != nil {
+			log.Fatalf("ERROR could not open storage in %v: %v", dataDir, err)
+		}
+		blockchain, err = LoadBlockChain(storage, genesis)
+		if err != nil {
+			log.Fatalf("ERROR could not load blockchain from %v: %v", dataDir, err)
+		}
+	}
+
+	// Create the dispatcher, which only talks to peers with the same genesis block
+	disp := NewDispatcher(name, uiPort, gossipAddr, peers, genesis.NetworkID, blockchain.Blocks[0].Hash)
 
 	// Create the rumorer
 	rumorer := NewRumorer(name, peers, disp.RumorerGossipIn, disp.RumorerOut, disp.RumorerLocalOut, disp.RumorerUIIn, antiEntropy)
@@ -42,12 +68,27 @@ func NewGossiper(name string, peers *Set, uiPort string, gossipAddr string,
 	privateRumorer := NewPrivateRumorer(name, disp.PrivateRumorerGossipIn, disp.PrivateRumorerUIIn,
 		disp.PrivateRumorerGossipOut, disp.RumorerUIIn, disp.PrivateRumorerLocalOut, routeRumoringTimeout, gossipAddr, hopLimit)
 
-	// Create the blockchain miner
-	blockchain := NewBlockChain()
+	// Open the keystore with our private keys, if one is given
+	var keys *keystore.Keystore
+	if keystorePath != "" {
+		var err error
+		keys, err = keystore.Open(keystorePath, passphrase)
+		if err != nil {
+			log.Fatalf("ERROR could not open keystore %v: %v", keystorePath, err)
+		}
+	}
+
+	voteRumorer := NewVoteRumorer(name, disp.VoteRumorerUIIn, disp.VoteRumorerIn, disp.RumorerGossipIn,
+		disp.PrivateRumorerGossipIn, blockchain, hopLimit, keys)
+
+	miner := NewMiner(name, blockchain, disp.TransactionRumorerIn, disp.BlockRumorerIn, disp.RumorerGossipIn,
+		voteRumorer.PrivateKey, miningWorkers)
 
-	voteRumorer := NewVoteRumorer(name, disp.VoteRumorerUIIn, disp.VoteRumorerIn, disp.RumorerGossipIn, blockchain)
+	// Create the syncer to catch up with the blocks of our peers
+	syncer := NewSyncer(name, blockchain, peers, disp.SyncerIn, disp.RumorerOut, disp.BlockRumorerIn)
 
-	miner := NewMiner(name, blockchain, disp.TransactionRumorerIn, disp.BlockRumorerIn, disp.RumorerGossipIn)
+	// Create the finalizer to vote on blocks if we are a validator, and finalize blocks
+	finalizer := NewFinalizer(name, blockchain, disp.FinalityIn, disp.RumorerGossipIn, voteRumorer.PrivateKey)
 
 	// Create the webserver for interacting with the rumorer
 	webServer := NewWebServer(rumorer, privateRumorer, voteRumorer, blockchain, uiPort)
@@ -60,6 +101,8 @@ func NewGossiper(name string, peers *Set, uiPort string, gossipAddr string,
 		VoteRumorer:     voteRumorer,
 		Blockchain:      blockchain,
 		miner:           miner,
+		syncer:          syncer,
+		finalizer:       finalizer,
 		name:            name,
 		N:               N,
 		stubbornTimeout: stubbornTimeout,
@@ -72,6 +115,8 @@ func (g *Gossiper) Run() {
 	g.PrivateRumorer.Run()
 	g.VoteRumorer.Run()
 	g.miner.Run()
+	g.syncer.Run()
+	g.finalizer.Run()
 
 	if g.WebServer != nil {
 		g.WebServer.Run()
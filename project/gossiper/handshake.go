@@ -0,0 +1,108 @@
+package gossiper
+
+import (
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"sync"
+	"time"
+)
+
+// A peer that didn't answer our handshake gets a new one after this time
+const handshakeRetry = 5 * time.Second
+
+// Peers only gossip with each other after a handshake in which both showed they are on the same network:
+// with the same network ID and genesis block. Packets from a peer we didn't shake hands with are dropped,
+// and answered with a handshake. Peers of another network are removed from the peers
+type Handshaker struct {
+	name        string
+	networkID   string
+	genesisHash string
+	peers       *Set
+	out         chan *AddrGossipPacket
+
+	accepted map[string]bool      // By address, false if the peer is of another network
+	greeted  map[string]time.Time // When we last sent a handshake to a peer, by address
+	mutex    *sync.Mutex
+}
+
+func NewHandshaker(name string, networkID string, genesisHash string, peers *Set, out chan *AddrGossipPacket) *Handshaker {
+	return &Handshaker{
+		name:        name,
+		networkID:   networkID,
+		genesisHash: genesisHash,
+		peers:       peers,
+		out:         out,
+		accepted:    make(map[string]bool),
+		greeted:     make(map[string]time.Time),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// Send a handshake to all peers we know of
+func (h *Handshaker) GreetPeers() {
+	for _, peer := range h.peers.Data() {
+		h.greet(peer, false)
+	}
+}
+
+// Whether the packet may be dispatched: it is from a peer of our network. Handshakes are handled here
+func (h *Handshaker) Accept(packet *AddrGossipPacket) bool {
+	address := packet.Address.String()
+	if handshake := packet.Gossip.Handshake; handshake != nil {
+		h.handle(handshake, packet.Address)
+		return false
+	}
+
+	h.mutex.Lock()
+	accepted, known := h.accepted[address]
+	h.mutex.Unlock()
+	if !known {
+		if Debug {
+			fmt.Printf("[DEBUG] Dropping packet from %v before the handshake\n", address)
+		}
+		h.greet(packet.Address, false)
+	}
+	return accepted
+}
+
+func (h *Handshaker) handle(handshake *Handshake, sender UDPAddr) {
+	valid := handshake.NetworkID == h.networkID && handshake.GenesisHash == h.genesisHash
+
+	h.mutex.Lock()
+	h.accepted[sender.String()] = valid
+	h.mutex.Unlock()
+
+	if !valid {
+		fmt.Printf("REJECTED PEER %v (%v): network %v with genesis block %v\n", sender, handshake.Origin,
+			handshake.NetworkID, handshake.GenesisHash)
+		h.peers.Delete(sender)
+		return
+	}
+	fmt.Printf("HANDSHAKE with %v (%v)\n", sender, handshake.Origin)
+	h.peers.Add(sender)
+	if !handshake.Reply {
+		h.greet(sender, true)
+	}
+}
+
+func (h *Handshaker) greet(peer UDPAddr, reply bool) {
+	h.mutex.Lock()
+	if last, greeted := h.greeted[peer.String()]; !reply && greeted && time.Since(last) < handshakeRetry {
+		h.mutex.Unlock()
+		return
+	}
+	h.greeted[peer.String()] = time.Now()
+	h.mutex.Unlock()
+
+	h.out <- &AddrGossipPacket{
+		Address: peer,
+		Gossip: &GossipPacket{Handshake: &Handshake{
+			Origin:      h.name,
+			NetworkID:   h.networkID,
+			GenesisHash: h.genesisHash,
+			Reply:       reply,
+		}},
+	}
+}
@@ -0,0 +1,206 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/lukasdeloose/decentralized-voting-system/project/threshold"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Parameters of scrypt, which derives the encryption key from the passphrase
+const scryptN = 1 << 15
+const scryptR = 8
+const scryptP = 1
+
+var ErrPassphrase = errors.New("wrong passphrase or corrupted keystore")
+
+// Encrypted on-disk store for the secrets of a node: its RSA identity key and its key shares for polls.
+// The whole store is encrypted with AES-256-GCM, with a key derived from a passphrase with scrypt, and
+// rewritten on every change
+type Keystore struct {
+	path  string
+	key   []byte // Derived from the passphrase
+	salt  []byte
+	keys  *keys
+	mutex *sync.Mutex
+}
+
+// Contents of the keystore
+type keys struct {
+	Identity  []byte                         `json:"identity"`  // PKCS #1 encoded RSA private key
+	Shares    map[string]*threshold.KeyShare `json:"shares"`    // By Poll.KeyID
+	Decrypted map[string][]byte              `json:"decrypted"` // Digest of the aggregates we decrypted, by Poll.KeyID
+}
+
+// Format of the keystore file
+type sealedKeystore struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Open the keystore at path with passphrase, an empty keystore is created if the file doesn't exist
+func Open(path string, passphrase string) (*Keystore, error) {
+	k := &Keystore{
+		path: path,
+		keys: &keys{
+			Shares:    make(map[string]*threshold.KeyShare),
+			Decrypted: make(map[string][]byte),
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		k.salt = make([]byte, 32)
+		if _, err := rand.Read(k.salt); err != nil {
+			return nil, err
+		}
+		if k.key, err = deriveKey(passphrase, k.salt); err != nil {
+			return nil, err
+		}
+		return k, k.save()
+	} else if err != nil {
+		return nil, err
+	}
+
+	sealed := &sealedKeystore{}
+	if err := json.Unmarshal(data, sealed); err != nil {
+		return nil, err
+	}
+	k.salt = sealed.Salt
+	if k.key, err = deriveKey(passphrase, k.salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	if err := json.Unmarshal(plain, k.keys); err != nil {
+		return nil, err
+	}
+	if k.keys.Shares == nil {
+		k.keys.Shares = make(map[string]*threshold.KeyShare)
+	}
+	if k.keys.Decrypted == nil {
+		k.keys.Decrypted = make(map[string][]byte)
+	}
+	return k, nil
+}
+
+// The identity key of the node, nil if there is none yet
+func (k *Keystore) Identity() (*rsa.PrivateKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.keys.Identity == nil {
+		return nil, nil
+	}
+	return x509.ParsePKCS1PrivateKey(k.keys.Identity)
+}
+
+func (k *Keystore) SetIdentity(key *rsa.PrivateKey) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.keys.Identity = x509.MarshalPKCS1PrivateKey(key)
+	return k.save()
+}
+
+// All key shares, by Poll.KeyID
+func (k *Keystore) Shares() map[string]*threshold.KeyShare {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	shares := make(map[string]*threshold.KeyShare)
+	for keyID, share := range k.keys.Shares {
+		shares[keyID] = share
+	}
+	return shares
+}
+
+func (k *Keystore) AddShare(keyID string, share *threshold.KeyShare) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.keys.Shares[keyID] = share
+	return k.save()
+}
+
+// Digests of the aggregates we partially decrypted, by Poll.KeyID
+func (k *Keystore) Decrypted() map[string][]byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	decrypted := make(map[string][]byte)
+	for keyID, digest := range k.keys.Decrypted {
+		decrypted[keyID] = digest
+	}
+	return decrypted
+}
+
+func (k *Keystore) SetDecrypted(keyID string, digest []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.keys.Decrypted[keyID] = digest
+	return k.save()
+}
+
+// Encrypt the keys with a fresh nonce, and write them to a temporary file that replaces the keystore,
+// so a crash never leaves a partial keystore behind
+func (k *Keystore) save() error {
+	plain, err := json.Marshal(k.keys)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.Marshal(&sealedKeystore{
+		Salt:       k.salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
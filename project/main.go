@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/gossiper"
+	"github.com/lukasdeloose/decentralized-voting-system/project/keystore"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
 	"log"
 	"math/rand"
+	"os"
+	"runtime"
 	"time"
 
 	"flag"
@@ -22,10 +31,18 @@ var (
 	antiEntropy   int
 	routeRumoring int
 
-	debug         bool
-	N             int
+	debug           bool
+	N               int
 	stubbornTimeout int
-	hopLimit	 int
+	hopLimit        int
+	dataDir         string
+	keystorePath    string
+	rsaKeyBits      uint
+	elgamalKeyBits  uint
+	consensus       string
+	miningWorkers   int
+	genesisPath     string
+	publicKey       bool
 )
 
 func main() {
@@ -42,6 +59,22 @@ func main() {
 	flag.IntVar(&N, "N", -1, "Total number of peers in the network")
 	flag.IntVar(&stubbornTimeout, "stubbornTimeout", 5, "Timeout for resending txn BlockPublish")
 	flag.IntVar(&hopLimit, "hopLimit", 10, "HopLimit for point to point messages")
+	flag.StringVar(&dataDir, "dataDir", "", "directory where the blockchain is stored, "+
+		"it is restored from this directory on startup. Empty (default) means the blockchain is only kept in memory")
+	flag.StringVar(&keystorePath, "keystore", "", "file where the private keys of the node are stored, encrypted "+
+		"with a passphrase (from $KEYSTORE_PASSPHRASE, or asked on startup). Empty (default) means the keys are only kept in memory")
+	flag.StringVar(&genesisPath, "genesis", "", "genesis file of the network to join. Empty (default) means "+
+		"the default network, with the parameters of the flags below")
+	flag.UintVar(&rsaKeyBits, "rsaKeyBits", DefaultRSAKeyBits, "minimum size of the RSA keys of users, "+
+		"without genesis file")
+	flag.UintVar(&elgamalKeyBits, "elgamalKeyBits", DefaultElGamalKeyBits, "minimum size of the group of the "+
+		"ElGamal keys of polls, at most 4096, without genesis file")
+	flag.StringVar(&consensus, "consensus", ProofOfWork, "consensus without genesis file: 'pow' for proof-of-work. "+
+		"Proof-of-authority needs a genesis file with the keys of the signers")
+	flag.BoolVar(&publicKey, "publicKey", false, "print the public key of the node in the keystore, for in a "+
+		"genesis file, and exit. A key is generated if the keystore has none")
+	flag.IntVar(&miningWorkers, "miningWorkers", runtime.NumCPU(), "number of goroutines that search for the nonce "+
+		"of a block in parallel with proof-of-work (default the number of CPUs)")
 	flag.Parse()
 
 	// Seed random generator
@@ -63,13 +96,81 @@ func main() {
 	HW1 = true
 	HW2 = true
 
+	genesis := DefaultGenesis()
+	genesis.RSAKeyBits = uint32(rsaKeyBits)
+	genesis.ElGamalKeyBits = uint32(elgamalKeyBits)
+	genesis.Consensus = consensus
+	if genesisPath != "" {
+		var err error
+		genesis, err = LoadGenesis(genesisPath)
+		if err != nil {
+			log.Fatalf("Could not load the genesis file %v: %v", genesisPath, err)
+		}
+	}
+
+	passphrase := ""
+	if keystorePath != "" {
+		passphrase = readPassphrase()
+	}
+
+	if publicKey {
+		printPublicKey(keystorePath, passphrase, int(genesis.RSAKeyBits))
+		return
+	}
+
 	// Initialize and run gossiper
-	goss := NewGossiper(name, peersSet, uiPort, gossipAddr, antiEntropy, routeRumoring, N, stubbornTimeout, hopLimit)
+	goss := NewGossiper(name, peersSet, uiPort, gossipAddr, antiEntropy, routeRumoring, N, stubbornTimeout, hopLimit, dataDir,
+		keystorePath, passphrase, genesis, miningWorkers)
 	goss.Run()
 
 	// Wait forever
 	select {}
 }
 
+// Passphrase of the keystore, from the environment or else from stdin
+func readPassphrase() string {
+	if passphrase, ok := os.LookupEnv("KEYSTORE_PASSPHRASE"); ok {
+		return passphrase
+	}
+	fmt.Print("Keystore passphrase: ")
+	passphrase, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && passphrase == "" {
+		log.Fatalf("Could not read the keystore passphrase: %v", err)
+	}
+	return strings.TrimRight(passphrase, "\r\n")
+}
+
 // TODO: indicate confirmation of origin in GUI
 
+// Print the public key of the identity in the keystore as an entry of a genesis file
+func printPublicKey(keystorePath string, passphrase string, keyBits int) {
+	if keystorePath == "" {
+		log.Fatal("Please provide the keystore with the '-keystore' flag")
+	}
+	keys, err := keystore.Open(keystorePath, passphrase)
+	if err != nil {
+		log.Fatalf("Could not open keystore %v: %v", keystorePath, err)
+	}
+	privKey, err := keys.Identity()
+	if err != nil {
+		log.Fatalf("Could not load private key: %v", err)
+	}
+	if privKey == nil || privKey.N.BitLen() < keyBits {
+		if keyBits < 2048 {
+			keyBits = 2048
+		}
+		privKey, err = rsa.GenerateKey(cryptorand.Reader, keyBits)
+		if err == nil {
+			err = keys.SetIdentity(privKey)
+		}
+		if err != nil {
+			log.Fatalf("Could not generate private key: %v", err)
+		}
+	}
+	encoded, err := EncodePublicKey(&privKey.PublicKey)
+	if err != nil {
+		log.Fatalf("Could not encode public key: %v", err)
+	}
+	entry, _ := json.MarshalIndent(GenesisKey{Name: name, PublicKey: encoded}, "", "  ")
+	fmt.Println(string(entry))
+}
@@ -9,21 +9,20 @@ import (
 	"time"
 )
 
-
 type PrivateRumorer struct {
 	routingTable *RoutingTable
 
 	messages      map[string][]*PrivateMessage
 	messagesMutex *sync.RWMutex
 
-	in      chan *AddrGossipPacket
-	out     chan *AddrGossipPacket
-	uiIn    chan *Message
+	in       chan *AddrGossipPacket
+	out      chan *AddrGossipPacket
+	uiIn     chan *Message
 	localOut chan *AddrGossipPacket
 
 	rumorerUIIn chan *Message // Channel on which the 'public' rumorer listens for UI messages: used to spread a route rumor
 
-	name  string
+	name string
 
 	routeRumoringTimeout time.Duration
 	hopLimit             uint32
@@ -92,8 +91,8 @@ func (pr *PrivateRumorer) Run() {
 			select {
 			case packet := <-pr.in:
 				go func() {
-					if packet.Gossip.Rumor != nil {
-						pr.handleMongerable(packet.Gossip.Rumor, packet.Address)
+					if mongerable := packet.Gossip.ToMongerableMessage(); mongerable != nil && packet.Address.String() != "" {
+						pr.handleMongerable(mongerable, packet.Address)
 					}
 
 					p2pMsg := packet.Gossip.ToP2PMessage()
@@ -196,7 +195,6 @@ func (pr *PrivateRumorer) handleUIMessage(msg *Message) {
 	}
 }
 
-
 func (pr *PrivateRumorer) savePrivateMessage(msg *PrivateMessage) {
 	// Ensure thread-safe access
 	pr.messagesMutex.Lock()
@@ -209,4 +207,4 @@ func (pr *PrivateRumorer) savePrivateMessage(msg *PrivateMessage) {
 		pr.messages[msg.Origin] = make([]*PrivateMessage, 0)
 	}
 	pr.messages[msg.Origin] = append(pr.messages[msg.Origin], msg)
-}
\ No newline at end of file
+}
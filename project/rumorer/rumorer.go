@@ -9,6 +9,7 @@ import (
 	"sync"
 
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -131,6 +132,8 @@ func (r *Rumorer) runPeer() {
 					r.printTx(gossip.Transaction)
 				} else if gossip.MongerableBlock != nil {
 					r.printBlock(gossip.MongerableBlock)
+				} else if gossip.FinalityVote != nil {
+					r.printFinalityVote(gossip.FinalityVote)
 				}
 
 				// Handle the message
@@ -380,6 +383,10 @@ func (r *Rumorer) printTx(t *Transaction) {
 		fmt.Printf("POLL TRANSACTION ID %v ORIGIN %v\n", t.ID, t.Origin)
 	} else if t.VoteTx != nil {
 		fmt.Printf("VOTE TRANSACTION ID %v ORIGIN %v\n", t.ID, t.Origin)
+	} else if t.RevoteTx != nil {
+		fmt.Printf("REVOTE TRANSACTION ID %v ORIGIN %v\n", t.ID, t.Origin)
+	} else if t.DelegationTx != nil {
+		fmt.Printf("DELEGATION TRANSACTION ID %v ORIGIN %v\n", t.ID, t.Origin)
 	} else if t.RegisterTx != nil {
 		fmt.Printf("REGISTER TRANSACTION ID %v ORIGIN %v\n", t.ID, t.Origin)
 	}
@@ -388,3 +395,7 @@ func (r *Rumorer) printTx(t *Transaction) {
 func (r *Rumorer) printBlock(b *MongerableBlock) {
 	fmt.Printf("NEW BLOCK RECEIVED FROM %v with ID=%v\n", b.Origin, b.Block.ID)
 }
+
+func (r *Rumorer) printFinalityVote(v *FinalityVote) {
+	fmt.Printf("%v FROM %v for block %v\n", strings.ToUpper(v.Type), v.Origin, v.Height)
+}
@@ -0,0 +1,238 @@
+package threshold
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+)
+
+// Threshold ElGamal (see package elgamal) with a key that the trustees generate together, so nobody ever
+// knows the key itself (Pedersen's distributed key generation). Every trustee deals a random secret with
+// Shamir secret sharing modulo q: it picks a random polynomial f of degree t-1, publishes the Feldman
+// commitments g^a of its coefficients, and sends f(j) to trustee j. Every trustee checks the values it was
+// dealt against the commitments and complains about the dealers of which it got no valid value, these have
+// to reveal that value or are disqualified. The key is the sum of the secrets f(0) of the qualified
+// trustees, and the key share of a trustee the sum of the values they dealt it. As long as one qualified
+// trustee deals honestly the key is unknown to everyone, any t trustees can decrypt together and fewer
+// learn nothing.
+//
+// Partial decryptions can be verified without any secret: the verification key g^share of every trustee
+// follows from the commitments, and the trustee proves that its partial decryption used the same exponent.
+
+// Share of the decryption key held by trustee Index (1..NumTrustees)
+type KeyShare struct {
+	Index       int
+	NumTrustees int
+	Threshold   int
+	P           *big.Int // Safe prime of the group
+	Share       *big.Int
+}
+
+// The secret polynomial of a trustee in the key generation
+type Polynomial struct {
+	group  *elgamal.Group
+	coeffs []*big.Int
+}
+
+// Deal a random secret of which threshold shares are needed
+func Deal(group *elgamal.Group, threshold int) (*Polynomial, error) {
+	if threshold < 1 {
+		return nil, errors.New("threshold has to be at least 1")
+	}
+	coeffs := make([]*big.Int, threshold)
+	for i := range coeffs {
+		c, err := group.RandomExponent()
+		if err != nil {
+			return nil, err
+		}
+		coeffs[i] = c
+	}
+	return &Polynomial{group: group, coeffs: coeffs}, nil
+}
+
+// Feldman commitments g^a of the coefficients of the polynomial, the first one is the part of the public key
+// of the trustee
+func (d *Polynomial) Commitments() []*big.Int {
+	commitments := make([]*big.Int, len(d.coeffs))
+	for i, c := range d.coeffs {
+		commitments[i] = d.group.Pow(c)
+	}
+	return commitments
+}
+
+// Value f(index) of the polynomial that is dealt to trustee index
+func (d *Polynomial) Share(index int) *big.Int {
+	x := big.NewInt(int64(index))
+	share := new(big.Int)
+	for i := len(d.coeffs) - 1; i >= 0; i-- {
+		share.Mul(share, x)
+		share.Add(share, d.coeffs[i])
+		share.Mod(share, d.group.Q)
+	}
+	return share
+}
+
+// g^f(index) of the dealing with the given commitments: the product of the commitments to the power index^k
+func committedShare(group *elgamal.Group, commitments []*big.Int, index int) *big.Int {
+	res := big.NewInt(1)
+	power := big.NewInt(1)
+	for _, c := range commitments {
+		res = group.Mul(res, group.Exp(c, power))
+		power = new(big.Int).Mul(power, big.NewInt(int64(index)))
+	}
+	return res
+}
+
+// Check share, dealt to trustee index, against the commitments of the dealing
+func VerifyShare(group *elgamal.Group, commitments []*big.Int, index int, share *big.Int) bool {
+	if share.Sign() < 0 || share.Cmp(group.Q) >= 0 {
+		return false
+	}
+	for _, c := range commitments {
+		if !group.Contains(c) {
+			return false
+		}
+	}
+	return group.Pow(share).Cmp(committedShare(group, commitments, index)) == 0
+}
+
+// Public key of the poll, for the commitments of the dealings of the qualified trustees: the product of their parts
+func PublicKey(group *elgamal.Group, commitments [][]*big.Int) *big.Int {
+	h := big.NewInt(1)
+	for _, dealing := range commitments {
+		h = group.Mul(h, dealing[0])
+	}
+	return h
+}
+
+// Verification key g^share of trustee index, for the commitments of the dealings of the qualified trustees
+func VerificationKey(group *elgamal.Group, commitments [][]*big.Int, index int) *big.Int {
+	vk := big.NewInt(1)
+	for _, dealing := range commitments {
+		vk = group.Mul(vk, committedShare(group, dealing, index))
+	}
+	return vk
+}
+
+// Key share of trustee index, from the values dealt to it by the trustees whose dealings make the key
+func NewKeyShare(group *elgamal.Group, index int, numTrustees int, threshold int, dealt []*big.Int) *KeyShare {
+	share := new(big.Int)
+	for _, value := range dealt {
+		share.Add(share, value)
+	}
+	return &KeyShare{
+		Index:       index,
+		NumTrustees: numTrustees,
+		Threshold:   threshold,
+		P:           new(big.Int).Set(group.P),
+		Share:       share.Mod(share, group.Q),
+	}
+}
+
+func (s *KeyShare) Group() *elgamal.Group {
+	return elgamal.NewGroup(s.P)
+}
+
+// Partial decryption of ciphertext c: A^share
+func (s *KeyShare) PartialDecrypt(c *elgamal.Ciphertext) *big.Int {
+	return s.Group().Exp(c.A, s.Share)
+}
+
+// Prove that partial is the partial decryption of c with this share: the discrete log of partial in base A
+// equals the discrete log of the verification key in base g (Chaum-Pedersen, made non-interactive with
+// Fiat-Shamir)
+func (s *KeyShare) ProveDecryption(c *elgamal.Ciphertext, partial *big.Int) (*DecryptionProof, error) {
+	group := s.Group()
+	vk := group.Pow(s.Share)
+
+	r, err := group.RandomExponent()
+	if err != nil {
+		return nil, err
+	}
+	a := group.Exp(c.A, r)
+	b := group.Pow(r)
+	e := decryptionChallenge(group, vk, c.A, partial, a, b)
+	z := new(big.Int).Mul(e, s.Share)
+	z.Add(z, r)
+
+	return &DecryptionProof{
+		A: a.Bytes(),
+		B: b.Bytes(),
+		Z: z.Mod(z, group.Q).Bytes(),
+	}, nil
+}
+
+// Verify that partial is a correct partial decryption of c by the trustee with verification key vk
+func VerifyDecryption(group *elgamal.Group, vk *big.Int, c *elgamal.Ciphertext, partial *big.Int,
+	proof *DecryptionProof) bool {
+	if proof == nil || !group.Contains(vk) || !group.Contains(c.A) || !group.Contains(partial) {
+		return false
+	}
+	a := new(big.Int).SetBytes(proof.A)
+	b := new(big.Int).SetBytes(proof.B)
+	z := new(big.Int).SetBytes(proof.Z)
+	if z.Cmp(group.Q) >= 0 {
+		return false
+	}
+	e := decryptionChallenge(group, vk, c.A, partial, a, b)
+
+	// A^z = a * partial^e and g^z = b * vk^e
+	if group.Exp(c.A, z).Cmp(group.Mul(a, group.Exp(partial, e))) != 0 {
+		return false
+	}
+	return group.Pow(z).Cmp(group.Mul(b, group.Exp(vk, e))) == 0
+}
+
+func decryptionChallenge(group *elgamal.Group, values ...*big.Int) *big.Int {
+	h := sha256.New()
+	for _, x := range append([]*big.Int{group.P, group.G}, values...) {
+		bs := x.Bytes()
+		h.Write(big.NewInt(int64(len(bs))).FillBytes(make([]byte, 4)))
+		h.Write(bs)
+	}
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	return e.Mod(e, group.Q)
+}
+
+// Combine the partial decryptions of ciphertext c, by index of the trustee, to g^m for the message m.
+// Exactly the first threshold partial decryptions (by index) are used
+func Combine(group *elgamal.Group, numTrustees int, threshold int, c *elgamal.Ciphertext,
+	partials map[int]*big.Int) (*big.Int, error) {
+	if len(partials) < threshold {
+		return nil, errors.New("not enough partial decryptions")
+	}
+	indices := make([]int, 0, threshold)
+	for i := 1; i <= numTrustees && len(indices) < threshold; i++ {
+		if _, ok := partials[i]; ok {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) < threshold {
+		return nil, errors.New("partial decryptions with invalid index")
+	}
+
+	// A^key = prod partial_i^lambda_i, with lambda_i the lagrange coefficient of i in 0
+	ax := big.NewInt(1)
+	for _, i := range indices {
+		ax = group.Mul(ax, group.Exp(partials[i], lagrange(group.Q, indices, i)))
+	}
+	return group.Div(c.B, ax), nil
+}
+
+// Lagrange coefficient of index i in 0 for the set of indices, modulo q
+func lagrange(q *big.Int, indices []int, i int) *big.Int {
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	for _, j := range indices {
+		if j == i {
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(j)))
+		den.Mul(den, big.NewInt(int64(j-i)))
+	}
+	den.Mod(den, q)
+	num.Mul(num, den.ModInverse(den, q))
+	return num.Mod(num, q)
+}
@@ -0,0 +1,152 @@
+package threshold
+
+import (
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+	"testing"
+)
+
+// Key generation among numTrustees trustees, returns the key shares and the commitments of all dealings
+func generateKey(t *testing.T, group *elgamal.Group, numTrustees int, threshold int) ([]*KeyShare, [][]*big.Int) {
+	polynomials := make([]*Polynomial, numTrustees)
+	commitments := make([][]*big.Int, numTrustees)
+	for i := range polynomials {
+		p, err := Deal(group, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		polynomials[i] = p
+		commitments[i] = p.Commitments()
+	}
+
+	shares := make([]*KeyShare, numTrustees)
+	for j := 1; j <= numTrustees; j++ {
+		dealt := make([]*big.Int, numTrustees)
+		for i, p := range polynomials {
+			dealt[i] = p.Share(j)
+			if !VerifyShare(group, commitments[i], j, dealt[i]) {
+				t.Fatalf("value dealt by %v to %v rejected", i+1, j)
+			}
+		}
+		shares[j-1] = NewKeyShare(group, j, numTrustees, threshold, dealt)
+	}
+	return shares, commitments
+}
+
+func TestCombine(t *testing.T) {
+	group, _ := elgamal.StandardGroup(2048)
+	shares, commitments := generateKey(t, group, 5, 3)
+	c, _, err := group.Encrypt(PublicKey(group, commitments), big.NewInt(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		trustees []int
+		valid    bool
+	}{
+		{"first trustees", []int{1, 2, 3}, true},
+		{"other trustees", []int{2, 4, 5}, true},
+		{"more than threshold", []int{5, 1, 3, 4}, true},
+		{"all trustees", []int{1, 2, 3, 4, 5}, true},
+		{"below threshold", []int{2, 5}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			partials := make(map[int]*big.Int)
+			for _, i := range test.trustees {
+				partials[i] = shares[i-1].PartialDecrypt(c)
+			}
+			gm, err := Combine(group, 5, 3, c, partials)
+			if !test.valid {
+				if err == nil {
+					t.Error("combined partial decryptions below the threshold")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, err := group.DiscreteLog(gm, 100); err != nil || m != 42 {
+				t.Errorf("decrypted %v (%v), expected 42", m, err)
+			}
+		})
+	}
+}
+
+func TestVerifyDecryption(t *testing.T) {
+	group, _ := elgamal.StandardGroup(2048)
+	shares, commitments := generateKey(t, group, 3, 2)
+	c, _, err := group.Encrypt(PublicKey(group, commitments), big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := group.Encrypt(PublicKey(group, commitments), big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share := shares[0]
+	partial := share.PartialDecrypt(c)
+	proof, err := share.ProveDecryption(c, partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedZ := &DecryptionProof{A: proof.A, B: proof.B, Z: new(big.Int).Add(new(big.Int).SetBytes(proof.Z), big.NewInt(1)).Bytes()}
+
+	tests := []struct {
+		name    string
+		index   int // Trustee whose verification key is used
+		c       *elgamal.Ciphertext
+		partial *big.Int
+		proof   *DecryptionProof
+		valid   bool
+	}{
+		{"honest", 1, c, partial, proof, true},
+		{"tampered partial", 1, c, group.Mul(partial, group.G), proof, false},
+		{"partial of another trustee", 1, c, shares[1].PartialDecrypt(c), proof, false},
+		{"verification key of another trustee", 2, c, partial, proof, false},
+		{"other ciphertext", 1, other, partial, proof, false},
+		{"tampered response", 1, c, partial, tamperedZ, false},
+		{"partial not in the group", 1, c, new(big.Int).Sub(group.P, big.NewInt(1)), proof, false},
+		{"no proof", 1, c, partial, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vk := VerificationKey(group, commitments, test.index)
+			if VerifyDecryption(group, vk, test.c, test.partial, test.proof) != test.valid {
+				t.Errorf("expected valid = %v", test.valid)
+			}
+		})
+	}
+}
+
+func TestVerifyShare(t *testing.T) {
+	group, _ := elgamal.StandardGroup(2048)
+	p, err := Deal(group, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitments := p.Commitments()
+
+	tests := []struct {
+		name  string
+		index int
+		share *big.Int
+		valid bool
+	}{
+		{"honest", 2, p.Share(2), true},
+		{"tampered", 2, new(big.Int).Add(p.Share(2), big.NewInt(1)), false},
+		{"dealt to another trustee", 2, p.Share(3), false},
+		{"out of range", 2, new(big.Int).Add(p.Share(2), group.Q), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if VerifyShare(group, commitments, test.index, test.share) != test.valid {
+				t.Errorf("expected valid = %v", test.valid)
+			}
+		})
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"net"
 )
 
-const BUFFERSIZE = 10240
+// Largest payload of a UDP datagram: ciphertexts under keys of secure sizes are several kilobytes
+const BUFFERSIZE = 65507
 
 // Wrapper type that represents a UDP address
 type UDPAddr struct {
@@ -69,13 +70,15 @@ func NewServer(addr string) *Server {
 
 func (s *Server) Listen() {
 	// Put incoming messages in the ingress channel
+	buffer := make([]byte, BUFFERSIZE)
 	for {
-		buffer := make([]byte, BUFFERSIZE)
 		n, addr, err := s.conn.ReadFromUDP(buffer)
 		if err != nil {
 			fmt.Printf("ERROR when reading from connection: %v", err)
 		}
-		s.ingress <- &RawPacket{UDPAddr{addr.String()}, buffer[:n]}
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		s.ingress <- &RawPacket{UDPAddr{addr.String()}, data}
 	}
 }
 
@@ -83,6 +86,10 @@ func (s *Server) Talk() {
 	// Send outgoing messages through the UDP socket
 	for {
 		data := <-s.outgress
+		if len(data.Data) > BUFFERSIZE {
+			fmt.Printf("ERROR packet of %v bytes is too large to send over UDP\n", len(data.Data))
+			continue
+		}
 		_, err := s.conn.WriteToUDP(data.Data, data.Addr.Resolve())
 		if err != nil {
 			panic(fmt.Sprintf("ERROR could not send bytes over UDP: %v", err))
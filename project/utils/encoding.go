@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// Canonical binary encoding of blocks and transactions, which is what gets hashed.
+// Every value is written with a fixed size or a length prefix, so two different values never
+// have the same encoding
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+// The zero time (no opening or deadline) is encoded differently from every other time
+func (e *encoder) time(t time.Time) {
+	e.bool(!t.IsZero())
+	if !t.IsZero() {
+		e.int64(t.UnixNano())
+	}
+}
+
+func (e *encoder) byteSlices(v [][]byte) {
+	e.uint32(uint32(len(v)))
+	for _, b := range v {
+		e.bytes(b)
+	}
+}
+
+func (e *encoder) strings(v []string) {
+	e.uint32(uint32(len(v)))
+	for _, s := range v {
+		e.string(s)
+	}
+}
+
+func (e *encoder) keyDealing(d *KeyDealing) {
+	e.bool(d != nil && d.Dealing != nil)
+	if d != nil && d.Dealing != nil {
+		e.string(d.Dealing.Session)
+		e.bytes(d.Dealing.Poll)
+		e.strings(d.Dealing.Trustees)
+		e.uint32(d.Dealing.Index)
+		e.byteSlices(d.Dealing.Commitments)
+		e.bytes(d.Signature)
+	}
+}
+
+func (e *encoder) uint32s(v []uint32) {
+	e.uint32(uint32(len(v)))
+	for _, u := range v {
+		e.uint32(u)
+	}
+}
+
+func (e *encoder) ballotProof(p *BallotProof) {
+	e.bool(p != nil)
+	if p != nil {
+		e.byteSlices(p.Commitments)
+		e.byteSlices(p.Challenges)
+		e.byteSlices(p.Responses)
+	}
+}
+
+func (e *encoder) sum() []byte {
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+// Encoding of the header of the block, the transactions are included through their Merkle root.
+// The signature is not included: it is a signature over the hash
+func (b *Block) EncodeHeader() []byte {
+	e := &encoder{}
+	e.uint32(b.ID)
+	e.time(b.Timestamp)
+	e.int64(int64(b.Difficulty))
+	e.string(b.Origin)
+	e.string(b.Nonce)
+	e.string(b.PrevHash)
+	e.bytes(b.MerkleRoot)
+	e.bool(b.Config != nil)
+	if b.Config != nil {
+		e.string(b.Config.NetworkID)
+		e.uint32(b.Config.InitialDifficulty)
+		e.uint32(b.Config.RSAKeyBits)
+		e.uint32(b.Config.ElGamalKeyBits)
+		e.string(b.Config.Consensus)
+		e.strings(b.Config.Signers)
+		e.strings(b.Config.Validators)
+	}
+	return e.buf
+}
+
+// Hash of the block, as a hex string
+func (b *Block) CalculateHash() string {
+	hash := sha256.Sum256(b.EncodeHeader())
+	return hex.EncodeToString(hash[:])
+}
+
+// The hashes of the transactions below cover everything except the ID, which the miner assigns:
+// the hash of a transaction is known before it is in a block
+
+func (tx *VoteTx) Hash() []byte {
+	e := &encoder{}
+	e.bool(tx.Vote != nil)
+	if tx.Vote != nil {
+		e.string(tx.Vote.Origin)
+		e.uint32(tx.Vote.PollID)
+		e.byteSlices(tx.Vote.Vote)
+	}
+	e.bytes(tx.Signature)
+	e.uint32(uint32(len(tx.Proofs)))
+	for _, proof := range tx.Proofs {
+		e.ballotProof(proof)
+	}
+	e.uint32(uint32(len(tx.SumProofs)))
+	for _, proof := range tx.SumProofs {
+		e.ballotProof(proof)
+	}
+	return e.sum()
+}
+
+func (tx *RevoteTx) Hash() []byte {
+	e := &encoder{}
+	e.bool(tx.Revote != nil && tx.Revote.Vote != nil)
+	if tx.Revote != nil && tx.Revote.Vote != nil {
+		e.string(tx.Revote.Vote.Origin)
+		e.uint32(tx.Revote.Vote.PollID)
+		e.byteSlices(tx.Revote.Vote.Vote)
+		e.bytes(tx.Revote.Supersedes)
+	}
+	e.bytes(tx.Signature)
+	e.uint32(uint32(len(tx.Proofs)))
+	for _, proof := range tx.Proofs {
+		e.ballotProof(proof)
+	}
+	e.uint32(uint32(len(tx.SumProofs)))
+	for _, proof := range tx.SumProofs {
+		e.ballotProof(proof)
+	}
+	return e.sum()
+}
+
+func (tx *DelegationTx) Hash() []byte {
+	e := &encoder{}
+	e.bool(tx.Delegation != nil)
+	if d := tx.Delegation; d != nil {
+		e.string(d.Origin)
+		e.string(d.Delegate)
+		e.uint32(d.PollID)
+		e.string(d.Creator)
+		e.bytes(d.Supersedes)
+	}
+	e.bytes(tx.Signature)
+	return e.sum()
+}
+
+// Hash of the terms of the poll: everything but its key, which the trustees generate for these terms
+func (poll *Poll) TermsHash() []byte {
+	e := &encoder{}
+	e.string(poll.Origin)
+	e.uint32(poll.Id)
+	e.string(poll.Question)
+	e.strings(poll.Voters)
+	e.uint32s(poll.Weights)
+	e.time(poll.Opening)
+	e.time(poll.Deadline)
+	e.strings(poll.Trustees)
+	e.uint32(poll.Threshold)
+	e.strings(poll.Options)
+	e.string(poll.BallotType)
+	return e.sum()
+}
+
+func (tx *PollTx) Hash() []byte {
+	e := &encoder{}
+	e.bool(tx.Poll != nil)
+	if poll := tx.Poll; poll != nil {
+		e.string(poll.Origin)
+		e.uint32(poll.Id)
+		e.string(poll.Question)
+		e.strings(poll.Voters)
+		e.uint32s(poll.Weights)
+		e.time(poll.Opening)
+		e.time(poll.Deadline)
+		e.bytes(poll.PublicKey)
+		e.strings(poll.Trustees)
+		e.uint32(poll.Threshold)
+		e.strings(poll.Options)
+		e.string(poll.BallotType)
+		e.uint32(uint32(len(poll.Dealings)))
+		for _, d := range poll.Dealings {
+			e.keyDealing(d)
+		}
+		e.byteSlices(poll.VerificationKeys)
+	}
+	e.bytes(tx.Signature)
+	return e.sum()
+}
+
+func (tx *RegisterTx) Hash() []byte {
+	e := &encoder{}
+	e.bool(tx.Registry != nil)
+	if tx.Registry != nil {
+		e.string(tx.Registry.Origin)
+		e.bytes(tx.Registry.PublicKey.N)
+		e.int64(int64(tx.Registry.PublicKey.E))
+	}
+	return e.sum()
+}
+
+func (tx *ResultTx) Hash() []byte {
+	e := &encoder{}
+	e.bool(tx.Result != nil)
+	if result := tx.Result; result != nil {
+		e.uint32(uint32(len(result.Counts)))
+		for _, count := range result.Counts {
+			e.int64(count)
+		}
+		e.uint32(result.PollId)
+		e.time(result.Timestamp)
+		e.uint32(uint32(len(result.Tallies)))
+		for _, tally := range result.Tallies {
+			e.bool(tally != nil)
+			if tally == nil {
+				continue
+			}
+			e.bytes(tally.Aggregate)
+			e.uint32(uint32(len(tally.Decryption)))
+			for _, share := range tally.Decryption {
+				e.bool(share != nil)
+				if share == nil {
+					continue
+				}
+				e.uint32(share.Index)
+				e.bytes(share.Partial)
+				e.bool(share.Proof != nil)
+				if share.Proof != nil {
+					e.bytes(share.Proof.A)
+					e.bytes(share.Proof.B)
+					e.bytes(share.Proof.Z)
+				}
+			}
+		}
+	}
+	return e.sum()
+}
+
+// Hash that the validator signs, everything except the ID the rumorer assigns
+func (v *FinalityVote) Hash() []byte {
+	e := &encoder{}
+	e.string(v.Origin)
+	e.string(v.Type)
+	e.uint32(v.Height)
+	e.string(v.BlockHash)
+	return e.sum()
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Kinds of transactions, part of the leaves of the Merkle tree so a transaction of one kind can't
+// be passed off as one of another kind
+const (
+	VoteLeaf       byte = 1
+	PollLeaf       byte = 2
+	RegisterLeaf   byte = 3
+	ResultLeaf     byte = 4
+	RevoteLeaf     byte = 5
+	DelegationLeaf byte = 6
+)
+
+// Proof that a leaf is in the Merkle tree with a given root: the hashes of the siblings on the path
+// from the leaf to the root. Where a node has no sibling (the last node of a level with an odd
+// number of nodes), it moves up a level unchanged
+type MerkleProof struct {
+	Index     uint32 // Position of the leaf
+	NumLeaves uint32
+	Siblings  [][]byte
+}
+
+// Leaf of the Merkle tree for a transaction with the given ID and hash.
+// Leaves and inner nodes are hashed with a different prefix, so an inner node can't be a leaf
+func MerkleLeaf(kind byte, id uint32, txHash []byte) []byte {
+	e := &encoder{buf: []byte{0, kind}}
+	e.uint32(id)
+	e.bytes(txHash)
+	return e.sum()
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Hash the nodes of a level of the tree pairwise, a last node without sibling moves up unchanged
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+// Leaves of all transactions: the votes, polls, registrations, results, revotes and delegations,
+// in the order of the block
+func (tx Transactions) Leaves() [][]byte {
+	leaves := make([][]byte, 0, len(tx.Votes)+len(tx.Polls)+len(tx.Registers)+len(tx.Results)+len(tx.Revotes)+
+		len(tx.Delegations))
+	for _, vote := range tx.Votes {
+		leaves = append(leaves, MerkleLeaf(VoteLeaf, vote.ID, vote.Hash()))
+	}
+	for _, poll := range tx.Polls {
+		leaves = append(leaves, MerkleLeaf(PollLeaf, poll.ID, poll.Hash()))
+	}
+	for _, register := range tx.Registers {
+		leaves = append(leaves, MerkleLeaf(RegisterLeaf, register.ID, register.Hash()))
+	}
+	for _, result := range tx.Results {
+		leaves = append(leaves, MerkleLeaf(ResultLeaf, result.ID, result.Hash()))
+	}
+	for _, revote := range tx.Revotes {
+		leaves = append(leaves, MerkleLeaf(RevoteLeaf, revote.ID, revote.Hash()))
+	}
+	for _, delegation := range tx.Delegations {
+		leaves = append(leaves, MerkleLeaf(DelegationLeaf, delegation.ID, delegation.Hash()))
+	}
+	return leaves
+}
+
+func (tx Transactions) MerkleRoot() []byte {
+	return MerkleRoot(tx.Leaves())
+}
+
+// Root of the Merkle tree over leaves, the hash of nothing if there are no leaves
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+// Proof that leaves[index] is in the Merkle tree over leaves, nil if index is out of range
+func NewMerkleProof(leaves [][]byte, index int) *MerkleProof {
+	if index < 0 || index >= len(leaves) {
+		return nil
+	}
+	proof := &MerkleProof{
+		Index:     uint32(index),
+		NumLeaves: uint32(len(leaves)),
+		Siblings:  make([][]byte, 0),
+	}
+	level := leaves
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+	return proof
+}
+
+// Whether the proof shows that leaf is in the Merkle tree with the given root
+func (p *MerkleProof) Verify(leaf []byte, root []byte) bool {
+	if p == nil || p.Index >= p.NumLeaves {
+		return false
+	}
+	hash := leaf
+	index, size := p.Index, p.NumLeaves
+	siblings := p.Siblings
+	for size > 1 {
+		if sibling := index ^ 1; sibling < size {
+			if len(siblings) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				hash = merkleNode(hash, siblings[0])
+			} else {
+				hash = merkleNode(siblings[0], hash)
+			}
+			siblings = siblings[1:]
+		}
+		index /= 2
+		size = (size + 1) / 2
+	}
+	return len(siblings) == 0 && bytes.Equal(hash, root)
+}
+
+// Proof that a transaction is in a block: the header of the block, and the path from the leaf of
+// the transaction to the Merkle root in the header
+type InclusionProof struct {
+	Header *Block // The block without its transactions
+	Kind   byte   // Kind of transaction, VoteLeaf to DelegationLeaf
+	TxID   uint32
+	TxHash []byte
+	Proof  *MerkleProof
+}
+
+// Whether the transaction is in the block of the header. This does not check whether the block is
+// on the main chain, only that the header has a valid hash
+func (p *InclusionProof) Verify() bool {
+	if p.Header == nil || p.Header.CalculateHash() != p.Header.Hash {
+		return false
+	}
+	return p.Proof.Verify(MerkleLeaf(p.Kind, p.TxID, p.TxHash), p.Header.MerkleRoot)
+}
+
+// Lifecycle of a transaction
+const (
+	TxUnknown  = "unknown"  // Neither in the mempool nor on the main chain
+	TxPending  = "pending"  // In the mempool, waiting to be mined
+	TxIncluded = "included" // In a block of the main chain
+)
+
+// Where a transaction is, so whoever sent it can check that it counted
+type Receipt struct {
+	TxHash        string          `json:"txHash"`
+	Status        string          `json:"status"`
+	BlockID       uint32          `json:"blockId"`
+	Confirmations uint32          `json:"confirmations"` // Blocks of the main chain from the including block up to the tip
+	Final         bool            `json:"final"`         // The including block is finalized by the validators
+	Proof         *InclusionProof `json:"proof"`         // nil unless the transaction is included
+}
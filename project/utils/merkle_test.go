@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		hash := sha256.Sum256([]byte{byte(i)})
+		leaves[i] = MerkleLeaf(VoteLeaf, uint32(i), hash[:])
+	}
+	return leaves
+}
+
+// Every leaf of trees of every shape up to 9 leaves, with odd levels at different heights, has a valid proof
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := testLeaves(n)
+		root := MerkleRoot(leaves)
+		for i, leaf := range leaves {
+			if !NewMerkleProof(leaves, i).Verify(leaf, root) {
+				t.Errorf("proof of leaf %v of %v not valid", i, n)
+			}
+		}
+		if NewMerkleProof(leaves, n) != nil {
+			t.Errorf("proof of leaf %v of %v", n, n)
+		}
+	}
+}
+
+func TestMerkleProofTampered(t *testing.T) {
+	leaves := testLeaves(7)
+	root := MerkleRoot(leaves)
+
+	tests := []struct {
+		name   string
+		index  int                      // Of the proven leaf
+		tamper func(proof *MerkleProof) // Changes the proof of leaves[index]
+		leaf   []byte
+		root   []byte
+		valid  bool
+	}{
+		{"valid", 2, func(proof *MerkleProof) {}, leaves[2], root, true},
+		{"last leaf without sibling", 6, func(proof *MerkleProof) {}, leaves[6], root, true},
+		{"other leaf", 2, func(proof *MerkleProof) {}, leaves[3], root, false},
+		{"other root", 2, func(proof *MerkleProof) {}, leaves[2], MerkleRoot(leaves[:6]), false},
+		{"other index", 2, func(proof *MerkleProof) { proof.Index = 3 }, leaves[2], root, false},
+		{"index out of range", 2, func(proof *MerkleProof) { proof.Index = 7 }, leaves[2], root, false},
+		{"fewer leaves", 6, func(proof *MerkleProof) { proof.NumLeaves = 6 }, leaves[6], root, false},
+		{"missing sibling", 2, func(proof *MerkleProof) { proof.Siblings = proof.Siblings[1:] }, leaves[2], root, false},
+		{"extra sibling", 2, func(proof *MerkleProof) { proof.Siblings = append(proof.Siblings, root) }, leaves[2],
+			root, false},
+		{"changed sibling", 2, func(proof *MerkleProof) { proof.Siblings[1] = leaves[0] }, leaves[2], root, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proof := NewMerkleProof(leaves, test.index)
+			test.tamper(proof)
+			if proof.Verify(test.leaf, test.root) != test.valid {
+				t.Errorf("expected valid = %v", test.valid)
+			}
+		})
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	txs := Transactions{
+		Registers: []*RegisterTx{{ID: 0, Registry: &Registry{Origin: "alice"}}},
+		Results:   []*ResultTx{{ID: 0, Result: &Result{PollId: 1}}, {ID: 1, Result: &Result{PollId: 2}}},
+	}
+	header := &Block{ID: 1, Origin: "alice", MerkleRoot: txs.MerkleRoot()}
+	header.Hash = header.CalculateHash()
+	// The result of poll 2 is the third leaf
+	proof := func() *InclusionProof {
+		headerCopy := *header
+		return &InclusionProof{
+			Header: &headerCopy,
+			Kind:   ResultLeaf,
+			TxID:   1,
+			TxHash: txs.Results[1].Hash(),
+			Proof:  NewMerkleProof(txs.Leaves(), 2),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(proof *InclusionProof)
+		valid  bool
+	}{
+		{"valid", func(proof *InclusionProof) {}, true},
+		{"other transaction", func(proof *InclusionProof) { proof.TxHash = txs.Results[0].Hash() }, false},
+		{"other kind", func(proof *InclusionProof) { proof.Kind = VoteLeaf }, false},
+		{"other ID", func(proof *InclusionProof) { proof.TxID = 0 }, false},
+		{"header with another root", func(proof *InclusionProof) { proof.Header.MerkleRoot = proof.TxHash }, false},
+		{"header with its hash fixed", func(proof *InclusionProof) {
+			proof.Header.MerkleRoot = proof.TxHash
+			proof.Header.Hash = proof.Header.CalculateHash()
+		}, false},
+		{"no header", func(proof *InclusionProof) { proof.Header = nil }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := proof()
+			test.tamper(p)
+			if p.Verify() != test.valid {
+				t.Errorf("expected valid = %v", test.valid)
+			}
+		})
+	}
+}
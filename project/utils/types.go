@@ -1,8 +1,8 @@
 package utils
 
 import (
-	"bitbucket.org/ustraca/crypto/paillier"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/constants"
@@ -20,19 +20,35 @@ type Message struct {
 }
 
 type VotingMessage struct {
-	NewVote      *NewVote
-	NewPoll      *NewPoll
-	CountRequest *CountRequest
+	NewVote       *NewVote
+	NewPoll       *NewPoll
+	CountRequest  *CountRequest
+	NewDelegation *NewDelegation
 }
 
 type NewVote struct {
-	Pollid uint32
-	Vote   bool
+	Pollid  uint32
+	Vote    bool     // Vote on a yes/no poll
+	Choices []uint32 // Indices of the chosen options, from most to least preferred for ranked polls
+}
+
+// Delegate our vote on a poll, or on all polls of Creator if it is not empty. An empty Delegate revokes the delegation
+type NewDelegation struct {
+	Delegate string
+	Pollid   uint32
+	Creator  string
 }
 
 type NewPoll struct {
-	Question string
-	Voters   []string
+	Question   string
+	Voters     []string
+	Weights    []uint32  // Weight of every voter, all voters have weight 1 if empty
+	Trustees   []string  // Trustees that get a share of the decryption key, the creator if empty
+	Threshold  uint32    // Number of trustees needed to decrypt
+	Options    []string  // Empty for a yes/no question
+	BallotType string    // See package ballot
+	Opening    time.Time // Votes are accepted from Opening until Deadline, zero for no limit
+	Deadline   time.Time
 }
 
 type CountRequest struct {
@@ -62,63 +78,151 @@ type StatusPacket struct {
 	Want []PeerStatus
 }
 
-/****************************** Blockchain types ******************************/
-type Block struct {
-	ID             uint32
-	Timestamp      time.Time
-	Transactions   Transactions
-	PaillierPublic paillier.PublicKey
-	Difficulty     int
-	Origin         string
-	Nonce          string
-	PrevHash       string
-	Hash           string
-}
-
-// Convert the fields of the block to a string representation, allowing us to hash it
-func (b Block) ToString() string {
-	//str := ""
-	//str = fmt.Sprint(b.ID, b.Timestamp.String(), b.Difficulty, b.Transactions.ToString(), b.PaillierPublic.N.String(),
-	//	b.PaillierPublic.G.String(), b.PrevHash, b.Nonce)
-	str := fmt.Sprint(b.Nonce, b.Origin, b.Difficulty, b.ID, b.PrevHash, b.Transactions.ToString(), b.PaillierPublic.N.String(),
-		b.PaillierPublic.G.String())
-	return str
+// Request of the creator of a poll to a trustee to take part in the generation of the key of the poll
+type KeyGenRequest struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Session     string // Identifies the key generation
+	Poll        *Poll  // Terms of the poll, without its key. Trustee i deals with index i+1
 }
 
-// Transactions that happened since last Block
-type Transactions struct {
-	Votes     []*VoteTx
-	Polls     []*PollTx
-	Registers []*RegisterTx
-	Results   []*ResultTx
+// Signed dealing of a trustee, sent to the creator of the poll
+type DealingMessage struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Dealing     *KeyDealing
 }
 
-// Helper function to convert transactions to string
-func (tx Transactions) ToString() string {
-	str := ""
-	for _, vote := range tx.Votes {
-		str += fmt.Sprint(vote.ID, vote.Vote.Origin, vote.Vote.PollID, hex.EncodeToString(vote.Vote.Vote))
-	}
-	for _, poll := range tx.Polls {
-		str += fmt.Sprint(poll.ID, poll.Poll.Origin, poll.Poll.Question)
-		for _, voter := range poll.Poll.Voters {
-			str += fmt.Sprint(voter)
-		}
-	}
-	// TODO: Registers
-	return str
+// Value dealt by a trustee to another trustee, encrypted for the trustee it is sent to
+type KeyShareMessage struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Session     string
+	Dealing     *KeyDealing // The dealing the value has to match
+	SealedKey   []byte      // AES key, encrypted with RSA-OAEP for the trustee
+	SealedShare []byte      // Dealt value, encrypted with AES-GCM
 }
 
-type SerializablePaillierPubKey struct {
-	N []byte
-	G []byte
+// Sent by a trustee to the creator of the poll once it checked the values dealt to it, and to every dealer
+// it complains about: that dealer has to reveal the value it dealt to the trustee
+type KeyGenComplaint struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Session     string
+	Index       uint32   // Of the trustee that checked the values
+	Against     []uint32 // Indices of the dealers of which the trustee got no valid value
 }
 
-func (s *SerializablePaillierPubKey) ToPaillier() paillier.PublicKey {
-	return paillier.PublicKey{
-		N: (&big.Int{}).SetBytes(s.N),
-		G: (&big.Int{}).SetBytes(s.G),
-	}
+// Value a dealer reveals to the creator of the poll after a complaint, dealers that don't are disqualified
+type KeyGenReveal struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Session     string
+	Index       uint32 // Of the dealer
+	Trustee     uint32 // Index of the trustee that complained
+	Value       []byte
+}
+
+// Qualified dealings of a key generation, signed by the creator of the poll
+type KeyGenOutcome struct {
+	Session  string
+	Dealings []*KeyDealing // By increasing index of the dealer
+}
+
+// Sent by the creator of the poll to every trustee, which computes its key share from the qualified dealings
+type KeyGenResult struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Outcome     *KeyGenOutcome
+	Signature   []byte   // Of the creator over Outcome
+	Revealed    [][]byte // Values revealed for the trustee, in the order of Outcome.Dealings, empty if not revealed
+}
+
+// Request to a trustee to partially decrypt the aggregated votes of a poll
+type DecryptionRequest struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	PollID      uint32
+	Aggregates  [][]byte // Product of every entry of the encrypted votes, trustees only decrypt them if their chain agrees
+	Signature   []byte   // Of the creator of the poll over Authorization(), only needed for polls without deadline
+}
+
+// What the creator of a poll without deadline signs to close it
+type DecryptionAuthorization struct {
+	PollID     uint32
+	Aggregates [][]byte
+}
+
+func (r *DecryptionRequest) Authorization() *DecryptionAuthorization {
+	return &DecryptionAuthorization{PollID: r.PollID, Aggregates: r.Aggregates}
+}
+
+// Partial decryption of the aggregated votes of a poll by a trustee
+type PartialDecryption struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	PollID      uint32
+	Aggregates  [][]byte           // The aggregates that were decrypted
+	Shares      []*DecryptionShare // Partial decryption of every aggregate
+}
+
+// Partial decryption by trustee Index, with a proof that it used its key share
+type DecryptionShare struct {
+	Index   uint32
+	Partial []byte
+	Proof   *DecryptionProof
+}
+
+// Proof that the discrete log of Partial in base A (of the ciphertext) equals the discrete log of the
+// verification key of the trustee in base g
+type DecryptionProof struct {
+	A []byte // A^r
+	B []byte // g^r
+	Z []byte // r + challenge * share
+}
+
+/****************************** Blockchain types ******************************/
+// Parameters of the network, recorded in the genesis block
+type ChainConfig struct {
+	NetworkID         string   // Nodes only talk to nodes of the same network
+	InitialDifficulty uint32   // Difficulty of the first blocks with proof-of-work
+	RSAKeyBits        uint32   // Minimum size of the RSA keys users register with
+	ElGamalKeyBits    uint32   // Minimum size of the group of the ElGamal keys of polls
+	Consensus         string   // "pow" (proof-of-work, also if empty) or "poa" (proof-of-authority)
+	Signers           []string // Registered users that take turns signing blocks with proof-of-authority
+	Validators        []string // Registered users that finalize blocks, no finality if empty
+}
+
+type Block struct {
+	ID           uint32
+	Timestamp    time.Time
+	Transactions Transactions
+	Difficulty   int
+	Origin       string
+	Nonce        string
+	PrevHash     string
+	MerkleRoot   []byte // Root of the Merkle tree over the transactions
+	Hash         string
+	Signature    []byte       // Signature over Hash by Origin, for proof-of-authority
+	Config       *ChainConfig // Only set in the genesis block
+}
+
+// Transactions that happened since last Block
+type Transactions struct {
+	Votes       []*VoteTx
+	Polls       []*PollTx
+	Registers   []*RegisterTx
+	Results     []*ResultTx
+	Revotes     []*RevoteTx
+	Delegations []*DelegationTx
 }
 
 type SerializableRSAPubKey struct {
@@ -137,9 +241,50 @@ type Poll struct {
 	Origin    string
 	Id        uint32
 	Question  string
-	Voters    []string // Hashes of Sciper numbers of people who are allowed to vote
+	Voters    []string  // Hashes of Sciper numbers of people who are allowed to vote
+	Weights   []uint32  // Weight of the ballot of every voter, in the order of Voters. All weights are 1 if empty
+	Opening   time.Time // Votes are accepted from Opening until Deadline (by block timestamp), zero for no limit
 	Deadline  time.Time
-	PublicKey SerializablePaillierPubKey
+	PublicKey []byte   // ElGamal public key, generated by the trustees
+	Trustees  []string // Trustee i holds key share i+1
+	Threshold uint32   // Number of trustees needed to decrypt
+
+	Options    []string // Empty for a yes/no question
+	BallotType string   // See package ballot
+
+	Dealings         []*KeyDealing // Dealings of the qualified trustees in the generation of the key, by index
+	VerificationKeys [][]byte      // Verification key of every trustee, to check their partial decryptions
+}
+
+// Public part of the dealing of a trustee in the generation of the key of a poll, see package threshold
+type Dealing struct {
+	Session     string
+	Poll        []byte // TermsHash of the poll, so the dealing can't be used for another poll
+	Trustees    []string
+	Index       uint32   // Index of the dealer, trustee Index-1
+	Commitments [][]byte // Commitments to the coefficients of the secret polynomial of the dealer
+}
+
+// Dealing, signed by the trustee that dealt it
+type KeyDealing struct {
+	Dealing   *Dealing
+	Signature []byte
+}
+
+// Identifies the poll before it gets an ID in the blockchain: the hash of its public key
+func (poll *Poll) KeyID() string {
+	hash := sha256.Sum256(poll.PublicKey)
+	return hex.EncodeToString(hash[:])
+}
+
+// Whether votes are accepted at time t
+func (poll *Poll) IsOpen(t time.Time) bool {
+	return (poll.Opening.IsZero() || !t.Before(poll.Opening)) && (poll.Deadline.IsZero() || !t.After(poll.Deadline))
+}
+
+// Whether the deadline of the poll passed at time t, polls without deadline are never closed
+func (poll *Poll) IsClosed(t time.Time) bool {
+	return !poll.Deadline.IsZero() && t.After(poll.Deadline)
 }
 
 func (poll *Poll) IsEqual(poll2 *Poll) bool {
@@ -155,7 +300,7 @@ func (poll *Poll) IsEqual(poll2 *Poll) bool {
 type EncryptedVote struct {
 	Origin string
 	PollID uint32
-	Vote   []byte
+	Vote   [][]byte // Every entry of the ballot, encrypted separately
 }
 
 type Registry struct {
@@ -168,6 +313,49 @@ type VoteTx struct {
 	ID        uint32
 	Vote      *EncryptedVote
 	Signature []byte
+	Proofs    []*BallotProof // Proof that every entry of the encrypted vote is 0 or 1
+	SumProofs []*BallotProof // Proof that exactly one entry of every group of ballot.OneHotGroups is 1
+}
+
+// Ballot that replaces the last ballot of a voter on a poll, only the last ballot of every voter is counted
+type RevoteTx struct {
+	ID        uint32
+	Revote    *Revote
+	Signature []byte
+	Proofs    []*BallotProof
+	SumProofs []*BallotProof
+}
+
+// The signed part of a RevoteTx. Supersedes is the hash of the ballot it replaces, so the revotes of a voter
+// form a chain and an earlier ballot can't be replayed to replace a later one
+type Revote struct {
+	Vote       *EncryptedVote
+	Supersedes []byte
+}
+
+// Delegation of the vote of Origin to Delegate, on one poll or on all polls of a creator. The delegate's ballot
+// counts for the voters that delegated to them, directly or through delegates that didn't vote.
+// A delegation replaces the earlier delegation of Origin with the same scope, a delegation to nobody revokes it
+type Delegation struct {
+	Origin     string
+	Delegate   string // Empty to revoke the delegation
+	PollID     uint32 // Poll of the delegation, if Creator is empty
+	Creator    string // If not empty, the delegation is for all polls of Creator, also future ones
+	Supersedes []byte // Hash of the delegation it replaces, so an earlier delegation can't be replayed
+}
+
+type DelegationTx struct {
+	ID         uint32
+	Delegation *Delegation
+	Signature  []byte
+}
+
+// Non-interactive zero-knowledge proof that an ElGamal ciphertext encrypts one of a set of allowed values,
+// with two commitments, a challenge and a response for every allowed value
+type BallotProof struct {
+	Commitments [][]byte
+	Challenges  [][]byte
+	Responses   [][]byte
 }
 
 // New poll added, finder of block assigns the unique pollID
@@ -190,9 +378,15 @@ type ResultTx struct {
 }
 
 type Result struct {
-	Count     int64
+	Counts    []int64 // Number of votes for every entry of the ballot
 	PollId    uint32
 	Timestamp time.Time
+	Tallies   []*Tally // Verifiable decryption of every entry of Counts
+}
+
+type Tally struct {
+	Aggregate  []byte             // Product of an entry of all encrypted votes, of which the count is the decryption
+	Decryption []*DecryptionShare // Threshold partial decryptions of Aggregate, so anyone can verify the count
 }
 
 /******************************************************************************/
@@ -203,15 +397,30 @@ type GossipPacket struct {
 	Private         *PrivateMessage
 	Transaction     *Transaction
 	MongerableBlock *MongerableBlock
+	BlockRequest    *BlockRequest
+	BlockResponse   *BlockResponse
+	FinalityVote    *FinalityVote
+	Handshake       *Handshake
+
+	KeyGenRequest     *KeyGenRequest
+	Dealing           *DealingMessage
+	KeyShare          *KeyShareMessage
+	KeyGenComplaint   *KeyGenComplaint
+	KeyGenReveal      *KeyGenReveal
+	KeyGenResult      *KeyGenResult
+	DecryptionRequest *DecryptionRequest
+	PartialDecryption *PartialDecryption
 }
 
 type Transaction struct {
-	Origin     string
-	ID         uint32
-	VoteTx     *VoteTx
-	PollTx     *PollTx
-	RegisterTx *RegisterTx
-	ResultTx   *ResultTx
+	Origin       string
+	ID           uint32
+	VoteTx       *VoteTx
+	PollTx       *PollTx
+	RegisterTx   *RegisterTx
+	ResultTx     *ResultTx
+	RevoteTx     *RevoteTx
+	DelegationTx *DelegationTx
 }
 
 type MongerableBlock struct {
@@ -220,6 +429,44 @@ type MongerableBlock struct {
 	Block  *Block
 }
 
+// Request for the blocks that follow the most recent block in Locator the receiver knows of
+type BlockRequest struct {
+	Origin  string
+	Locator []string // Hashes of blocks on the main chain of the requester, from tip to genesis
+}
+
+// Answer to a BlockRequest, every block is sent in a separate response
+type BlockResponse struct {
+	Origin string
+	Block  *Block
+	Height uint32 // Length of the main chain of the sender
+	Last   bool   // Last block the sender will send for this request
+}
+
+// First message between two peers: they only gossip with each other if they have the same genesis block
+type Handshake struct {
+	Origin      string
+	NetworkID   string
+	GenesisHash string
+	Reply       bool // Answer to the handshake of the receiver
+}
+
+// Kinds of finality votes
+const (
+	Prevote   = "prevote"
+	Precommit = "precommit"
+)
+
+// Vote of a validator for the block at Height, see blockchain.Finalizer
+type FinalityVote struct {
+	Origin    string
+	ID        uint32
+	Type      string // Prevote or Precommit
+	Height    uint32
+	BlockHash string
+	Signature []byte // Over Hash(), with the registered key of Origin
+}
+
 type AddrGossipPacket struct {
 	Address UDPAddr
 	Gossip  *GossipPacket
@@ -230,7 +477,7 @@ type Messages struct {
 }
 
 // Messages that can be directly sent from peer to peer:
-// PrivateMessages
+// PrivateMessages, the messages of the key generation, DecryptionRequests and PartialDecryptions
 type PointToPointMessage interface {
 	GetOrigin() string
 	GetDestination() string
@@ -247,10 +494,82 @@ func (p *PrivateMessage) HopIsZero() bool         { return p.HopLimit == 0 }
 func (p *PrivateMessage) DecrHopLimit()           { p.HopLimit -= 1 }
 func (p *PrivateMessage) ToGossip() *GossipPacket { return &GossipPacket{Private: p} }
 
+// Implement the point to point interface for KeyGenRequest
+func (k *KeyGenRequest) GetOrigin() string       { return k.Origin }
+func (k *KeyGenRequest) GetDestination() string  { return k.Destination }
+func (k *KeyGenRequest) HopIsZero() bool         { return k.HopLimit == 0 }
+func (k *KeyGenRequest) DecrHopLimit()           { k.HopLimit -= 1 }
+func (k *KeyGenRequest) ToGossip() *GossipPacket { return &GossipPacket{KeyGenRequest: k} }
+
+// Implement the point to point interface for DealingMessage
+func (d *DealingMessage) GetOrigin() string       { return d.Origin }
+func (d *DealingMessage) GetDestination() string  { return d.Destination }
+func (d *DealingMessage) HopIsZero() bool         { return d.HopLimit == 0 }
+func (d *DealingMessage) DecrHopLimit()           { d.HopLimit -= 1 }
+func (d *DealingMessage) ToGossip() *GossipPacket { return &GossipPacket{Dealing: d} }
+
+// Implement the point to point interface for KeyShareMessage
+func (k *KeyShareMessage) GetOrigin() string       { return k.Origin }
+func (k *KeyShareMessage) GetDestination() string  { return k.Destination }
+func (k *KeyShareMessage) HopIsZero() bool         { return k.HopLimit == 0 }
+func (k *KeyShareMessage) DecrHopLimit()           { k.HopLimit -= 1 }
+func (k *KeyShareMessage) ToGossip() *GossipPacket { return &GossipPacket{KeyShare: k} }
+
+// Implement the point to point interface for KeyGenComplaint
+func (k *KeyGenComplaint) GetOrigin() string       { return k.Origin }
+func (k *KeyGenComplaint) GetDestination() string  { return k.Destination }
+func (k *KeyGenComplaint) HopIsZero() bool         { return k.HopLimit == 0 }
+func (k *KeyGenComplaint) DecrHopLimit()           { k.HopLimit -= 1 }
+func (k *KeyGenComplaint) ToGossip() *GossipPacket { return &GossipPacket{KeyGenComplaint: k} }
+
+// Implement the point to point interface for KeyGenReveal
+func (k *KeyGenReveal) GetOrigin() string       { return k.Origin }
+func (k *KeyGenReveal) GetDestination() string  { return k.Destination }
+func (k *KeyGenReveal) HopIsZero() bool         { return k.HopLimit == 0 }
+func (k *KeyGenReveal) DecrHopLimit()           { k.HopLimit -= 1 }
+func (k *KeyGenReveal) ToGossip() *GossipPacket { return &GossipPacket{KeyGenReveal: k} }
+
+// Implement the point to point interface for KeyGenResult
+func (k *KeyGenResult) GetOrigin() string       { return k.Origin }
+func (k *KeyGenResult) GetDestination() string  { return k.Destination }
+func (k *KeyGenResult) HopIsZero() bool         { return k.HopLimit == 0 }
+func (k *KeyGenResult) DecrHopLimit()           { k.HopLimit -= 1 }
+func (k *KeyGenResult) ToGossip() *GossipPacket { return &GossipPacket{KeyGenResult: k} }
+
+// Implement the point to point interface for DecryptionRequest
+func (d *DecryptionRequest) GetOrigin() string       { return d.Origin }
+func (d *DecryptionRequest) GetDestination() string  { return d.Destination }
+func (d *DecryptionRequest) HopIsZero() bool         { return d.HopLimit == 0 }
+func (d *DecryptionRequest) DecrHopLimit()           { d.HopLimit -= 1 }
+func (d *DecryptionRequest) ToGossip() *GossipPacket { return &GossipPacket{DecryptionRequest: d} }
+
+// Implement the point to point interface for PartialDecryption
+func (p *PartialDecryption) GetOrigin() string       { return p.Origin }
+func (p *PartialDecryption) GetDestination() string  { return p.Destination }
+func (p *PartialDecryption) HopIsZero() bool         { return p.HopLimit == 0 }
+func (p *PartialDecryption) DecrHopLimit()           { p.HopLimit -= 1 }
+func (p *PartialDecryption) ToGossip() *GossipPacket { return &GossipPacket{PartialDecryption: p} }
+
 // Get point to point message from GossipPacket
 func (g *GossipPacket) ToP2PMessage() PointToPointMessage {
 	if g.Private != nil {
 		return g.Private
+	} else if g.KeyGenRequest != nil {
+		return g.KeyGenRequest
+	} else if g.Dealing != nil {
+		return g.Dealing
+	} else if g.KeyShare != nil {
+		return g.KeyShare
+	} else if g.KeyGenComplaint != nil {
+		return g.KeyGenComplaint
+	} else if g.KeyGenReveal != nil {
+		return g.KeyGenReveal
+	} else if g.KeyGenResult != nil {
+		return g.KeyGenResult
+	} else if g.DecryptionRequest != nil {
+		return g.DecryptionRequest
+	} else if g.PartialDecryption != nil {
+		return g.PartialDecryption
 	} else {
 		return nil
 	}
@@ -283,6 +602,12 @@ func (b *MongerableBlock) GetID() uint32           { return b.ID }
 func (b *MongerableBlock) SetID(id uint32)         { b.ID = id }
 func (b *MongerableBlock) ToGossip() *GossipPacket { return &GossipPacket{MongerableBlock: b} }
 
+// Implement the MongerableMessage interface for FinalityVote
+func (v *FinalityVote) GetOrigin() string       { return v.Origin }
+func (v *FinalityVote) GetID() uint32           { return v.ID }
+func (v *FinalityVote) SetID(id uint32)         { v.ID = id }
+func (v *FinalityVote) ToGossip() *GossipPacket { return &GossipPacket{FinalityVote: v} }
+
 // Get MongerableMessage from GossipPacket
 func (g *GossipPacket) ToMongerableMessage() MongerableMessage {
 	if g.Rumor != nil {
@@ -291,6 +616,8 @@ func (g *GossipPacket) ToMongerableMessage() MongerableMessage {
 		return g.Transaction
 	} else if g.MongerableBlock != nil {
 		return g.MongerableBlock
+	} else if g.FinalityVote != nil {
+		return g.FinalityVote
 	} else {
 		return nil
 	}
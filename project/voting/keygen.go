@@ -0,0 +1,617 @@
+package voting
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
+	"github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	"github.com/lukasdeloose/decentralized-voting-system/project/threshold"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+	"time"
+)
+
+// Generation of the key of a poll by its trustees (see package threshold). The creator of the poll asks every
+// trustee to deal, the trustees send the values they dealt to each other and their signed dealings to the
+// creator. Every trustee checks the values it got and reports to the creator, complaining about the dealers
+// of which it got no valid value: these have to reveal that value to the creator or are disqualified. The
+// creator sends the qualified dealings to the trustees, which compute their key share from them, and puts
+// them in the poll with the public key, so every node can check that the trustees made the key
+
+// Key generations that didn't finish in time are published with the dealers that qualified by then
+const keyGenTimeout = 30 * time.Second
+
+// Trustees complain about the dealers of which they got no valid value by then
+const complaintTimeout = 10 * time.Second
+
+// Bounds the key generations we take part in at the same time, so they can't be used to fill our memory
+const maxPendingKeyGens = 64
+
+// Complaint of a trustee about a dealer, both by index
+type complaint struct {
+	dealer  int
+	trustee int
+}
+
+// Key generation for a poll we create
+type pendingPoll struct {
+	poll        *Poll
+	terms       []byte             // TermsHash of the poll, every dealing has to be for it
+	dealings    []*KeyDealing      // Verified dealing of every trustee, nil until it arrives
+	commitments [][]*big.Int       // Commitments of the dealings
+	reported    []bool             // Whether every trustee checked the values dealt to it
+	complaints  map[complaint]bool // Complaints of which the value isn't revealed yet
+	revealed    map[complaint][]byte
+}
+
+// What we dealt in a key generation, to reveal values after complaints
+type dealtKeyGen struct {
+	creator    string
+	index      int
+	trustees   []string
+	polynomial *threshold.Polynomial
+}
+
+// Values dealt to us in a key generation we take part in as trustee
+type pendingShare struct {
+	creator   string // Empty until the request of the creator arrives
+	poll      []byte // TermsHash of the poll
+	trustees  []string
+	threshold int              // Number of commitments of every dealing
+	values    map[int]*big.Int // Verified values, by index of the dealer
+	reported  bool
+	started   time.Time
+}
+
+// Start the generation of the key of the poll, it is published once the trustees dealt and checked their values
+func (v *VoteRumorer) startKeyGen(poll *Poll) error {
+	if !DistinctStrings(poll.Trustees) {
+		return fmt.Errorf("a trustee appears twice")
+	}
+	for _, trustee := range poll.Trustees {
+		if v.blockchain.GetPublicKey(trustee) == nil {
+			return fmt.Errorf("trustee %v is not registered", trustee)
+		}
+	}
+	sessionBytes := make([]byte, 16)
+	if _, err := rand.Read(sessionBytes); err != nil {
+		return err
+	}
+	session := hex.EncodeToString(sessionBytes)
+
+	v.keyGenMutex.Lock()
+	v.pendingPolls[session] = &pendingPoll{
+		poll:        poll,
+		terms:       poll.TermsHash(),
+		dealings:    make([]*KeyDealing, len(poll.Trustees)),
+		commitments: make([][]*big.Int, len(poll.Trustees)),
+		reported:    make([]bool, len(poll.Trustees)),
+		complaints:  make(map[complaint]bool),
+		revealed:    make(map[complaint][]byte),
+	}
+	v.keyGenMutex.Unlock()
+
+	time.AfterFunc(keyGenTimeout, func() {
+		v.finishKeyGen(session, true)
+	})
+
+	// The poll gets its key once the key generation finishes
+	terms := *poll
+	for _, trustee := range poll.Trustees {
+		v.sendPrivate(&GossipPacket{KeyGenRequest: &KeyGenRequest{
+			Origin:      v.name,
+			Destination: trustee,
+			HopLimit:    v.hopLimit,
+			Session:     session,
+			Poll:        &terms,
+		}})
+	}
+	fmt.Printf("REQUESTED KEY GENERATION FOR POLL %v\n", poll.Question)
+	return nil
+}
+
+// Deal a secret for the key generation: the signed dealing goes to the creator of the poll, the values to the
+// trustees, encrypted with the public key they registered
+func (v *VoteRumorer) handleKeyGenRequest(req *KeyGenRequest) {
+	poll := req.Poll
+	index := 0
+	if poll != nil && poll.Origin == req.Origin {
+		index = indexOf(poll.Trustees, v.name)
+	}
+	if index == 0 || poll.Threshold < 1 || int(poll.Threshold) > len(poll.Trustees) ||
+		!DistinctStrings(poll.Trustees) || v.privateKey == nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] Ignoring key generation request from %v\n", req.Origin)
+		}
+		return
+	}
+
+	group := v.blockchain.Group()
+	dealing, err := threshold.Deal(group, int(poll.Threshold))
+	if err != nil {
+		fmt.Printf("ERROR: could not deal: %v\n", err)
+		return
+	}
+	terms := poll.TermsHash()
+
+	// We deal only once per key generation
+	v.keyGenMutex.Lock()
+	if v.dealt[req.Session] != nil {
+		v.keyGenMutex.Unlock()
+		return
+	}
+	pending, err := v.pendingShareFor(req.Session, terms, poll.Trustees, int(poll.Threshold))
+	if err != nil {
+		v.keyGenMutex.Unlock()
+		fmt.Printf("REFUSED KEY GENERATION FOR %v: %v\n", req.Origin, err)
+		return
+	}
+	pending.creator = req.Origin
+	complete := len(pending.values) == len(pending.trustees)
+	v.dealt[req.Session] = &dealtKeyGen{
+		creator:    req.Origin,
+		index:      index,
+		trustees:   poll.Trustees,
+		polynomial: dealing,
+	}
+	v.keyGenMutex.Unlock()
+
+	time.AfterFunc(keyGenTimeout, func() {
+		v.keyGenMutex.Lock()
+		delete(v.dealt, req.Session)
+		v.keyGenMutex.Unlock()
+	})
+	time.AfterFunc(complaintTimeout, func() {
+		v.reportValues(req.Session)
+	})
+
+	commitments := dealing.Commitments()
+	public := &Dealing{
+		Session:     req.Session,
+		Poll:        terms,
+		Trustees:    poll.Trustees,
+		Index:       uint32(index),
+		Commitments: make([][]byte, len(commitments)),
+	}
+	for i, c := range commitments {
+		public.Commitments[i] = c.Bytes()
+	}
+	signed := &KeyDealing{Dealing: public, Signature: v.sign(public)}
+
+	msgs := make([]*KeyShareMessage, len(poll.Trustees))
+	for i, trustee := range poll.Trustees {
+		pubKey := v.blockchain.GetPublicKey(trustee)
+		if pubKey == nil {
+			fmt.Printf("ERROR: trustee %v is not registered\n", trustee)
+			return
+		}
+		msg, err := sealShare(req.Session, dealing.Share(i+1), pubKey)
+		if err != nil {
+			fmt.Printf("ERROR: could not encrypt key share: %v\n", err)
+			return
+		}
+		msg.Origin = v.name
+		msg.Destination = trustee
+		msg.HopLimit = v.hopLimit
+		msg.Dealing = signed
+		msgs[i] = msg
+	}
+
+	v.sendPrivate(&GossipPacket{Dealing: &DealingMessage{
+		Origin:      v.name,
+		Destination: req.Origin,
+		HopLimit:    v.hopLimit,
+		Dealing:     signed,
+	}})
+	for _, msg := range msgs {
+		v.sendPrivate(&GossipPacket{KeyShare: msg})
+	}
+	fmt.Printf("DEALT KEY SHARES AS TRUSTEE %v FOR %v\n", index, req.Origin)
+
+	// The values of the other trustees may have arrived before the request
+	if complete {
+		v.reportValues(req.Session)
+	}
+}
+
+// Our key generation of the session as trustee, created if it is the first message of the session.
+// The caller holds keyGenMutex
+func (v *VoteRumorer) pendingShareFor(session string, poll []byte, trustees []string, t int) (*pendingShare, error) {
+	pending, exists := v.pendingShares[session]
+	if !exists {
+		for s, p := range v.pendingShares {
+			if time.Since(p.started) > 2*keyGenTimeout {
+				delete(v.pendingShares, s)
+			}
+		}
+		if len(v.pendingShares) >= maxPendingKeyGens {
+			return nil, fmt.Errorf("too many key generations")
+		}
+		pending = &pendingShare{
+			poll:      poll,
+			trustees:  trustees,
+			threshold: t,
+			values:    make(map[int]*big.Int),
+			started:   time.Now(),
+		}
+		v.pendingShares[session] = pending
+	}
+	if !bytes.Equal(pending.poll, poll) || !EqualStrings(pending.trustees, trustees) || pending.threshold != t {
+		return nil, fmt.Errorf("other poll, trustees or threshold")
+	}
+	return pending, nil
+}
+
+// Check the signed dealing of trustee index, and return its commitments
+func (v *VoteRumorer) verifyDealing(d *KeyDealing, origin string) ([]*big.Int, bool) {
+	if d == nil || d.Dealing == nil {
+		return nil, false
+	}
+	index := int(d.Dealing.Index)
+	if index < 1 || index > len(d.Dealing.Trustees) || d.Dealing.Trustees[index-1] != origin {
+		return nil, false
+	}
+	pubKey := v.blockchain.GetPublicKey(origin)
+	if pubKey == nil || !SignatureValid(pubKey, d.Dealing, d.Signature) {
+		return nil, false
+	}
+	group := v.blockchain.Group()
+	commitments := make([]*big.Int, len(d.Dealing.Commitments))
+	for i, c := range d.Dealing.Commitments {
+		commitments[i] = new(big.Int).SetBytes(c)
+		if !group.Contains(commitments[i]) {
+			return nil, false
+		}
+	}
+	return commitments, len(commitments) > 0
+}
+
+// Collect the values dealt to us, we report to the creator once every trustee dealt
+func (v *VoteRumorer) handleKeyShare(msg *KeyShareMessage) {
+	commitments, ok := v.verifyDealing(msg.Dealing, msg.Origin)
+	if !ok || msg.Dealing.Dealing.Session != msg.Session {
+		fmt.Printf("INVALID KEY SHARE FROM %v: invalid dealing\n", msg.Origin)
+		return
+	}
+	dealing := msg.Dealing.Dealing
+	index := indexOf(dealing.Trustees, v.name)
+	if index == 0 {
+		return
+	}
+	value, err := v.openShare(msg)
+	if err != nil {
+		fmt.Printf("ERROR: could not open key share from %v: %v\n", msg.Origin, err)
+		return
+	}
+	group := v.blockchain.Group()
+	if !threshold.VerifyShare(group, commitments, index, value) {
+		fmt.Printf("INVALID KEY SHARE FROM %v: does not match the commitments\n", msg.Origin)
+		return
+	}
+
+	v.keyGenMutex.Lock()
+	pending, err := v.pendingShareFor(msg.Session, dealing.Poll, dealing.Trustees, len(commitments))
+	if err != nil {
+		v.keyGenMutex.Unlock()
+		fmt.Printf("REFUSED KEY SHARE FROM %v: %v\n", msg.Origin, err)
+		return
+	}
+	pending.values[int(dealing.Index)] = value
+	complete := len(pending.values) == len(pending.trustees)
+	v.keyGenMutex.Unlock()
+
+	if complete {
+		v.reportValues(msg.Session)
+	}
+}
+
+// Tell the creator of the poll which dealers we got no valid value from, and ask these to reveal it
+func (v *VoteRumorer) reportValues(session string) {
+	v.keyGenMutex.Lock()
+	pending, exists := v.pendingShares[session]
+	if !exists || pending.reported || pending.creator == "" {
+		v.keyGenMutex.Unlock()
+		return
+	}
+	pending.reported = true
+	against := make([]uint32, 0)
+	for i := range pending.trustees {
+		if pending.values[i+1] == nil {
+			against = append(against, uint32(i+1))
+		}
+	}
+	v.keyGenMutex.Unlock()
+
+	complaint := &KeyGenComplaint{
+		Origin:      v.name,
+		Destination: pending.creator,
+		HopLimit:    v.hopLimit,
+		Session:     session,
+		Index:       uint32(indexOf(pending.trustees, v.name)),
+		Against:     against,
+	}
+	v.sendPrivate(&GossipPacket{KeyGenComplaint: complaint})
+	for _, dealer := range against {
+		c := *complaint
+		c.Destination = pending.trustees[dealer-1]
+		v.sendPrivate(&GossipPacket{KeyGenComplaint: &c})
+	}
+	if len(against) > 0 {
+		fmt.Printf("COMPLAINED ABOUT DEALERS %v TO %v\n", against, pending.creator)
+	}
+}
+
+// A trustee checked the values dealt to it: as creator of the poll we wait until the values it complains
+// about are revealed, as dealer we reveal the value we dealt it
+func (v *VoteRumorer) handleKeyGenComplaint(c *KeyGenComplaint) {
+	trustee := int(c.Index)
+
+	v.keyGenMutex.Lock()
+	pending, creator := v.pendingPolls[c.Session]
+	if creator && trustee >= 1 && trustee <= len(pending.poll.Trustees) &&
+		pending.poll.Trustees[trustee-1] == c.Origin && !pending.reported[trustee-1] {
+		pending.reported[trustee-1] = true
+		for _, dealer := range c.Against {
+			key := complaint{dealer: int(dealer), trustee: trustee}
+			if dealer >= 1 && int(dealer) <= len(pending.poll.Trustees) && pending.revealed[key] == nil {
+				pending.complaints[key] = true
+			}
+		}
+	}
+	dealt := v.dealt[c.Session]
+	v.keyGenMutex.Unlock()
+
+	if creator {
+		v.finishKeyGen(c.Session, false)
+	}
+	if dealt == nil || trustee < 1 || trustee > len(dealt.trustees) || dealt.trustees[trustee-1] != c.Origin {
+		return
+	}
+	for _, dealer := range c.Against {
+		if int(dealer) == dealt.index {
+			v.sendPrivate(&GossipPacket{KeyGenReveal: &KeyGenReveal{
+				Origin:      v.name,
+				Destination: dealt.creator,
+				HopLimit:    v.hopLimit,
+				Session:     c.Session,
+				Index:       uint32(dealt.index),
+				Trustee:     uint32(trustee),
+				Value:       dealt.polynomial.Share(trustee).Bytes(),
+			}})
+			fmt.Printf("REVEALED KEY SHARE FOR %v AFTER COMPLAINT\n", c.Origin)
+		}
+	}
+}
+
+// Collect the values dealers reveal after complaints about them, for a poll we create
+func (v *VoteRumorer) handleKeyGenReveal(r *KeyGenReveal) {
+	dealer, trustee := int(r.Index), int(r.Trustee)
+	group := v.blockchain.Group()
+
+	v.keyGenMutex.Lock()
+	pending, exists := v.pendingPolls[r.Session]
+	if !exists || dealer < 1 || dealer > len(pending.poll.Trustees) || trustee < 1 ||
+		trustee > len(pending.poll.Trustees) || pending.poll.Trustees[dealer-1] != r.Origin ||
+		pending.dealings[dealer-1] == nil {
+		v.keyGenMutex.Unlock()
+		return
+	}
+	if !threshold.VerifyShare(group, pending.commitments[dealer-1], trustee, new(big.Int).SetBytes(r.Value)) {
+		v.keyGenMutex.Unlock()
+		fmt.Printf("INVALID REVEALED KEY SHARE FROM %v: does not match the commitments\n", r.Origin)
+		return
+	}
+	key := complaint{dealer: dealer, trustee: trustee}
+	pending.revealed[key] = r.Value
+	delete(pending.complaints, key)
+	v.keyGenMutex.Unlock()
+
+	v.finishKeyGen(r.Session, false)
+}
+
+// Collect the dealings for a poll we create
+func (v *VoteRumorer) handleDealing(msg *DealingMessage) {
+	commitments, ok := v.verifyDealing(msg.Dealing, msg.Origin)
+	if !ok {
+		fmt.Printf("INVALID DEALING FROM %v\n", msg.Origin)
+		return
+	}
+	dealing := msg.Dealing.Dealing
+
+	v.keyGenMutex.Lock()
+	pending, exists := v.pendingPolls[dealing.Session]
+	if !exists {
+		v.keyGenMutex.Unlock()
+		return
+	}
+	if !bytes.Equal(pending.terms, dealing.Poll) || !EqualStrings(pending.poll.Trustees, dealing.Trustees) ||
+		len(commitments) != int(pending.poll.Threshold) {
+		v.keyGenMutex.Unlock()
+		fmt.Printf("INVALID DEALING FROM %v: other poll, trustees or threshold\n", msg.Origin)
+		return
+	}
+	pending.dealings[dealing.Index-1] = msg.Dealing
+	pending.commitments[dealing.Index-1] = commitments
+	v.keyGenMutex.Unlock()
+
+	v.finishKeyGen(dealing.Session, false)
+}
+
+// Publish the poll once every trustee dealt and reported, and every complaint is answered. At the timeout,
+// the poll is published with the dealers that qualified: those that dealt and answered every complaint
+func (v *VoteRumorer) finishKeyGen(session string, timeout bool) {
+	v.keyGenMutex.Lock()
+	pending, exists := v.pendingPolls[session]
+	if !exists || (!timeout && !pending.complete()) {
+		v.keyGenMutex.Unlock()
+		return
+	}
+	delete(v.pendingPolls, session)
+	v.keyGenMutex.Unlock()
+
+	poll := pending.poll
+	qualified := pending.qualified()
+	if len(qualified) < int(poll.Threshold) {
+		fmt.Printf("KEY GENERATION FOR POLL %v FAILED: %v of %v trustees qualified\n", poll.Question,
+			len(qualified), len(poll.Trustees))
+		return
+	}
+
+	outcome := &KeyGenOutcome{Session: session, Dealings: make([]*KeyDealing, len(qualified))}
+	commitments := make([][]*big.Int, len(qualified))
+	for i, dealer := range qualified {
+		outcome.Dealings[i] = pending.dealings[dealer-1]
+		commitments[i] = pending.commitments[dealer-1]
+	}
+	signature := v.sign(outcome)
+	for i, trustee := range poll.Trustees {
+		revealed := make([][]byte, len(qualified))
+		for k, dealer := range qualified {
+			revealed[k] = pending.revealed[complaint{dealer: dealer, trustee: i + 1}]
+		}
+		v.sendPrivate(&GossipPacket{KeyGenResult: &KeyGenResult{
+			Origin:      v.name,
+			Destination: trustee,
+			HopLimit:    v.hopLimit,
+			Outcome:     outcome,
+			Signature:   signature,
+			Revealed:    revealed,
+		}})
+	}
+
+	v.publishPoll(poll, outcome.Dealings, commitments)
+}
+
+// Whether every trustee dealt and reported, and every complaint is answered
+func (p *pendingPoll) complete() bool {
+	for i := range p.poll.Trustees {
+		if p.dealings[i] == nil || !p.reported[i] {
+			return false
+		}
+	}
+	return len(p.complaints) == 0
+}
+
+// Indices of the dealers that dealt and answered every complaint about them
+func (p *pendingPoll) qualified() []int {
+	disqualified := make(map[int]bool)
+	for c := range p.complaints {
+		disqualified[c.dealer] = true
+	}
+	qualified := make([]int, 0)
+	for i, d := range p.dealings {
+		if d != nil && !disqualified[i+1] {
+			qualified = append(qualified, i+1)
+		}
+	}
+	return qualified
+}
+
+// Compute our key share from the qualified dealings the creator of the poll sent us
+func (v *VoteRumorer) handleKeyGenResult(r *KeyGenResult) {
+	if r.Outcome == nil {
+		return
+	}
+	session := r.Outcome.Session
+
+	v.keyGenMutex.Lock()
+	defer v.keyGenMutex.Unlock()
+
+	pending, exists := v.pendingShares[session]
+	if !exists || pending.creator != r.Origin {
+		return
+	}
+	pubKey := v.blockchain.GetPublicKey(r.Origin)
+	if pubKey == nil || !SignatureValid(pubKey, r.Outcome, r.Signature) ||
+		len(r.Revealed) != len(r.Outcome.Dealings) || len(r.Outcome.Dealings) < pending.threshold {
+		fmt.Printf("INVALID KEY GENERATION RESULT FROM %v\n", r.Origin)
+		return
+	}
+
+	group := v.blockchain.Group()
+	index := indexOf(pending.trustees, v.name)
+	dealt := make([]*big.Int, len(r.Outcome.Dealings))
+	commitments := make([][]*big.Int, len(r.Outcome.Dealings))
+	previous := 0
+	for i, d := range r.Outcome.Dealings {
+		if d == nil || d.Dealing == nil || int(d.Dealing.Index) <= previous ||
+			int(d.Dealing.Index) > len(pending.trustees) {
+			fmt.Printf("INVALID KEY GENERATION RESULT FROM %v: dealings out of order\n", r.Origin)
+			return
+		}
+		dealer := int(d.Dealing.Index)
+		c, ok := v.verifyDealing(d, pending.trustees[dealer-1])
+		if !ok || d.Dealing.Session != session || !bytes.Equal(d.Dealing.Poll, pending.poll) ||
+			!EqualStrings(d.Dealing.Trustees, pending.trustees) || len(c) != pending.threshold {
+			fmt.Printf("INVALID KEY GENERATION RESULT FROM %v: invalid dealing of %v\n", r.Origin, dealer)
+			return
+		}
+		value := pending.values[dealer]
+		if len(r.Revealed[i]) > 0 {
+			value = new(big.Int).SetBytes(r.Revealed[i])
+		}
+		if value == nil || !threshold.VerifyShare(group, c, index, value) {
+			fmt.Printf("INVALID KEY GENERATION RESULT FROM %v: no valid value of %v\n", r.Origin, dealer)
+			return
+		}
+		dealt[i] = value
+		commitments[i] = c
+		previous = dealer
+	}
+	delete(v.pendingShares, session)
+
+	share := threshold.NewKeyShare(group, index, len(pending.trustees), pending.threshold, dealt)
+	keyID := (&Poll{PublicKey: threshold.PublicKey(group, commitments).Bytes()}).KeyID()
+
+	v.sharesMutex.Lock()
+	v.shares[keyID] = share
+	v.sharesMutex.Unlock()
+
+	// Without the share, the poll can't be counted if we are needed for the threshold
+	if v.keystore != nil {
+		if err := v.keystore.AddShare(keyID, share); err != nil {
+			fmt.Printf("ERROR: could not store key share: %v\n", err)
+		}
+	}
+
+	fmt.Printf("GENERATED KEY SHARE %v\n", share.Index)
+}
+
+// Complete the poll with the key of the qualified dealings, and publish it
+func (v *VoteRumorer) publishPoll(poll *Poll, dealings []*KeyDealing, commitments [][]*big.Int) {
+	group := v.blockchain.Group()
+	poll.PublicKey = threshold.PublicKey(group, commitments).Bytes()
+	poll.Dealings = dealings
+	poll.VerificationKeys = make([][]byte, len(poll.Trustees))
+	for i := range poll.Trustees {
+		poll.VerificationKeys[i] = threshold.VerificationKey(group, commitments, i+1).Bytes()
+	}
+
+	// Let the public rumorer monger the transaction
+	v.publicOut <- &AddrGossipPacket{
+		Address: UDPAddr{},
+		Gossip: &GossipPacket{Transaction: &Transaction{
+			ID:     0,
+			Origin: v.name,
+			PollTx: &PollTx{
+				Poll:      poll,
+				ID:        0,
+				Signature: v.sign(poll),
+			},
+		}},
+	}
+	fmt.Printf("POLL: %v\n", poll.Question)
+}
+
+// Index (from 1) of name in names, 0 if it isn't in names
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,303 @@
+package voting
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
+	"github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	"github.com/lukasdeloose/decentralized-voting-system/project/threshold"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+)
+
+// Partial decryptions collected to count the votes of a poll
+type pendingCount struct {
+	aggregates [][]byte                   // Product of every entry of the encrypted votes
+	shares     map[int][]*DecryptionShare // Verified partial decryptions of the aggregates, by index of the trustee
+}
+
+func (v *VoteRumorer) isTrustee(poll *Poll) bool {
+	for _, trustee := range poll.Trustees {
+		if trustee == v.name {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *VoteRumorer) share(poll *Poll) *threshold.KeyShare {
+	v.sharesMutex.RLock()
+	defer v.sharesMutex.RUnlock()
+
+	return v.shares[poll.KeyID()]
+}
+
+// Send a point to point message through the private rumorer
+func (v *VoteRumorer) sendPrivate(gossip *GossipPacket) {
+	v.privateOut <- &AddrGossipPacket{
+		Address: UDPAddr{},
+		Gossip:  gossip,
+	}
+}
+
+// Partially decrypt the aggregated votes of the poll for the node that wants to count them
+// Only the aggregate of the votes on our own chain is decrypted, once the poll is closed: a poll with a
+// deadline when our tip is past it, a poll without deadline when its creator signs the request. Once the
+// result of the poll is mined no other aggregate is decrypted: the difference of two aggregates could
+// reveal individual votes
+func (v *VoteRumorer) handleDecryptionRequest(req *DecryptionRequest) {
+	poll := v.blockchain.GetPoll(req.PollID)
+	if poll == nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] Could not find poll with pollid %v\n", req.PollID)
+		}
+		return
+	}
+	share := v.share(poll.Poll)
+	if share == nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] No key share for poll %v\n", req.PollID)
+		}
+		return
+	}
+
+	if poll.Poll.Deadline.IsZero() && !v.signedByCreator(poll.Poll, req) {
+		fmt.Printf("REFUSED DECRYPTION FOR POLLID %v TO %v: only the creator closes a poll without deadline\n",
+			req.PollID, req.Origin)
+		return
+	}
+	if !poll.Poll.Deadline.IsZero() && !poll.Poll.IsClosed(v.blockchain.Tip().Timestamp) {
+		fmt.Printf("REFUSED DECRYPTION FOR POLLID %v TO %v: poll is open until %v\n", req.PollID, req.Origin,
+			poll.Poll.Deadline)
+		return
+	}
+
+	aggregates, _ := v.blockchain.AggregateVotes(req.PollID)
+	if !sameAggregates(aggregates, req.Aggregates) {
+		fmt.Printf("REFUSED DECRYPTION FOR POLLID %v TO %v: aggregates do not match our chain\n", req.PollID, req.Origin)
+		return
+	}
+	if !v.mayDecrypt(poll, aggregates) {
+		fmt.Printf("REFUSED DECRYPTION FOR POLLID %v TO %v: the poll is counted already\n", req.PollID, req.Origin)
+		return
+	}
+
+	shares := make([]*DecryptionShare, len(aggregates))
+	for i, aggregate := range aggregates {
+		c, err := v.blockchain.Group().Unmarshal(aggregate)
+		if err != nil {
+			fmt.Printf("ERROR: invalid aggregate: %v\n", err)
+			return
+		}
+		partial := share.PartialDecrypt(c)
+		proof, err := share.ProveDecryption(c, partial)
+		if err != nil {
+			fmt.Printf("ERROR: could not prove partial decryption: %v\n", err)
+			return
+		}
+		shares[i] = &DecryptionShare{
+			Index:   uint32(share.Index),
+			Partial: partial.Bytes(),
+			Proof:   proof,
+		}
+	}
+
+	v.sendPrivate(&GossipPacket{PartialDecryption: &PartialDecryption{
+		Origin:      v.name,
+		Destination: req.Origin,
+		HopLimit:    v.hopLimit,
+		PollID:      req.PollID,
+		Aggregates:  aggregates,
+		Shares:      shares,
+	}})
+	fmt.Printf("SENT PARTIAL DECRYPTION FOR POLLID %v TO %v\n", req.PollID, req.Origin)
+}
+
+// Collect the partial decryptions, and count the votes once we have enough valid ones
+func (v *VoteRumorer) handlePartialDecryption(pd *PartialDecryption) {
+	poll := v.blockchain.GetPoll(pd.PollID)
+	if poll == nil || len(pd.Shares) == 0 || pd.Shares[0] == nil {
+		return
+	}
+	index := pd.Shares[0].Index
+	if index < 1 || int(index) > len(poll.Poll.Trustees) || poll.Poll.Trustees[index-1] != pd.Origin {
+		fmt.Printf("INVALID PARTIAL DECRYPTION: %v is not trustee %v\n", pd.Origin, index)
+		return
+	}
+
+	v.countsMutex.Lock()
+	defer v.countsMutex.Unlock()
+
+	pending, exists := v.counts[pd.PollID]
+	if !exists {
+		return
+	}
+	if !sameAggregates(pd.Aggregates, pending.aggregates) || len(pd.Shares) != len(pending.aggregates) {
+		// The chain of the trustee has other votes than ours
+		fmt.Printf("INVALID PARTIAL DECRYPTION: %v decrypted other aggregates\n", pd.Origin)
+		return
+	}
+	for i, share := range pd.Shares {
+		if share == nil || share.Index != index ||
+			!v.blockchain.VerifyDecryptionShare(poll.Poll, pending.aggregates[i], share) {
+			fmt.Printf("INVALID PARTIAL DECRYPTION: invalid proof from %v\n", pd.Origin)
+			return
+		}
+	}
+	pending.shares[int(index)] = pd.Shares
+
+	if len(pending.shares) < int(poll.Poll.Threshold) {
+		return
+	}
+	delete(v.counts, pd.PollID)
+
+	counts := make([]int64, len(pending.aggregates))
+	tallies := make([]*Tally, len(pending.aggregates))
+	for i, aggregate := range pending.aggregates {
+		tallies[i] = &Tally{
+			Aggregate:  aggregate,
+			Decryption: make([]*DecryptionShare, 0, len(pending.shares)),
+		}
+		for _, shares := range pending.shares {
+			tallies[i].Decryption = append(tallies[i].Decryption, shares[i])
+		}
+		count, err := v.blockchain.DecryptTally(poll.Poll, tallies[i])
+		if err != nil {
+			fmt.Printf("ERROR: could not decrypt votes: %v\n", err)
+			return
+		}
+		counts[i] = count
+	}
+
+	go v.publishResult(pd.PollID, counts, tallies)
+}
+
+// Whether the creator of poll signed the request
+func (v *VoteRumorer) signedByCreator(poll *Poll, req *DecryptionRequest) bool {
+	pubKey := v.blockchain.GetPublicKey(poll.Origin)
+	return pubKey != nil && SignatureValid(pubKey, req.Authorization(), req.Signature)
+}
+
+// Whether we may decrypt the aggregates of poll. Once the result of the poll is mined, we remember its
+// aggregates and decrypt no others, even if the result is rolled back later
+func (v *VoteRumorer) mayDecrypt(poll *PollTx, aggregates [][]byte) bool {
+	if result := v.blockchain.GetResult(poll.ID); result != nil {
+		counted := make([][]byte, len(result.Result.Tallies))
+		for i, tally := range result.Result.Tallies {
+			counted[i] = tally.Aggregate
+		}
+		v.markDecrypted(poll.Poll, counted)
+		return false
+	}
+
+	v.sharesMutex.RLock()
+	defer v.sharesMutex.RUnlock()
+
+	previous, exists := v.decrypted[poll.Poll.KeyID()]
+	return !exists || bytes.Equal(previous, aggregatesDigest(aggregates))
+}
+
+// Remember the aggregates of the mined result of poll
+func (v *VoteRumorer) markDecrypted(poll *Poll, aggregates [][]byte) {
+	digest := aggregatesDigest(aggregates)
+
+	v.sharesMutex.Lock()
+	defer v.sharesMutex.Unlock()
+
+	keyID := poll.KeyID()
+	if previous, exists := v.decrypted[keyID]; exists && bytes.Equal(previous, digest) {
+		return
+	}
+	v.decrypted[keyID] = digest
+	if v.keystore != nil {
+		if err := v.keystore.SetDecrypted(keyID, digest); err != nil {
+			fmt.Printf("ERROR: could not store decryption: %v\n", err)
+		}
+	}
+}
+
+func aggregatesDigest(aggregates [][]byte) []byte {
+	hash := sha256.New()
+	for _, aggregate := range aggregates {
+		hash.Write(aggregate)
+	}
+	return hash.Sum(nil)
+}
+
+func sameAggregates(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encrypt the value dealt to a trustee in the key generation session: a fresh AES key encrypts the value,
+// and is itself encrypted with the RSA key of the trustee
+func sealShare(session string, value *big.Int, pubKey *rsa.PublicKey) (*KeyShareMessage, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	sealedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, key, []byte(session))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &KeyShareMessage{
+		Session:     session,
+		SealedKey:   sealedKey,
+		SealedShare: gcm.Seal(nonce, nonce, value.Bytes(), []byte(session)),
+	}, nil
+}
+
+func (v *VoteRumorer) openShare(msg *KeyShareMessage) (*big.Int, error) {
+	if v.privateKey == nil {
+		return nil, fmt.Errorf("no private key")
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, v.privateKey, msg.SealedKey, []byte(msg.Session))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.SealedShare) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed share too short")
+	}
+	nonce, sealed := msg.SealedShare[:gcm.NonceSize()], msg.SealedShare[gcm.NonceSize():]
+	value, err := gcm.Open(nil, nonce, sealed, []byte(msg.Session))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(value), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,19 +1,22 @@
 package voting
 
 import (
-	"bitbucket.org/ustraca/crypto/paillier"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/dedis/protobuf"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
 	"github.com/lukasdeloose/decentralized-voting-system/project/constants"
+	"github.com/lukasdeloose/decentralized-voting-system/project/keystore"
+	"github.com/lukasdeloose/decentralized-voting-system/project/threshold"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"github.com/lukasdeloose/decentralized-voting-system/project/zkp"
 	"math/big"
-	"strings"
 	"sync"
 	"time"
 )
@@ -23,29 +26,59 @@ type VoteRumorer struct {
 	nameHash [32]byte
 
 	privateKey *rsa.PrivateKey
+	keystore   *keystore.Keystore // Keeps the private key and the key shares across restarts, nil if not used
 
-	polls      map[string]*paillier.PrivateKey
-	pollsMutex *sync.RWMutex
-	pollId     uint32
+	shares      map[string]*threshold.KeyShare // Our key shares for the polls we are trustee of, by Poll.KeyID
+	decrypted   map[string][]byte              // Digest of the aggregates we decrypted, by Poll.KeyID
+	sharesMutex *sync.RWMutex
+	pollId      uint32
 
-	uiIn      chan *VotingMessage
-	in        chan *AddrGossipPacket
-	publicOut chan *AddrGossipPacket
+	counts      map[uint32]*pendingCount // Counts we requested partial decryptions for, by pollID
+	countsMutex *sync.Mutex
+
+	pendingPolls  map[string]*pendingPoll  // Key generations of the polls we create, by session
+	pendingShares map[string]*pendingShare // Key generations we take part in as trustee, by session
+	dealt         map[string]*dealtKeyGen  // What we dealt in key generations, by session
+	keyGenMutex   *sync.Mutex
+
+	uiIn       chan *VotingMessage
+	in         chan *AddrGossipPacket
+	publicOut  chan *AddrGossipPacket
+	privateOut chan *AddrGossipPacket
+
+	hopLimit uint32
 
 	blockchain *Blockchain
 }
 
-func NewVoteRumorer(name string, uiIn chan *VotingMessage, in chan *AddrGossipPacket, publicOut chan *AddrGossipPacket, blockchain *Blockchain) *VoteRumorer {
+func NewVoteRumorer(name string, uiIn chan *VotingMessage, in chan *AddrGossipPacket, publicOut chan *AddrGossipPacket,
+	privateOut chan *AddrGossipPacket, blockchain *Blockchain, hopLimit int, keystore *keystore.Keystore) *VoteRumorer {
+	shares := make(map[string]*threshold.KeyShare)
+	decrypted := make(map[string][]byte)
+	if keystore != nil {
+		shares = keystore.Shares()
+		decrypted = keystore.Decrypted()
+	}
 	return &VoteRumorer{
-		name:       name,
-		nameHash:   sha256.Sum256([]byte(name)),
-		polls:      make(map[string]*paillier.PrivateKey),
-		pollsMutex: &sync.RWMutex{},
-		uiIn:       uiIn,
-		in:         in,
-		pollId:     0,
-		publicOut:  publicOut,
-		blockchain: blockchain,
+		name:          name,
+		nameHash:      sha256.Sum256([]byte(name)),
+		keystore:      keystore,
+		shares:        shares,
+		decrypted:     decrypted,
+		sharesMutex:   &sync.RWMutex{},
+		counts:        make(map[uint32]*pendingCount),
+		countsMutex:   &sync.Mutex{},
+		pendingPolls:  make(map[string]*pendingPoll),
+		pendingShares: make(map[string]*pendingShare),
+		dealt:         make(map[string]*dealtKeyGen),
+		keyGenMutex:   &sync.Mutex{},
+		uiIn:          uiIn,
+		in:            in,
+		pollId:        0,
+		publicOut:     publicOut,
+		privateOut:    privateOut,
+		hopLimit:      uint32(hopLimit),
+		blockchain:    blockchain,
 	}
 }
 
@@ -55,72 +88,112 @@ func (v *VoteRumorer) Run() {
 	go func() {
 		for msg := range v.uiIn {
 			if msg.NewVote != nil {
-				go v.handleNewVote(msg.NewVote.Vote, msg.NewVote.Pollid)
+				go v.handleNewVote(msg.NewVote)
 			} else if msg.NewPoll != nil {
-				go v.handleNewPoll(msg.NewPoll.Question, msg.NewPoll.Voters)
+				go v.handleNewPoll(msg.NewPoll)
 			} else if msg.CountRequest != nil {
 				go v.countVotes(msg.CountRequest.Pollid)
+			} else if msg.NewDelegation != nil {
+				go v.handleNewDelegation(msg.NewDelegation)
+			}
+		}
+	}()
+
+	go func() {
+		for packet := range v.in {
+			if packet.Gossip.KeyGenRequest != nil {
+				go v.handleKeyGenRequest(packet.Gossip.KeyGenRequest)
+			} else if packet.Gossip.Dealing != nil {
+				go v.handleDealing(packet.Gossip.Dealing)
+			} else if packet.Gossip.KeyShare != nil {
+				go v.handleKeyShare(packet.Gossip.KeyShare)
+			} else if packet.Gossip.KeyGenComplaint != nil {
+				go v.handleKeyGenComplaint(packet.Gossip.KeyGenComplaint)
+			} else if packet.Gossip.KeyGenReveal != nil {
+				go v.handleKeyGenReveal(packet.Gossip.KeyGenReveal)
+			} else if packet.Gossip.KeyGenResult != nil {
+				go v.handleKeyGenResult(packet.Gossip.KeyGenResult)
+			} else if packet.Gossip.DecryptionRequest != nil {
+				go v.handleDecryptionRequest(packet.Gossip.DecryptionRequest)
+			} else if packet.Gossip.PartialDecryption != nil {
+				go v.handlePartialDecryption(packet.Gossip.PartialDecryption)
 			}
 		}
 	}()
 }
 
+// Our private key, nil before we registered
+func (v *VoteRumorer) PrivateKey() *rsa.PrivateKey {
+	return v.privateKey
+}
+
 func (v *VoteRumorer) UIIn() chan *VotingMessage {
 	return v.uiIn
 }
 
-func (v *VoteRumorer) PrivateKey(question string, voters []string) *paillier.PrivateKey {
-	v.pollsMutex.RLock()
-	defer v.pollsMutex.RUnlock()
-
-	privKey, exists := v.polls[question+strings.Join(voters, " ")]
-	if exists {
-		return privKey
-	} else {
-		return nil
+// Only the creator and the trustees of a poll can start counting its votes, after the deadline. A poll without
+// deadline is closed by its creator, only the creator can count it
+func (v *VoteRumorer) CanCount(poll *PollTx) bool {
+	if v.blockchain.GetResult(poll.ID) != nil {
+		return false
+	}
+	if poll.Poll.Deadline.IsZero() {
+		return poll.Poll.Origin == v.name
+	}
+	if !poll.Poll.IsClosed(time.Now()) {
+		return false
 	}
+	return poll.Poll.Origin == v.name || v.isTrustee(poll.Poll)
 }
 
+// Ask the trustees of the poll to partially decrypt the aggregated votes, the votes are counted once
+// enough partial decryptions arrived (see handlePartialDecryption)
 func (v *VoteRumorer) countVotes(pollid uint32) {
-	v.pollsMutex.Lock()
-	defer v.pollsMutex.Unlock()
-
-	poll := v.blockchain.GetPoll(pollid)
-	if poll == nil {
+	// Multiply the encrypted votes on the blockchain, only this product is decrypted
+	// Remember that a vote is only registered on the blockchain if the
+	// signature and the ballot proof are checked, and if this user can actually vote
+	aggregates, exists := v.blockchain.AggregateVotes(pollid)
+	if !exists {
 		if constants.Debug {
 			fmt.Printf("[DEBUG] Could not find poll with pollid %v\n", pollid)
 		}
 		return
 	}
-
-	privKey, exists := v.polls[poll.Poll.Question+strings.Join(poll.Poll.Voters, " ")]
-	if !exists {
-		if constants.Debug {
-			fmt.Printf("[DEBUG] You need the private key to count the votes")
-		}
+	poll := v.blockchain.GetPoll(pollid)
+	if !v.CanCount(poll) {
+		fmt.Printf("CANNOT COUNT POLLID %v: the poll is open, counted, or not ours to close\n", pollid)
 		return
 	}
 
-	// Get the votes for this poll from the blockchain
-	// Remember that a vote is only registered on the blockchain if the
-	// signature is checked, and if this user can actually vote, so we can
-	// simply decrypt the votes, check if in (0, 1) and add them together
-	votes := v.blockchain.RetrieveVotes(pollid)
-	count := int64(0)
-	for _, vote := range votes {
-		// decrypt the vote with our private key
-		voteBigInt := (&big.Int{}).SetBytes(vote.Vote)
-		voteDecr := privKey.Decrypt(&paillier.Cypher{C: voteBigInt})
-		if !voteDecr.IsInt64() || (voteDecr.Int64() != 0 && voteDecr.Int64() != 1) {
-			if constants.Debug {
-				fmt.Printf("[DEBUG] Invalid vote %v! Will be ignored...\n", voteDecr.Int64())
-			}
-		} else {
-			count += voteDecr.Int64()
-		}
+	v.countsMutex.Lock()
+	v.counts[pollid] = &pendingCount{
+		aggregates: aggregates,
+		shares:     make(map[int][]*DecryptionShare),
 	}
+	v.countsMutex.Unlock()
 
-	fmt.Printf("COUNTED VOTES FOR POLLID %v, COUNT: %v\n", pollid, count)
+	var signature []byte
+	if poll.Poll.Origin == v.name {
+		// Trustees only decrypt a poll without deadline when its creator signed the request
+		signature = v.sign(&DecryptionAuthorization{PollID: pollid, Aggregates: aggregates})
+	}
+	for _, trustee := range poll.Poll.Trustees {
+		v.sendPrivate(&GossipPacket{DecryptionRequest: &DecryptionRequest{
+			Origin:      v.name,
+			Destination: trustee,
+			HopLimit:    v.hopLimit,
+			PollID:      pollid,
+			Aggregates:  aggregates,
+			Signature:   signature,
+		}})
+	}
+	fmt.Printf("REQUESTED PARTIAL DECRYPTIONS FOR POLLID %v\n", pollid)
+}
+
+// Publish the result of a poll, together with the aggregates it is the decryption of and the partial
+// decryptions, so every node can verify it
+func (v *VoteRumorer) publishResult(pollid uint32, counts []int64, tallies []*Tally) {
+	fmt.Printf("COUNTED VOTES FOR POLLID %v, COUNTS: %v\n", pollid, counts)
 	v.publicOut <- &AddrGossipPacket{
 		Address: UDPAddr{},
 		Gossip: &GossipPacket{Transaction: &Transaction{
@@ -129,17 +202,60 @@ func (v *VoteRumorer) countVotes(pollid uint32) {
 			ResultTx: &ResultTx{
 				ID: 0,
 				Result: &Result{
-					Count:     count,
+					Counts:    counts,
 					PollId:    pollid,
 					Timestamp: time.Now(),
+					Tallies:   tallies,
 				},
-			},}},
+			}}},
 	}
 }
 
+// The private key from the keystore, nil if there is none
+func (v *VoteRumorer) loadIdentity() *rsa.PrivateKey {
+	if v.keystore == nil {
+		return nil
+	}
+	privKey, err := v.keystore.Identity()
+	if err != nil {
+		fmt.Printf("ERROR: could not load private key: %v\n", err)
+		return nil
+	}
+	if privKey != nil {
+		fmt.Println("LOADED PRIVATE KEY FROM KEYSTORE")
+	}
+	return privKey
+}
+
 func (v *VoteRumorer) registerName() {
-	privKey, _ := rsa.GenerateKey(rand.Reader, 128)
+	keyBits := int(v.blockchain.Config().RSAKeyBits)
+	privKey := v.loadIdentity()
+	if privKey != nil && privKey.N.BitLen() < keyBits {
+		fmt.Printf("STORED PRIVATE KEY OF %v BITS IS TOO SMALL FOR THIS NETWORK, GENERATING A NEW ONE\n", privKey.N.BitLen())
+		privKey = nil
+	}
+	if privKey == nil {
+		// RSA-PSS signatures with SHA256 need keys of at least 528 bits
+		if keyBits < 2048 {
+			keyBits = 2048
+		}
+		privKey, _ = rsa.GenerateKey(rand.Reader, keyBits)
+		if v.keystore != nil {
+			if err := v.keystore.SetIdentity(privKey); err != nil {
+				fmt.Printf("ERROR: could not store private key: %v\n", err)
+			}
+		}
+	}
 	v.privateKey = privKey
+
+	// A restarted node might already be registered
+	if registered := v.blockchain.GetPublicKey(v.name); registered != nil {
+		if registered.N.Cmp(privKey.N) != 0 || registered.E != privKey.E {
+			fmt.Printf("ERROR: %v is registered with another key\n", v.name)
+		}
+		return
+	}
+
 	registry := &Registry{
 		Origin: v.name,
 		PublicKey: SerializableRSAPubKey{
@@ -166,18 +282,33 @@ func (v *VoteRumorer) registerName() {
 	fmt.Println("REGISTERED NAME AND PUBLIC KEY")
 }
 
-func (v *VoteRumorer) handleNewVote(vote bool, pollid uint32) {
-	// Create a new transaction, this is mongerable
-	votetx := v.createEncryptedVote(vote, pollid)
-	if votetx == nil {
-		return
-	}
+// Cast a vote, returns the hash of the vote transaction to look up its receipt, empty if the vote could not be cast
+func (v *VoteRumorer) Vote(newVote *NewVote) string {
+	return v.handleNewVote(newVote)
+}
 
+func (v *VoteRumorer) handleNewVote(newVote *NewVote) string {
+	// Create a new transaction, this is mongerable. A voter who already voted replaces the last ballot,
+	// also when that ballot is still pending
 	tx := &Transaction{
 		ID:     0,
 		Origin: v.name,
-		VoteTx: votetx,
 	}
+	var hash []byte
+	if latest := v.blockchain.LatestPendingBallot(newVote.Pollid, v.name); latest != nil {
+		tx.RevoteTx = v.createRevote(newVote, latest)
+		if tx.RevoteTx == nil {
+			return ""
+		}
+		hash = tx.RevoteTx.Hash()
+	} else {
+		tx.VoteTx = v.createEncryptedVote(newVote)
+		if tx.VoteTx == nil {
+			return ""
+		}
+		hash = tx.VoteTx.Hash()
+	}
+	txHash := hex.EncodeToString(hash)
 
 	// Let the public rumorer monger the transaction
 	v.publicOut <- &AddrGossipPacket{
@@ -185,129 +316,223 @@ func (v *VoteRumorer) handleNewVote(vote bool, pollid uint32) {
 		Gossip:  &GossipPacket{Transaction: tx},
 	}
 
-	fmt.Printf("VOTE %v FOR %v\n", vote, pollid)
+	if tx.RevoteTx != nil {
+		fmt.Printf("REVOTE %v %v FOR %v, TRANSACTION %v\n", newVote.Vote, newVote.Choices, newVote.Pollid, txHash)
+	} else {
+		fmt.Printf("VOTE %v %v FOR %v, TRANSACTION %v\n", newVote.Vote, newVote.Choices, newVote.Pollid, txHash)
+	}
+	return txHash
 }
 
-func (v *VoteRumorer) handleNewPoll(question string, voters []string) {
-	poll := v.createPoll(question, voters)
-	if poll == nil {
-		return
+// Delegate our vote, returns the hash of the delegation transaction, empty if we could not delegate
+func (v *VoteRumorer) Delegate(newDelegation *NewDelegation) string {
+	return v.handleNewDelegation(newDelegation)
+}
+
+func (v *VoteRumorer) handleNewDelegation(newDelegation *NewDelegation) string {
+	if v.privateKey == nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] First register your name and get a private key\n")
+		}
+		return ""
+	}
+	delegation := &Delegation{
+		Origin:   v.name,
+		Delegate: newDelegation.Delegate,
+		PollID:   newDelegation.Pollid,
+		Creator:  newDelegation.Creator,
+	}
+	if delegation.Creator != "" {
+		delegation.PollID = 0
 	}
+	// The delegation replaces our last one with the same scope
+	delegation.Supersedes = v.blockchain.LastDelegation(v.name, delegation.PollID, delegation.Creator)
+	tx := &DelegationTx{
+		ID:         0,
+		Delegation: delegation,
+		Signature:  v.sign(delegation),
+	}
+	txHash := hex.EncodeToString(tx.Hash())
+
 	// Let the public rumorer monger the transaction
 	v.publicOut <- &AddrGossipPacket{
 		Address: UDPAddr{},
 		Gossip: &GossipPacket{Transaction: &Transaction{
-			ID:     0,
-			Origin: v.name,
-			PollTx: poll,
+			ID:           0,
+			Origin:       v.name,
+			DelegationTx: tx,
 		}},
 	}
-	fmt.Printf("POLL: %v\n", question)
+
+	scope := fmt.Sprintf("POLL %v", delegation.PollID)
+	if delegation.Creator != "" {
+		scope = "ALL POLLS OF " + delegation.Creator
+	}
+	if delegation.Delegate == "" {
+		fmt.Printf("REVOKED DELEGATION FOR %v, TRANSACTION %v\n", scope, txHash)
+	} else {
+		fmt.Printf("DELEGATED TO %v FOR %v, TRANSACTION %v\n", delegation.Delegate, scope, txHash)
+	}
+	return txHash
 }
 
-func (v *VoteRumorer) createEncryptedVote(vote bool, pollid uint32) *VoteTx {
-	publicKey, exists := v.blockchain.PollKey(pollid)
-	if !exists {
+// Create the poll, it is published once its trustees generated its key
+func (v *VoteRumorer) handleNewPoll(newPoll *NewPoll) {
+	poll := v.createPoll(newPoll)
+	if poll == nil {
+		return
+	}
+	if err := v.startKeyGen(poll); err != nil {
+		fmt.Printf("ERROR: could not generate key for poll: %v\n", err)
+	}
+}
+
+func (v *VoteRumorer) createEncryptedVote(newVote *NewVote) *VoteTx {
+	encrVote, proofs, sumProofs := v.encryptBallot(newVote)
+	if encrVote == nil {
+		return nil
+	}
+	return &VoteTx{
+		ID:        0,
+		Vote:      encrVote,
+		Signature: v.sign(encrVote),
+		Proofs:    proofs,
+		SumProofs: sumProofs,
+	}
+}
+
+// Ballot that replaces the ballot with hash latest
+func (v *VoteRumorer) createRevote(newVote *NewVote, latest []byte) *RevoteTx {
+	encrVote, proofs, sumProofs := v.encryptBallot(newVote)
+	if encrVote == nil {
+		return nil
+	}
+	revote := &Revote{
+		Vote:       encrVote,
+		Supersedes: latest,
+	}
+	return &RevoteTx{
+		ID:        0,
+		Revote:    revote,
+		Signature: v.sign(revote),
+		Proofs:    proofs,
+		SumProofs: sumProofs,
+	}
+}
+
+// Encrypt every entry of the ballot, with proofs that the ballot is valid
+func (v *VoteRumorer) encryptBallot(newVote *NewVote) (*EncryptedVote, []*BallotProof, []*BallotProof) {
+	if v.privateKey == nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] First register your name and get a private key\n")
+		}
+		return nil, nil, nil
+	}
+	pollid := newVote.Pollid
+	poll := v.blockchain.GetPoll(pollid)
+	if poll == nil {
 		if constants.Debug {
 			fmt.Printf("[DEBUG] Public key for %v could not be found\n", pollid)
-			return nil
 		}
+		return nil, nil, nil
 	}
 
-	voteInt := big.NewInt(0)
-	if vote {
-		voteInt = big.NewInt(1)
+	entries, err := ballot.Entries(poll.Poll, newVote)
+	if err != nil {
+		fmt.Printf("ERROR: invalid vote for poll %v: %v\n", pollid, err)
+		return nil, nil, nil
 	}
 
-	voteCypher, _ := publicKey.Encrypt(voteInt, rand.Reader)
+	// The entries are weighted with our weight on the poll
+	weight := ballot.Weight(poll.Poll, v.name)
+	if weight == 0 {
+		fmt.Printf("ERROR: not allowed to vote on poll %v\n", pollid)
+		return nil, nil, nil
+	}
+	h := new(big.Int).SetBytes(poll.Poll.PublicKey)
+	vote, proofs, sumProofs, err := zkp.EncryptBallot(v.blockchain.Group(), h, entries, weight,
+		ballot.OneHotGroups(poll.Poll), zkp.BallotContext(v.name, pollid))
+	if err != nil {
+		fmt.Printf("ERROR: could not encrypt vote: %v\n", err)
+		return nil, nil, nil
+	}
 
 	encrVote := &EncryptedVote{
 		Origin: v.name,
-		PollID: 0,
-		Vote:   voteCypher.C.Bytes(),
+		PollID: pollid,
+		Vote:   vote,
 	}
-	voteBytes, _ := protobuf.Encode(encrVote)
+	return encrVote, proofs, sumProofs
+}
 
-	if v.privateKey != nil {
+func (v *VoteRumorer) sign(msg interface{}) []byte {
+	msgBytes, _ := protobuf.Encode(msg)
+	hash := sha256.Sum256(msgBytes)
+	signature, _ := rsa.SignPSS(rand.Reader, v.privateKey, crypto.SHA256, hash[:], nil)
+	return signature
+}
+
+// The poll without its key, see publishPoll
+func (v *VoteRumorer) createPoll(newPoll *NewPoll) *Poll {
+	if v.privateKey == nil {
 		if constants.Debug {
 			fmt.Printf("[DEBUG] First register your name and get a private key\n")
 		}
 		return nil
 	}
-	hash := sha256.Sum256(voteBytes)
-	signature, _ := rsa.SignPSS(rand.Reader, v.privateKey, crypto.SHA256, hash[:], nil)
 
-	return &VoteTx{
-		ID:        0,
-		Vote:      encrVote,
-		Signature: signature,
+	checked := &Poll{Options: newPoll.Options, BallotType: newPoll.BallotType, Voters: newPoll.Voters,
+		Weights: newPoll.Weights}
+	if err := ballot.CheckPoll(checked); err != nil {
+		fmt.Printf("ERROR: invalid poll: %v\n", err)
+		return nil
 	}
-}
-
-func (v *VoteRumorer) createPoll(question string, voters []string) *PollTx {
-	// Create public private key pair for poll
-	privKey := generateKey(128)
-
-	v.pollsMutex.Lock()
-	v.polls[question+strings.Join(voters, " ")] = privKey // TODO find better way to store key
-	v.pollsMutex.Unlock()
-
-	poll := &Poll{
-		Origin:   v.name,
-		Question: question,
-		Voters:   voters,
-		Id:       v.pollId,
-		PublicKey: SerializablePaillierPubKey{
-			N: privKey.PublicKey.N.Bytes(),
-			G: privKey.PublicKey.G.Bytes(),
-		},
+	if err := v.blockchain.CheckBallotSize(checked); err != nil {
+		fmt.Printf("ERROR: invalid poll: %v\n", err)
+		return nil
 	}
-	v.pollId++
-	pollBytes, _ := protobuf.Encode(poll)
 
-	if v.privateKey == nil {
-		if constants.Debug {
-			fmt.Printf("[DEBUG] First register your name and get a private key\n")
-		}
+	// Without trustees, the creator holds the whole key
+	trustees := newPoll.Trustees
+	t := newPoll.Threshold
+	if len(trustees) == 0 {
+		trustees = []string{v.name}
+		t = 1
+	}
+	if t < 1 || int(t) > len(trustees) {
+		fmt.Printf("ERROR: invalid poll: threshold %v for %v trustees\n", t, len(trustees))
 		return nil
 	}
-	hash := sha256.Sum256(pollBytes)
-	signature, _ := rsa.SignPSS(rand.Reader, v.privateKey, crypto.SHA256, hash[:], &rsa.PSSOptions{
-		SaltLength: rsa.PSSSaltLengthEqualsHash,
-	})
 
-	return &PollTx{
-		Poll:      poll,
-		ID:        0,
-		Signature: signature,
+	poll := &Poll{
+		Origin:     v.name,
+		Question:   newPoll.Question,
+		Voters:     newPoll.Voters,
+		Weights:    newPoll.Weights,
+		Id:         v.pollId,
+		Trustees:   trustees,
+		Threshold:  t,
+		Options:    newPoll.Options,
+		BallotType: newPoll.BallotType,
+		Opening:    newPoll.Opening,
+		Deadline:   newPoll.Deadline,
 	}
+	v.pollId++
+	return poll
 }
 
 func (v *VoteRumorer) CanVote(poll *PollTx) bool {
-	if v.blockchain.GetResult(poll.ID) != nil {
+	if v.blockchain.GetResult(poll.ID) != nil || !poll.Poll.IsOpen(time.Now()) {
 		return false
 	}
-	allowedTo := false
-	for _, voter := range poll.Poll.Voters {
-		if v.name == voter {
-			allowedTo = true
-			break
-		}
-	}
-	alreadyVoted := false
-	for _, vote := range v.blockchain.GetVotes(poll.ID) {
-		if vote.Vote.Origin == v.name {
-			alreadyVoted = true
-		}
-	}
-	return allowedTo && !alreadyVoted
+	return ballot.Weight(poll.Poll, v.name) > 0
 }
 
-func generateKey(bits int) *paillier.PrivateKey {
-	var p, q *big.Int
-
-	p, _ = rand.Prime(rand.Reader, bits/2)
-	q, _ = rand.Prime(rand.Reader, bits/2)
+// Whether our ballot on the poll is on the chain, voting again replaces it with a revote
+func (v *VoteRumorer) HasVoted(poll *PollTx) bool {
+	return v.blockchain.HasVoted(poll.ID, v.name)
+}
 
-	return paillier.CreatePrivateKey(p, q)
+func (v *VoteRumorer) Name() string {
+	return v.name
 }
@@ -3,7 +3,16 @@ $(document).ready(function () {
     let pollsEl = $("#polls");
     let questionEl = $("#add-poll-question");
     let votersEl = $("#add-poll-voters");
+    let trusteesEl = $("#add-poll-trustees");
+    let thresholdEl = $("#add-poll-threshold");
+    let optionsEl = $("#add-poll-options");
+    let ballotTypeEl = $("#add-poll-ballot-type");
+    let openingEl = $("#add-poll-opening");
+    let deadlineEl = $("#add-poll-deadline");
     let addButtonEl = $("#add-poll-button");
+    let receiptHashEl = $("#receipt-hash");
+    let receiptButtonEl = $("#receipt-button");
+    let receiptEl = $("#receipt");
 
     $.getJSON("../id", function (data) {
         nodeIdEl.html("<p>" + data.id + "</p>");
@@ -13,36 +22,134 @@ $(document).ready(function () {
     let pollIdsSet = new Set();
     let pollsList = [];
 
+    function optionsHtml(poll, id) {
+        let str = "<select id='" + id + "'>";
+        for (let j = 0; j < poll.options.length; j++) {
+            str += "<option value='" + j + "'>" + poll.options[j] + "</option>";
+        }
+        return str + "</select>";
+    }
+
+    function ballotHtml(poll) {
+        let str = "";
+        if (poll.ballotType === "single") {
+            str += " " + optionsHtml(poll, "select-vote-" + poll.id);
+        } else if (poll.ballotType === "approval") {
+            for (let j = 0; j < poll.options.length; j++) {
+                str += " <input type='checkbox' class='check-vote-" + poll.id + "' value='" + j + "'>" + poll.options[j];
+            }
+        } else if (poll.ballotType === "ranked") {
+            for (let j = 0; j < poll.options.length; j++) {
+                str += " " + (j + 1) + ". " + optionsHtml(poll, "select-rank-" + poll.id + "-" + j);
+            }
+        } else {
+            str += " <select id='select-vote-" + poll.id + "'><option value='0'>No</option><option value='1'>Yes</option></select>";
+        }
+        return str;
+    }
+
+    function resultHtml(poll) {
+        let result = poll.result;
+        let str = " RESULT ";
+        if (poll.ballotType === "single" || poll.ballotType === "approval") {
+            for (let j = 0; j < poll.options.length; j++) {
+                str += poll.options[j] + ": " + result.counts[j] + " ";
+            }
+        } else if (poll.ballotType === "ranked") {
+            str += "WINNER " + (result.winner === "" ? "none" : result.winner);
+            for (let j = 0; j < poll.options.length; j++) {
+                str += " " + poll.options[j] + ": " + result.points[j] + " points";
+            }
+        } else {
+            str += "YES " + result.counts[0] + " NO " + (result.weight - result.counts[0]);
+        }
+        if (result.finality === "final") {
+            str += " FINAL";
+        } else if (result.finality === "pending") {
+            str += " NOT FINAL YET";
+        }
+        return str + " (" + result.timestamp + ")";
+    }
+
     function constructPollHtml(poll) {
-        htmlStr = "ID " + poll.id + " QUESTION " + poll.question + " FROM " + poll.origin;
+        htmlStr = "ID " + poll.id + " QUESTION " + poll.question + " FROM " + poll.origin + " " + poll.state.toUpperCase();
+        if (poll.state === "upcoming") {
+            htmlStr += " (opens " + new Date(poll.opening).toLocaleString() + ")";
+        } else if (poll.state === "open" && !poll.deadline.startsWith("0001")) {
+            htmlStr += " (closes " + new Date(poll.deadline).toLocaleString() + ")";
+        }
         if (poll.canVote) {
-            htmlStr += " <select id='select-vote-" + poll.id + "'><option value='0'>No</option><option value='1'>Yes</option></select>" +
-                " <button type='button' class='button-vote' id='" + poll.id + "'>Vote</button>";
+            if (poll.weight > 1) {
+                htmlStr += " (your vote counts " + poll.weight + " times)";
+            }
+            htmlStr += ballotHtml(poll) +
+                " <button type='button' class='button-vote' id='" + poll.id + "'>" + (poll.voted ? "Change vote" : "Vote") + "</button>";
+            // Our vote goes to the delegate if we don't vote ourselves, an empty delegate revokes the delegation
+            htmlStr += " or delegate to <input type='text' id='input-delegate-" + poll.id + "' value='" + poll.delegate + "'>" +
+                " <button type='button' class='button-delegate' id='" + poll.id + "'>Delegate</button>";
 
         }
         if (poll.canCount) {
             htmlStr += " <button type='button' class='button-count' id='" + poll.id + "'>Count Votes</button>";
         }
-        if (poll.result.count >= 0) {
-            htmlStr += " RESULT " + poll.result.count + " (" + poll.result.timestamp + ")"
+        if (poll.result.counted) {
+            htmlStr += resultHtml(poll);
         }
         return htmlStr;
     }
 
+    function choices(poll) {
+        let chosen = [];
+        if (poll.ballotType === "single") {
+            chosen.push(parseInt($("#select-vote-" + poll.id).val()));
+        } else if (poll.ballotType === "approval") {
+            $(".check-vote-" + poll.id + ":checked").each(function () {
+                chosen.push(parseInt($(this).val()));
+            });
+        } else if (poll.ballotType === "ranked") {
+            for (let j = 0; j < poll.options.length; j++) {
+                chosen.push(parseInt($("#select-rank-" + poll.id + "-" + j).val()));
+            }
+        }
+        return chosen;
+    }
+
     function setClicks() {
         $(".button-vote").unbind("click");
         $(".button-count").unbind("click");
+        $(".button-delegate").unbind("click");
 
         $(".button-vote").click(function () {
             pollId = $(this).attr("id");
             console.log("Voting for  " + pollId);
+            poll = pollsList.find(function (p) {
+                return p.id == pollId;
+            });
             vote = $("#select-vote-" + pollId).val();
             $.ajax({
                 type: 'POST',
                 url: 'poll/' + pollId + "/vote",
-                data: JSON.stringify({"vote": vote}),
+                data: JSON.stringify({"vote": vote, "choices": choices(poll)}),
+                contentType: "application/json",
+                dataType: 'json'
+            }).done(function (data) {
+                // The hash of the vote, to check later whether it made it into the blockchain
+                receiptHashEl.val(data.txHash);
+                showReceipt(data.txHash);
+            });
+        });
+        $(".button-delegate").click(function () {
+            pollId = $(this).attr("id");
+            console.log("Delegating for " + pollId);
+            $.ajax({
+                type: 'POST',
+                url: 'poll/' + pollId + "/delegate",
+                data: JSON.stringify({"delegate": $("#input-delegate-" + pollId).val()}),
                 contentType: "application/json",
                 dataType: 'json'
+            }).done(function (data) {
+                receiptHashEl.val(data.txHash);
+                showReceipt(data.txHash);
             });
         });
         $(".button-count").click(function () {
@@ -93,7 +200,7 @@ $(document).ready(function () {
             for (i = 0; i < pollsList.length; i++) {
                 poll1 = pollsList[i];
                 poll2 = updatedPollIds.get(pollsList[i].id);
-                if (poll1.canCount != poll2.canCount || poll1.canVote != poll2.canVote || poll1.result.count != poll2.result.count) {
+                if (poll1.canCount != poll2.canCount || poll1.canVote != poll2.canVote || poll1.voted != poll2.voted || poll1.delegate != poll2.delegate || poll1.result.counted != poll2.result.counted || poll1.result.finality != poll2.result.finality || poll1.state != poll2.state) {
                     $("#polls li:nth-child(" + (i + 1) + ")").html(constructPollHtml(updatedPollIds.get(pollsList[i].id)));
                     console.log("Updating html of " + i);
                     console.log(JSON.stringify(poll1));
@@ -129,6 +236,7 @@ $(document).ready(function () {
                 prevHash.innerHTML = block.prevHash;
                 difficulty.innerHTML = block.difficulty;
             });
+            $("#hash-rate").text(Math.round(data.hashRate));
             if (oldBlockTable.parentNode != null) {
                 oldBlockTable.parentNode.replaceChild(newBlockTable, oldBlockTable);
             }
@@ -138,13 +246,44 @@ $(document).ready(function () {
         });
     }
 
+    function showReceipt(txHash) {
+        $.getJSON("receipt/" + txHash, function (data) {
+            if (data.status == "included") {
+                receiptEl.html("<p>Included in block " + data.blockId + " (" + data.proof.Header.Hash + "), " +
+                    data.confirmations + " confirmations" + (data.final ? ", final" : "") + "</p>");
+            } else {
+                receiptEl.html("<p>Pending: waiting to be included in a block</p>");
+            }
+        }).fail(function () {
+            receiptEl.html("<p>Unknown transaction</p>");
+        });
+    }
+
+    receiptButtonEl.click(function () {
+        showReceipt(receiptHashEl.val());
+    });
+
     addButtonEl.click(function () {
         $.ajax({
             type: 'POST',
             url: 'polls',
-            data: JSON.stringify({"question": questionEl.val(), "voters": votersEl.val()}),
+            data: JSON.stringify({
+                "question": questionEl.val(),
+                "voters": votersEl.val(),
+                "trustees": trusteesEl.val(),
+                "threshold": thresholdEl.val(),
+                "options": optionsEl.val(),
+                "ballotType": ballotTypeEl.val(),
+                "opening": openingEl.val(),
+                "deadline": deadlineEl.val()
+            }),
             contentType: "application/json",
             dataType: 'json'
+        }).fail(function (xhr) {
+            // The poll was refused, e.g. a ranked poll with too many options
+            if (xhr.status === 400) {
+                alert(xhr.responseText);
+            }
         });
     });
 
@@ -1,9 +1,12 @@
 package web
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/lukasdeloose/decentralized-voting-system/project/ballot"
+	"github.com/lukasdeloose/decentralized-voting-system/project/blockchain"
 	"github.com/lukasdeloose/decentralized-voting-system/project/constants"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/udp"
 	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
@@ -142,16 +145,30 @@ func (ws *WebServer) handlePostPrivate(w http.ResponseWriter, r *http.Request) {
 func (ws *WebServer) handleGetPolls(w http.ResponseWriter, r *http.Request) {
 	// Get all peers from the rumorer, encode them, and return them to the GUI client
 	type ResultJSON struct {
-		Count     int64     `json:"count"`
+		Counted   bool      `json:"counted"`
+		Votes     int       `json:"votes"`
+		Weight    int64     `json:"weight"` // Total weight of the ballots, the counts are weighted
+		Counts    []int64   `json:"counts"` // Yes votes, votes per option, or votes per rank and option
+		Winner    string    `json:"winner"` // Only for ranked polls
+		Points    []int64   `json:"points"` // Borda points of every option of a ranked poll
 		Timestamp time.Time `json:"timestamp"`
+		Finality  string    `json:"finality"` // final or pending, empty if the network has no validators
 	}
 	type PollJSON struct {
-		Question string     `json:"question"`
-		Origin   string     `json:"origin"`
-		ID       uint32     `json:"id"`
-		CanVote  bool       `json:"canVote"`
-		CanCount bool       `json:"canCount"`
-		Result   ResultJSON `json:"result"`
+		Question   string     `json:"question"`
+		Origin     string     `json:"origin"`
+		ID         uint32     `json:"id"`
+		BallotType string     `json:"ballotType"`
+		Options    []string   `json:"options"`
+		Opening    time.Time  `json:"opening"`
+		Deadline   time.Time  `json:"deadline"`
+		State      string     `json:"state"` // upcoming, open or closed
+		CanVote    bool       `json:"canVote"`
+		Voted      bool       `json:"voted"`    // Voting again replaces our ballot
+		Delegate   string     `json:"delegate"` // Who we delegated our vote to, if anyone
+		Weight     int64      `json:"weight"`   // Weight of our ballot, 0 if we can't vote
+		CanCount   bool       `json:"canCount"`
+		Result     ResultJSON `json:"result"`
 	}
 	type respStruct struct {
 		Polls []PollJSON `json:"polls"`
@@ -164,24 +181,57 @@ func (ws *WebServer) handleGetPolls(w http.ResponseWriter, r *http.Request) {
 		var resJSON ResultJSON
 		if res == nil {
 			resJSON = ResultJSON{
-				Count:     -1,
+				Counted:   false,
 				Timestamp: time.Time{},
 			}
 		} else {
 			resJSON = ResultJSON{
-				Count:     res.Result.Count,
+				Counted:   true,
+				Votes:     len(ws.blockchain.RetrieveVotes(poll.ID)),
+				Counts:    res.Result.Counts,
 				Timestamp: res.Result.Timestamp,
 			}
+			for _, weight := range ws.blockchain.VoteWeights(poll.ID) {
+				resJSON.Weight += weight
+			}
+			if ballot.Type(poll.Poll) == ballot.Ranked {
+				winner, points := ballot.Borda(len(poll.Poll.Options), res.Result.Counts)
+				if winner >= 0 {
+					resJSON.Winner = poll.Poll.Options[winner]
+				}
+				resJSON.Points = points
+			}
+			if ws.blockchain.HasFinality() {
+				resJSON.Finality = "pending"
+				if ws.blockchain.IsFinal(res.Hash()) {
+					resJSON.Finality = "final"
+				}
+			}
+		}
+		canCount := ws.voteRumorer.CanCount(poll)
+
+		state := "open"
+		if res != nil || poll.Poll.IsClosed(time.Now()) {
+			state = "closed"
+		} else if !poll.Poll.IsOpen(time.Now()) {
+			state = "upcoming"
 		}
-		canCount := ws.voteRumorer.PrivateKey(poll.Poll.Question, poll.Poll.Voters) != nil && ws.blockchain.GetResult(poll.ID) == nil
 
 		resp.Polls[i] = PollJSON{
-			Question: poll.Poll.Question,
-			Origin:   poll.Poll.Origin,
-			ID:       poll.ID,
-			CanVote:  ws.voteRumorer.CanVote(poll),
-			CanCount: canCount,
-			Result:   resJSON,
+			Question:   poll.Poll.Question,
+			Origin:     poll.Poll.Origin,
+			ID:         poll.ID,
+			BallotType: ballot.Type(poll.Poll),
+			Options:    poll.Poll.Options,
+			Opening:    poll.Poll.Opening,
+			Deadline:   poll.Poll.Deadline,
+			State:      state,
+			CanVote:    ws.voteRumorer.CanVote(poll),
+			Voted:      ws.voteRumorer.HasVoted(poll),
+			Delegate:   ws.blockchain.DelegateOf(ws.voteRumorer.Name(), poll.ID),
+			Weight:     ballot.Weight(poll.Poll, ws.voteRumorer.Name()),
+			CanCount:   canCount,
+			Result:     resJSON,
 		}
 	}
 
@@ -207,7 +257,8 @@ func (ws *WebServer) handlePostVote(w http.ResponseWriter, r *http.Request) {
 	// Decode the message and send it to the gossiper over UDP
 	decoder := json.NewDecoder(r.Body)
 	var data struct {
-		Vote string `json:"vote"`
+		Vote    string   `json:"vote"`
+		Choices []uint32 `json:"choices"` // Indices of the chosen options, in order of preference for ranked polls
 	}
 	err = decoder.Decode(&data)
 	if err != nil {
@@ -222,11 +273,61 @@ func (ws *WebServer) handlePostVote(w http.ResponseWriter, r *http.Request) {
 		vote = true
 	}
 
-	ws.voteRumorer.UIIn() <- &VotingMessage{
-		NewVote: &NewVote{
-			Pollid: pollId,
-			Vote:   vote,
-		},
+	// Vote right away instead of through the UI channel, to return the hash of the vote for its receipt
+	txHash := ws.voteRumorer.Vote(&NewVote{
+		Pollid:  pollId,
+		Vote:    vote,
+		Choices: data.Choices,
+	})
+	if txHash == "" {
+		http.Error(w, "could not cast vote", http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(struct {
+		TxHash string `json:"txHash"`
+	}{txHash})
+	if err != nil {
+		fmt.Printf("ERROR: could not encode vote: %v\n", err)
+	}
+}
+
+func (ws *WebServer) handlePostDelegate(w http.ResponseWriter, r *http.Request) {
+	// Parse pollid from request
+	vars := mux.Vars(r)
+	pollIdStr := vars["pollId"]
+	pollIdInt, err := strconv.Atoi(pollIdStr)
+	if err != nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] Could not convert pollid %v from request\n", pollIdStr)
+		}
+		return
+	}
+
+	var data struct {
+		Delegate string `json:"delegate"` // Empty to revoke the delegation
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		if constants.Debug {
+			fmt.Printf("[DEBUG] Could not decode json from request\n")
+		}
+		return
+	}
+
+	txHash := ws.voteRumorer.Delegate(&NewDelegation{
+		Delegate: data.Delegate,
+		Pollid:   uint32(pollIdInt),
+	})
+	if txHash == "" {
+		http.Error(w, "could not delegate", http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(struct {
+		TxHash string `json:"txHash"`
+	}{txHash})
+	if err != nil {
+		fmt.Printf("ERROR: could not encode delegation: %v\n", err)
 	}
 }
 
@@ -253,24 +354,88 @@ func (ws *WebServer) handlePostPolls(w http.ResponseWriter, r *http.Request) {
 	// Decode the message and send it to the gossiper over UDP
 	decoder := json.NewDecoder(r.Body)
 	var data struct {
-		Question string `json:"question"`
-		Voters   string `json:"voters"`
+		Question   string `json:"question"`
+		Voters     string `json:"voters"`
+		Trustees   string `json:"trustees"`
+		Threshold  string `json:"threshold"`
+		Options    string `json:"options"`
+		BallotType string `json:"ballotType"`
+		Opening    string `json:"opening"`  // Local time, as sent by a datetime-local input
+		Deadline   string `json:"deadline"` // Local time, as sent by a datetime-local input
 	}
 	err := decoder.Decode(&data)
 	if err != nil {
-		panic(err)
+		http.Error(w, "invalid poll: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	votersSlice := strings.Split(data.Voters, "\n")
+	// Voters can have a weight: name:weight
+	votersSlice, weights, err := ballot.ParseVoters(strings.Split(data.Voters, "\n"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trusteesSlice := make([]string, 0)
+	for _, trustee := range strings.Split(data.Trustees, "\n") {
+		if trustee != "" {
+			trusteesSlice = append(trusteesSlice, trustee)
+		}
+	}
+	optionsSlice := make([]string, 0)
+	for _, option := range strings.Split(data.Options, "\n") {
+		if option != "" {
+			optionsSlice = append(optionsSlice, option)
+		}
+	}
+	opening, err := parseLocalTime(data.Opening)
+	if err != nil {
+		http.Error(w, "invalid opening: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	deadline, err := parseLocalTime(data.Deadline)
+	if err != nil {
+		http.Error(w, "invalid deadline: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	threshold, err := strconv.Atoi(data.Threshold)
+	if err != nil && len(trusteesSlice) > 0 {
+		http.Error(w, "invalid threshold: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Tell the user instead of dropping the poll, e.g. a ranked poll of which the ballots don't fit in a packet
+	checked := &Poll{Options: optionsSlice, BallotType: data.BallotType, Voters: votersSlice, Weights: weights}
+	err = ballot.CheckPoll(checked)
+	if err == nil {
+		err = ws.blockchain.CheckBallotSize(checked)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	ws.voteRumorer.UIIn() <- &VotingMessage{
 		NewPoll: &NewPoll{
-			Question: data.Question,
-			Voters:   votersSlice,
+			Question:   data.Question,
+			Voters:     votersSlice,
+			Weights:    weights,
+			Trustees:   trusteesSlice,
+			Threshold:  uint32(threshold),
+			Options:    optionsSlice,
+			BallotType: data.BallotType,
+			Opening:    opening,
+			Deadline:   deadline,
 		},
 	}
 
 }
 
+// Parse a time sent by a datetime-local input, the zero time if empty
+func parseLocalTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", str, time.Local)
+}
+
 func (ws *WebServer) handleGetBlockchain(w http.ResponseWriter, r *http.Request) {
 
 	type TransactionsJSON struct {
@@ -292,11 +457,12 @@ func (ws *WebServer) handleGetBlockchain(w http.ResponseWriter, r *http.Request)
 	}
 
 	type respStruct struct {
-		Blocks []BlockJSON `json:"blocks"`
+		Blocks   []BlockJSON `json:"blocks"`
+		HashRate float64     `json:"hashRate"` // Hashes per second of our miner, for proof-of-work
 	}
 	blocks := ws.blockchain.Blocks
 
-	resp := respStruct{Blocks: make([]BlockJSON, len(blocks))}
+	resp := respStruct{Blocks: make([]BlockJSON, len(blocks)), HashRate: ws.blockchain.HashRate()}
 	for i, block := range blocks {
 		resp.Blocks[i] = BlockJSON{
 			Timestamp:  block.Timestamp,
@@ -314,3 +480,35 @@ func (ws *WebServer) handleGetBlockchain(w http.ResponseWriter, r *http.Request)
 		fmt.Printf("ERROR: could net encode polls: %v\n", err)
 	}
 }
+
+// Receipt of a transaction: whether it is pending or in a block, and if so, the proof that it is
+func (ws *WebServer) handleGetReceipt(w http.ResponseWriter, r *http.Request) {
+	txHash, err := hex.DecodeString(mux.Vars(r)["txhash"])
+	if err != nil {
+		http.Error(w, "invalid transaction hash", http.StatusBadRequest)
+		return
+	}
+
+	receipt := ws.blockchain.Receipt(txHash)
+	if receipt.Status == TxUnknown {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	err = json.NewEncoder(w).Encode(receipt)
+	if err != nil {
+		fmt.Printf("ERROR: could not encode receipt: %v\n", err)
+	}
+}
+
+// Headers of the main chain, to check the inclusion proof of a receipt of another node against
+func (ws *WebServer) handleGetHeaders(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(ws.blockchain.Headers()); err != nil {
+		fmt.Printf("ERROR: could not encode headers: %v\n", err)
+	}
+}
+
+// The whole main chain with all transactions, see blockchain.ChainExport
+func (ws *WebServer) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	if err := blockchain.WriteExport(w, ws.blockchain.Export()); err != nil {
+		fmt.Printf("ERROR: could not export the blockchain: %v\n", err)
+	}
+}
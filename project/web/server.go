@@ -14,9 +14,8 @@ import (
 type WebServer struct {
 	rumorer        *Rumorer
 	privateRumorer *PrivateRumorer
-	voteRumorer *VoteRumorer
-	blockchain *Blockchain
-
+	voteRumorer    *VoteRumorer
+	blockchain     *Blockchain
 
 	router *mux.Router
 	server *http.Server
@@ -47,8 +46,12 @@ func NewWebServer(rumorer *Rumorer, privateRumorer *PrivateRumorer, voteRumorer
 	ws.router.HandleFunc("/voting/polls", ws.handleGetPolls).Methods("GET")
 	ws.router.HandleFunc("/voting/poll/{pollId}/vote", ws.handlePostVote).Methods("POST")
 	ws.router.HandleFunc("/voting/poll/{pollId}/count", ws.handlePostCount).Methods("POST")
+	ws.router.HandleFunc("/voting/poll/{pollId}/delegate", ws.handlePostDelegate).Methods("POST")
 	ws.router.HandleFunc("/voting/polls", ws.handlePostPolls).Methods("POST")
 	ws.router.HandleFunc("/voting/blockchain", ws.handleGetBlockchain).Methods("GET")
+	ws.router.HandleFunc("/voting/receipt/{txhash}", ws.handleGetReceipt).Methods("GET")
+	ws.router.HandleFunc("/voting/headers", ws.handleGetHeaders).Methods("GET")
+	ws.router.HandleFunc("/voting/export", ws.handleGetExport).Methods("GET")
 
 	// Serve static files (Note: relative path from Peerster root)
 	ws.router.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("web/assets"))))
@@ -0,0 +1,258 @@
+package zkp
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+)
+
+// Non-interactive zero-knowledge proofs about ElGamal ciphertexts (see package elgamal).
+//
+// A membership proof shows that a ciphertext (A, B) under the public key h encrypts one of a set of allowed
+// values v_1..v_k, without revealing which one. It encrypts v_i with randomness r iff A = g^r and
+// B / g^v_i = h^r, so the proof is a disjunction (Cramer-Damgard-Schoenmakers) of k Chaum-Pedersen proofs
+// of equal discrete logs, of which all but the true one are simulated. The challenge is derived with
+// Fiat-Shamir.
+
+// Prove that c = Enc(allowed[index], r) encrypts one of the allowed values.
+// The proof is bound to context (e.g. the voter and the poll), so it can't be reused elsewhere
+func ProveMembership(group *elgamal.Group, h *big.Int, c *elgamal.Ciphertext, r *big.Int, allowed []*big.Int,
+	index int, context []byte) (*BallotProof, error) {
+	if index < 0 || index >= len(allowed) {
+		return nil, errors.New("index out of range")
+	}
+
+	// Two commitments for every allowed value: g^rho and h^rho
+	commitments := make([]*big.Int, 2*len(allowed))
+	challenges := make([]*big.Int, len(allowed))
+	responses := make([]*big.Int, len(allowed))
+
+	// Simulate the proofs for the values that are not encrypted: g^z / A^e and h^z / (B/g^v)^e
+	for j := range allowed {
+		if j == index {
+			continue
+		}
+		e, err := group.RandomExponent()
+		if err != nil {
+			return nil, err
+		}
+		z, err := group.RandomExponent()
+		if err != nil {
+			return nil, err
+		}
+		commitments[2*j] = group.Div(group.Pow(z), group.Exp(c.A, e))
+		commitments[2*j+1] = group.Div(group.Exp(h, z), group.Exp(residue(group, c, allowed[j]), e))
+		challenges[j] = e
+		responses[j] = z
+	}
+
+	// Real proof for the encrypted value
+	rho, err := group.RandomExponent()
+	if err != nil {
+		return nil, err
+	}
+	commitments[2*index] = group.Pow(rho)
+	commitments[2*index+1] = group.Exp(h, rho)
+
+	// The challenges have to add up to the Fiat-Shamir challenge
+	e := challenge(group, h, c, allowed, commitments, context)
+	for j := range allowed {
+		if j != index {
+			e.Sub(e, challenges[j])
+		}
+	}
+	challenges[index] = e.Mod(e, group.Q)
+
+	// z = rho + e*r mod q
+	z := new(big.Int).Mul(challenges[index], r)
+	z.Add(z, rho)
+	responses[index] = z.Mod(z, group.Q)
+
+	return &BallotProof{
+		Commitments: toBytes(commitments),
+		Challenges:  toBytes(challenges),
+		Responses:   toBytes(responses),
+	}, nil
+}
+
+// Verify that c encrypts one of the allowed values
+func VerifyMembership(group *elgamal.Group, h *big.Int, c *elgamal.Ciphertext, allowed []*big.Int,
+	proof *BallotProof, context []byte) bool {
+	if proof == nil || len(proof.Commitments) != 2*len(allowed) || len(proof.Challenges) != len(allowed) ||
+		len(proof.Responses) != len(allowed) {
+		return false
+	}
+	if !group.Contains(h) || !group.Contains(c.A) || !group.Contains(c.B) {
+		return false
+	}
+
+	commitments := fromBytes(proof.Commitments)
+	challenges := fromBytes(proof.Challenges)
+	responses := fromBytes(proof.Responses)
+
+	sum := new(big.Int)
+	for k := range allowed {
+		a, b, e, z := commitments[2*k], commitments[2*k+1], challenges[k], responses[k]
+		if e.Cmp(group.Q) >= 0 || z.Cmp(group.Q) >= 0 {
+			return false
+		}
+		// g^z = a * A^e and h^z = b * (B/g^v)^e
+		if group.Pow(z).Cmp(group.Mul(a, group.Exp(c.A, e))) != 0 {
+			return false
+		}
+		if group.Exp(h, z).Cmp(group.Mul(b, group.Exp(residue(group, c, allowed[k]), e))) != 0 {
+			return false
+		}
+		sum.Add(sum, e)
+	}
+
+	e := challenge(group, h, c, allowed, commitments, context)
+	return sum.Mod(sum, group.Q).Cmp(e) == 0
+}
+
+// B / g^v, h^r iff c encrypts v with randomness r
+func residue(group *elgamal.Group, c *elgamal.Ciphertext, v *big.Int) *big.Int {
+	return group.Div(c.B, group.Pow(v))
+}
+
+// Fiat-Shamir challenge: hash of everything the verifier knows, modulo q
+func challenge(group *elgamal.Group, h *big.Int, c *elgamal.Ciphertext, allowed []*big.Int,
+	commitments []*big.Int, context []byte) *big.Int {
+	hash := sha256.New()
+	write := func(bs []byte) {
+		length := big.NewInt(int64(len(bs))).FillBytes(make([]byte, 4))
+		hash.Write(length)
+		hash.Write(bs)
+	}
+	write(context)
+	write(group.P.Bytes())
+	write(group.G.Bytes())
+	write(h.Bytes())
+	write(c.A.Bytes())
+	write(c.B.Bytes())
+	for _, v := range allowed {
+		write(v.Bytes())
+	}
+	for _, a := range commitments {
+		write(a.Bytes())
+	}
+	e := new(big.Int).SetBytes(hash.Sum(nil))
+	return e.Mod(e, group.Q)
+}
+
+func toBytes(ints []*big.Int) [][]byte {
+	res := make([][]byte, len(ints))
+	for i, x := range ints {
+		res[i] = x.Bytes()
+	}
+	return res
+}
+
+func fromBytes(bs [][]byte) []*big.Int {
+	res := make([]*big.Int, len(bs))
+	for i, b := range bs {
+		res[i] = new(big.Int).SetBytes(b)
+	}
+	return res
+}
+
+// Allowed values of an entry of a ballot of a voter with the given weight: 0, or the weight for a chosen entry
+func WeightedBallot(weight int64) []*big.Int {
+	return []*big.Int{big.NewInt(0), big.NewInt(weight)}
+}
+
+// Context a ballot proof is bound to: a proof can't be copied to a vote of another voter or poll
+func BallotContext(origin string, pollid uint32) []byte {
+	return []byte(fmt.Sprintf("ballot|%v|%v", origin, pollid))
+}
+
+// Encrypt every entry of a ballot of a voter with the given weight: weight times the entry, which is 0 or 1.
+// Prove that every encrypted entry is 0 or the weight, and that exactly one entry of every group of oneHot
+// (indices of entries) is chosen: the product of the ciphertexts of the group, an encryption of their sum,
+// encrypts the weight
+func EncryptBallot(group *elgamal.Group, h *big.Int, entries []int64, weight int64, oneHot [][]int,
+	context []byte) ([][]byte, []*BallotProof, []*BallotProof, error) {
+	if weight < 1 {
+		return nil, nil, nil, errors.New("weight has to be positive")
+	}
+	vote := make([][]byte, len(entries))
+	proofs := make([]*BallotProof, len(entries))
+	ciphertexts := make([]*elgamal.Ciphertext, len(entries))
+	randomness := make([]*big.Int, len(entries))
+	for i, entry := range entries {
+		if entry != 0 && entry != 1 {
+			return nil, nil, nil, errors.New("ballot entries have to be 0 or 1")
+		}
+		c, r, err := group.Encrypt(h, big.NewInt(entry*weight))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		proofs[i], err = ProveMembership(group, h, c, r, WeightedBallot(weight), int(entry), entryContext(context, i))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		vote[i] = group.Marshal(c)
+		ciphertexts[i] = c
+		randomness[i] = r
+	}
+
+	sumProofs := make([]*BallotProof, len(oneHot))
+	for k, indices := range oneHot {
+		product := elgamal.Zero()
+		productR := new(big.Int)
+		for _, i := range indices {
+			if i < 0 || i >= len(entries) {
+				return nil, nil, nil, errors.New("one-hot group out of the ballot")
+			}
+			product = group.Add(product, ciphertexts[i])
+			productR.Add(productR, randomness[i]).Mod(productR, group.Q)
+		}
+		var err error
+		sumProofs[k], err = ProveMembership(group, h, product, productR, []*big.Int{big.NewInt(weight)}, 0,
+			sumContext(context, k))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return vote, proofs, sumProofs, nil
+}
+
+// Verify the proofs of an encrypted ballot of a voter with the given weight, see EncryptBallot
+func VerifyBallot(group *elgamal.Group, h *big.Int, vote [][]byte, proofs []*BallotProof, sumProofs []*BallotProof,
+	weight int64, oneHot [][]int, context []byte) bool {
+	if len(proofs) != len(vote) || len(sumProofs) != len(oneHot) || weight < 1 {
+		return false
+	}
+	ciphertexts := make([]*elgamal.Ciphertext, len(vote))
+	for i, entry := range vote {
+		c, err := group.Unmarshal(entry)
+		if err != nil || !VerifyMembership(group, h, c, WeightedBallot(weight), proofs[i], entryContext(context, i)) {
+			return false
+		}
+		ciphertexts[i] = c
+	}
+	for k, indices := range oneHot {
+		product := elgamal.Zero()
+		for _, i := range indices {
+			if i < 0 || i >= len(vote) {
+				return false
+			}
+			product = group.Add(product, ciphertexts[i])
+		}
+		if !VerifyMembership(group, h, product, []*big.Int{big.NewInt(weight)}, sumProofs[k], sumContext(context, k)) {
+			return false
+		}
+	}
+	return true
+}
+
+func entryContext(context []byte, i int) []byte {
+	return []byte(fmt.Sprintf("%s|%v", context, i))
+}
+
+func sumContext(context []byte, k int) []byte {
+	return []byte(fmt.Sprintf("%s|sum|%v", context, k))
+}
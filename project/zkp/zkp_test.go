@@ -0,0 +1,138 @@
+package zkp
+
+import (
+	"github.com/lukasdeloose/decentralized-voting-system/project/elgamal"
+	. "github.com/lukasdeloose/decentralized-voting-system/project/utils"
+	"math/big"
+	"testing"
+)
+
+func testKey(t *testing.T) (*elgamal.Group, *big.Int) {
+	group, err := elgamal.StandardGroup(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := group.RandomExponent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return group, group.Pow(x)
+}
+
+func TestMembership(t *testing.T) {
+	group, h := testKey(t)
+	context := BallotContext("alice", 1)
+
+	tests := []struct {
+		name    string
+		value   int64 // Encrypted value
+		index   int   // Index of the allowed value the proof claims
+		allowed []*big.Int
+		context []byte // Context of the verification
+		valid   bool
+	}{
+		{"0", 0, 0, WeightedBallot(1), context, true},
+		{"1", 1, 1, WeightedBallot(1), context, true},
+		{"weighted", 5, 1, WeightedBallot(5), context, true},
+		{"single allowed value", 3, 0, []*big.Int{big.NewInt(3)}, context, true},
+		{"out of the set", 2, 1, WeightedBallot(1), context, false},
+		{"other value of the set", 1, 0, WeightedBallot(1), context, false},
+		{"other voter", 1, 1, WeightedBallot(1), BallotContext("bob", 1), false},
+		{"other poll", 1, 1, WeightedBallot(1), BallotContext("alice", 2), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, r, err := group.Encrypt(h, big.NewInt(test.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof, err := ProveMembership(group, h, c, r, test.allowed, test.index, context)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if VerifyMembership(group, h, c, test.allowed, proof, test.context) != test.valid {
+				t.Errorf("expected valid = %v", test.valid)
+			}
+		})
+	}
+}
+
+func TestVerifyBallot(t *testing.T) {
+	group, h := testKey(t)
+	context := BallotContext("alice", 1)
+
+	// Ciphertext of which A is not in the group: p-1 is not a square modulo a safe prime
+	notInGroup := make([]byte, 2*group.ElementSize())
+	new(big.Int).Sub(group.P, big.NewInt(1)).FillBytes(notInGroup[:group.ElementSize()])
+	big.NewInt(1).FillBytes(notInGroup[group.ElementSize():])
+
+	// One-hot groups of a single choice ballot of 3 options, and of a ranked ballot of 2 options: both ranks
+	// and both options
+	single := [][]int{{0, 1, 2}}
+	ranked := [][]int{{0, 1}, {2, 3}, {0, 2}, {1, 3}}
+
+	tests := []struct {
+		name    string
+		entries []int64
+		weight  int64
+		oneHot  [][]int
+		tamper  func(vote [][]byte, proofs []*BallotProof) // Changes the ballot before it is verified
+		valid   bool
+	}{
+		{"yes", []int64{1}, 1, nil, nil, true},
+		{"approval", []int64{1, 0, 1}, 1, nil, nil, true},
+		{"single choice", []int64{0, 1, 0}, 3, single, nil, true},
+		{"no choice in one-hot ballot", []int64{0, 0, 0}, 1, single, nil, false},
+		{"two choices in one-hot ballot", []int64{1, 1, 0}, 1, single, nil, false},
+		{"ranking", []int64{0, 1, 1, 0}, 2, ranked, nil, true},
+		{"option ranked twice", []int64{1, 0, 1, 0}, 1, ranked, nil, false},
+		{"rank without option", []int64{1, 0, 0, 0}, 1, ranked, nil, false},
+		{"forged ciphertext", []int64{0, 1}, 1, nil, func(vote [][]byte, proofs []*BallotProof) {
+			c, _, _ := group.Encrypt(h, big.NewInt(1))
+			vote[0] = group.Marshal(c)
+		}, false},
+		{"swapped entries", []int64{0, 1}, 1, nil, func(vote [][]byte, proofs []*BallotProof) {
+			vote[0], vote[1] = vote[1], vote[0]
+		}, false},
+		{"ciphertext not in the group", []int64{1}, 1, nil, func(vote [][]byte, proofs []*BallotProof) {
+			vote[0] = notInGroup
+		}, false},
+		{"missing proof", []int64{1}, 1, nil, func(vote [][]byte, proofs []*BallotProof) {
+			proofs[0] = nil
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vote, proofs, sumProofs, err := EncryptBallot(group, h, test.entries, test.weight, test.oneHot, context)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.tamper != nil {
+				test.tamper(vote, proofs)
+			}
+			if VerifyBallot(group, h, vote, proofs, sumProofs, test.weight, test.oneHot, context) != test.valid {
+				t.Errorf("expected valid = %v", test.valid)
+			}
+		})
+	}
+}
+
+func TestEncryptBallotRejectsInvalidEntries(t *testing.T) {
+	group, h := testKey(t)
+	tests := []struct {
+		name    string
+		entries []int64
+		weight  int64
+	}{
+		{"entry above 1", []int64{2}, 1},
+		{"negative entry", []int64{-1}, 1},
+		{"no weight", []int64{1}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, err := EncryptBallot(group, h, test.entries, test.weight, nil, nil); err == nil {
+				t.Error("invalid ballot encrypted")
+			}
+		})
+	}
+}